@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import "maptiles"
+
+// exportCommand writes cached tiles of layers to a
+// {layer}/{z}/{x}/{y}.{format} file tree.
+func exportCommand(args []string) {
+	var layers, dir string
+	var tms bool
+	flags := newFlagSet("export")
+	flags.StringVar(&layers, "layers", "", "comma separated tile layers to export (default all)")
+	flags.StringVar(&dir, "o", "tiles", "output directory")
+	flags.BoolVar(&tms, "tms", false, "use TMS row numbering")
+	flags.Parse(args)
+	getConfig()
+
+	db := openTileDb()
+	defer db.Close()
+	metadata, err := db.GetTileLayers()
+	exitOnError(err)
+
+	var names []string
+	if "" != layers {
+		names = strings.Split(layers, ",")
+	} else {
+		for name := range metadata {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		layer, ok := metadata[name]
+		if !ok {
+			exitOnError(fmt.Errorf("Tile layer not found in tile cache: %v", name))
+		}
+		exported, err := exportLayer(db, layer, dir, tms)
+		exitOnError(err)
+		fmt.Println("Exported tiles of", name+":", exported)
+	}
+	maptiles.Ligneous.Flush()
+}
+
+// exportLayer writes cached tiles of layer to dir.
+func exportLayer(db maptiles.TileDb, layer maptiles.LayerMetadata, dir string, tms bool) (int, error) {
+	exported := 0
+	zoom, column, row := int64(-1), int64(-1), int64(-1)
+	for {
+		tiles, err := db.ReadTiles(layer.Name, false, zoom, column, row, 500)
+		if nil != err {
+			return exported, err
+		}
+		if 0 == len(tiles) {
+			return exported, nil
+		}
+		for _, tile := range tiles {
+			c := tile.Coord
+			y := c.Y
+			if !tms {
+				y = (1 << c.Zoom) - c.Y - 1
+			}
+			path := filepath.Join(dir, layer.Name, fmt.Sprint(c.Zoom), fmt.Sprint(c.X), fmt.Sprintf("%v.%v", y, layer.Format))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+				return exported, err
+			}
+			if err := ioutil.WriteFile(path, tile.BlobPNG, 0644); nil != err {
+				return exported, err
+			}
+			exported++
+		}
+		last := tiles[len(tiles)-1].Coord
+		zoom, column, row = int64(last.Zoom), int64(last.X), int64(last.Y)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+import "maptiles"
+
+// layersCommand lists, adds or removes tile layers of the tile cache.
+// Layers in the tile cache are loaded by the tile server on startup.
+func layersCommand(args []string) {
+	action := "list"
+	if 0 != len(args) && '-' != args[0][0] {
+		action, args = args[0], args[1:]
+	}
+
+	var name, source string
+	var purge bool
+	flags := newFlagSet("layers " + action)
+	switch action {
+	case "list":
+	case "add":
+		flags.StringVar(&name, "name", "", "tile layer name")
+		flags.StringVar(&source, "source", "", "mapnik stylesheet or tile url (default source from config)")
+	case "remove":
+		flags.StringVar(&name, "name", "", "tile layer name")
+		flags.BoolVar(&purge, "purge", false, "delete cached tiles")
+	default:
+		exitOnError(fmt.Errorf("Unknown layers command %v, expecting list, add or remove", action))
+	}
+	flags.Parse(args)
+	getConfig()
+
+	db := openTileDb()
+	defer db.Close()
+	switch action {
+	case "list":
+		metadata, err := db.GetTileLayers()
+		exitOnError(err)
+		var names []string
+		for name := range metadata {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%v\t%v\n", name, maptiles.RedactPassword(metadata[name].Source, ""))
+		}
+	case "add":
+		if "" == name {
+			exitOnError(fmt.Errorf("Missing tile layer -name"))
+		}
+		layerConfig := maptiles.NewLayerConfig(source)
+		if "" == source {
+			layerConfig = getLayerConfig(name)
+		}
+		exitOnError(layerConfig.Validate())
+		exitOnError(db.AddLayerMetadata(layerConfig.Metadata(name)))
+		fmt.Println("Added tile layer", name)
+	case "remove":
+		if "" == name {
+			exitOnError(fmt.Errorf("Missing tile layer -name"))
+		}
+		exitOnError(db.DeleteLayer(name, purge))
+		fmt.Println("Removed tile layer", name)
+	}
+	maptiles.Ligneous.Flush()
+}
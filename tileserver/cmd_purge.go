@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+import "maptiles"
+
+// purgeCommand deletes cached tiles of layers.
+func purgeCommand(args []string) {
+	var layers string
+	flags := newFlagSet("purge")
+	flags.StringVar(&layers, "layers", "", "comma separated tile layers to purge")
+	flags.Parse(args)
+	getConfig()
+
+	if "" == layers {
+		exitOnError(fmt.Errorf("Missing -layers to purge"))
+	}
+
+	db := openTileDb()
+	defer db.Close()
+	for _, name := range strings.Split(layers, ",") {
+		exitOnError(db.PurgeLayer(name))
+		fmt.Println("Purged tiles of", name)
+	}
+	maptiles.Ligneous.Flush()
+}
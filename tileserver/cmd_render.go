@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/png"
+)
+
+import (
+	"georef"
+	"mapnik"
+	"maptiles"
+)
+
+// renderCommand renders a map image of a bounding box to file, or a
+// pdf, svg or ps document with cairo.
+// Images are written as GeoTIFF for .tif output files, world files
+// and .prj files are written next to other images on request.
+func renderCommand(args []string) {
+	var layer, source, bbox, format, output string
+	var width, height int
+	var world bool
+	flags := newFlagSet("render")
+	flags.StringVar(&layer, "layer", "", "tile layer from config")
+	flags.StringVar(&source, "stylesheet", "", "mapnik stylesheet, instead of -layer")
+	flags.StringVar(&bbox, "bbox", "-180,-85,180,85", "west,south,east,north bounds")
+	flags.IntVar(&width, "width", 1024, "image width")
+	flags.IntVar(&height, "height", 768, "image height")
+	flags.StringVar(&format, "format", "", "mapnik format [png, png256, jpeg, webp, pdf, svg, ps, ...], from the output file extension by default")
+	flags.StringVar(&output, "o", "map.png", "output file, GeoTIFF for .tif and .tiff")
+	flags.BoolVar(&world, "world", false, "write world file and .prj file")
+	flags.Parse(args)
+
+	if "" == source {
+		getConfig()
+		source = getLayerConfig(layer).Source
+	}
+	bounds, err := parseBounds(bbox)
+	exitOnError(err)
+	if width <= 0 || height <= 0 {
+		exitOnError(fmt.Errorf("Invalid image size: %vx%v", width, height))
+	}
+
+	m := mapnik.NewMap(uint32(width), uint32(height))
+	defer m.Free()
+	if err := m.Load(source); nil != err {
+		exitOnError(fmt.Errorf("Unable to load mapnik stylesheet %v: %v", source, err))
+	}
+
+	// Project bounds from LatLong(EPSG:4326) to the map projection
+	p := m.Projection()
+	defer p.Free()
+	ll := p.Forward(mapnik.Coord{X: bounds[0], Y: bounds[1]})
+	ur := p.Forward(mapnik.Coord{X: bounds[2], Y: bounds[3]})
+	m.ZoomToMinMax(ll.X, ll.Y, ur.X, ur.Y)
+
+	var g georef.Georeference
+	if world || georef.IsGeoTIFF(output) {
+		srid, ok := georef.SRIDFromProj4(m.SRS())
+		if !ok {
+			exitOnError(fmt.Errorf("Georeferencing needs a map in EPSG:3857 or EPSG:4326: %v", m.SRS()))
+		}
+		minx, miny, maxx, maxy := m.CurrentExtent()
+		g = georef.Georeference{SRID: srid, Bounds: [4]float64{minx, miny, maxx, maxy}, Width: width, Height: height}
+	}
+
+	if georef.IsGeoTIFF(output) {
+		blob, err := m.RenderToMemory("png")
+		exitOnError(err)
+		img, _, err := image.Decode(bytes.NewReader(blob))
+		exitOnError(err)
+		exitOnError(georef.SaveGeoTIFF(output, img, g))
+	} else {
+		if "" == format {
+			format = mapnik.FormatFromPath(output)
+		}
+		if "" == format {
+			format = "png"
+		}
+		exitOnError(m.RenderToFileFormat(output, format))
+	}
+	if world {
+		exitOnError(georef.WriteSidecars(output, g))
+	}
+	maptiles.Ligneous.Info("Rendered ", output)
+	maptiles.Ligneous.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+)
+
+import "maptiles"
+
+// seedCommand renders tiles of a layer into the tile cache.
+func seedCommand(args []string) {
+	var layer, bbox string
+	var minZoom, maxZoom, batch int
+	flags := newFlagSet("seed")
+	flags.StringVar(&layer, "layer", "", "tile layer from config")
+	flags.StringVar(&bbox, "bbox", "", "west,south,east,north bounds (default layer bounds)")
+	flags.IntVar(&minZoom, "minz", -1, "min zoom level (default layer minzoom)")
+	flags.IntVar(&maxZoom, "maxz", -1, "max zoom level (default layer maxzoom)")
+	flags.IntVar(&batch, "batch", 100, "tiles per cache write")
+	flags.Parse(args)
+	getConfig()
+
+	layerConfig := getLayerConfig(layer)
+	db := openTileDb()
+	defer db.Close()
+	seeder := maptiles.Seeder{
+		Db:        db,
+		Layer:     layer,
+		Config:    layerConfig,
+		Bounds:    layerConfig.Bounds,
+		MinZoom:   uint64(layerConfig.MinZoom),
+		MaxZoom:   uint64(layerConfig.MaxZoom),
+		BatchSize: batch,
+	}
+	if "" != bbox {
+		bounds, err := parseBounds(bbox)
+		exitOnError(err)
+		seeder.Bounds = bounds
+	}
+	if minZoom >= 0 {
+		seeder.MinZoom = uint64(minZoom)
+	}
+	if maxZoom >= 0 {
+		seeder.MaxZoom = uint64(maxZoom)
+	}
+
+	seeded, err := seeder.Run()
+	exitOnError(err)
+	fmt.Println("Seeded tiles:", seeded)
+	maptiles.Ligneous.Flush()
+}
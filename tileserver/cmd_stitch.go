@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"os"
+)
+
+import (
+	"georef"
+	"maptiles"
+	"stitch"
+)
+
+// stitchCommand stitches tiles within bounds into a png, or a GeoTIFF for
+// .tif output files, cropped to the bounds. Tiles are rendered for a layer
+// of the config, read from an MBTiles or tile cache file or fetched from a
+// tile server url.
+func stitchCommand(args []string) {
+	var layer, bbox, output, url, mbtiles string
+	var zoom, tileSize, workers, retries int
+	var maxPixels int64
+	var world bool
+	flags := newFlagSet("stitch")
+	flags.StringVar(&layer, "layer", "", "tile layer from config, or of the tile cache with -mbtiles")
+	flags.StringVar(&url, "url", "", "tile url template with {z}, {x} and {y} or {-y}")
+	flags.StringVar(&mbtiles, "mbtiles", "", "MBTiles or sqlite tile cache file")
+	flags.StringVar(&bbox, "bbox", "-180,-85,180,85", "west,south,east,north bounds")
+	flags.IntVar(&zoom, "z", 3, "zoom level")
+	flags.IntVar(&tileSize, "tile_size", 256, "tile size of -url and -mbtiles tiles")
+	flags.IntVar(&workers, "workers", 8, "concurrent tile requests")
+	flags.IntVar(&retries, "retries", 3, "retries of failed tile requests")
+	flags.Int64Var(&maxPixels, "max_pixels", stitch.DefaultMaxPixels, "maximum pixels of the image")
+	flags.StringVar(&output, "o", "output.png", "output png file, GeoTIFF for .tif and .tiff")
+	flags.BoolVar(&world, "world", false, "write world file and .prj file")
+	flags.Parse(args)
+
+	bounds, err := parseBounds(bbox)
+	exitOnError(err)
+	opts := stitch.NewOptions(bounds, zoom)
+	opts.TileSize = tileSize
+	opts.Workers = workers
+	opts.Retries = retries
+	opts.MaxPixels = maxPixels
+
+	var src stitch.TileSource
+	switch {
+	case "" != url:
+		src = stitch.NewURLSource(url)
+	case "" != mbtiles:
+		mb, err := stitch.OpenMBTiles(mbtiles, layer)
+		exitOnError(err)
+		defer mb.Close()
+		src = mb
+	default:
+		getConfig()
+		layerConfig := getLayerConfig(layer)
+		opts.TileSize = layerConfig.TileSize
+		requests := maptiles.NewLayerRendererChan(layerConfig)
+		defer close(requests)
+		src = stitch.SourceFunc(func(z, x, y int) ([]byte, error) {
+			results := make(chan maptiles.TileFetchResult)
+			coord := maptiles.TileCoord{X: uint64(x), Y: uint64(y), Zoom: uint64(z), Layer: layer}
+			requests <- maptiles.TileFetchRequest{Coord: coord, OutChan: results}
+			result := <-results
+			if nil == result.BlobPNG {
+				return nil, fmt.Errorf("Unable to render tile %v/%v/%v", z, x, y)
+			}
+			return result.BlobPNG, nil
+		})
+	}
+
+	img, stats, err := stitch.Stitch(src, opts)
+	exitOnError(err)
+
+	if georef.IsGeoTIFF(output) {
+		exitOnError(georef.SaveGeoTIFF(output, img, opts.Georeference()))
+	} else {
+		out, err := os.Create(output)
+		exitOnError(err)
+		defer out.Close()
+		exitOnError(png.Encode(out, img))
+	}
+	if world {
+		exitOnError(georef.WriteSidecars(output, opts.Georeference()))
+	}
+	fmt.Println("Stitched tiles:", stats.Tiles-stats.Missing, "missing:", stats.Missing)
+	maptiles.Ligneous.Flush()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+import "maptiles"
+
+// Config tile server config.
+type Config struct {
+	Cache       string                          `json:"cache"`
+	Engine      string                          `json:"engine"`
+	Layers      map[string]maptiles.LayerConfig `json:"layers"`
+	PruneLayers bool                            `json:"prune_layers"`
+	Port        int                             `json:"port"`
+	Scheme      string                          `json:"scheme"`
+	PublicURL   string                          `json:"public_url"`
+	WMSMaxSize  int                             `json:"wms_max_size"`
+	MarkerIcons map[string]string               `json:"marker_icons"`
+	Pool        maptiles.ConnectionPool         `json:"pool"`
+}
+
+// envVar matches ${NAME} and ${NAME:-default} in config files.
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateString replaces ${NAME} with the value of environment
+// variable NAME, ${NAME:-default} falls back to default if NAME is not
+// set. Variables that are not set and have no default are added to missing.
+func interpolateString(s string, missing *[]string) string {
+	return envVar.ReplaceAllStringFunc(s, func(match string) string {
+		groups := envVar.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok {
+			return value
+		}
+		if "" != groups[2] {
+			return groups[3]
+		}
+		*missing = append(*missing, groups[1])
+		return match
+	})
+}
+
+// interpolateEnv replaces environment variables in the string values
+// of a decoded config file. Keys, comments and other values are left
+// untouched and variables can not break the syntax of the file.
+// Fails on variables that are not set and have no default.
+func interpolateEnv(values interface{}) (interface{}, error) {
+	var missing []string
+	var walk func(value interface{}) interface{}
+	walk = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case string:
+			return interpolateString(v, &missing)
+		case map[string]interface{}:
+			for key, item := range v {
+				v[key] = walk(item)
+			}
+		case []map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				v[i] = walk(item)
+			}
+		}
+		return value
+	}
+	values = walk(values)
+	if 0 != len(missing) {
+		return values, fmt.Errorf("Environment variables not set: %v", strings.Join(missing, ", "))
+	}
+	return values, nil
+}
+
+// normalizeYaml converts maps decoded by yaml to maps with string keys,
+// so they can be encoded as json.
+func normalizeYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeYaml(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYaml(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// decodeConfig decodes json, yaml and toml config files into maps
+// with string keys, the format is chosen by file extension.
+func decodeConfig(path string, data []byte) (interface{}, error) {
+	var values interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); nil != err {
+			return nil, err
+		}
+		values = normalizeYaml(values)
+	case ".toml":
+		m := make(map[string]interface{})
+		if err := toml.Unmarshal(data, &m); nil != err {
+			return nil, err
+		}
+		values = m
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); nil != err {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// applyEnvOverrides overrides config values with MAPNIK_SERVER_PORT,
+// MAPNIK_SERVER_CACHE and MAPNIK_SERVER_ENGINE environment variables.
+func applyEnvOverrides(c *Config) error {
+	if value, ok := os.LookupEnv("MAPNIK_SERVER_PORT"); ok {
+		port, err := strconv.Atoi(value)
+		if nil != err {
+			return fmt.Errorf("Invalid MAPNIK_SERVER_PORT: %v", value)
+		}
+		c.Port = port
+	}
+	if value, ok := os.LookupEnv("MAPNIK_SERVER_CACHE"); ok {
+		c.Cache = value
+	}
+	if value, ok := os.LookupEnv("MAPNIK_SERVER_ENGINE"); ok {
+		c.Engine = value
+	}
+	return nil
+}
+
+// loadConfig reads and validates tile server config file.
+// Json, yaml and toml files are supported.
+func loadConfig(path string) (Config, error) {
+	var c Config
+
+	file, err := ioutil.ReadFile(path)
+	if nil != err {
+		return c, err
+	}
+
+	values, err := decodeConfig(path, file)
+	if nil != err {
+		return c, err
+	}
+
+	values, err = interpolateEnv(values)
+	if nil != err {
+		return c, err
+	}
+
+	file, err = json.Marshal(values)
+	if nil != err {
+		return c, err
+	}
+
+	err = json.Unmarshal(file, &c)
+	if nil != err {
+		return c, err
+	}
+
+	err = applyEnvOverrides(&c)
+	if nil != err {
+		return c, err
+	}
+
+	if c.Engine != "sqlite" {
+		if c.Engine != "postgres" {
+			return c, fmt.Errorf("Unsupported database engine: %v", c.Engine)
+		}
+	}
+
+	if "" != c.Scheme && "xyz" != c.Scheme && "tms" != c.Scheme {
+		return c, fmt.Errorf("Unsupported tile scheme: %v", c.Scheme)
+	}
+
+	if c.WMSMaxSize < 0 {
+		return c, fmt.Errorf("Invalid wms_max_size: %v", c.WMSMaxSize)
+	}
+
+	for name, layer := range c.Layers {
+		if err := layer.Validate(); nil != err {
+			return c, fmt.Errorf("Invalid tile layer %v: %v", name, err)
+		}
+	}
+
+	return c, nil
+}
+
+// redactCache hides the password of a postgres connection string.
+func redactCache(cache string) string {
+	return maptiles.RedactPassword(cache, "xxxxx")
+}
+
+// redactConfig returns a copy of config with the passwords of the cache
+// and of the layer sources hidden.
+func redactConfig(c Config) Config {
+	c.Cache = redactCache(c.Cache)
+	layers := make(map[string]maptiles.LayerConfig, len(c.Layers))
+	for name, layer := range c.Layers {
+		layer.Source = maptiles.RedactPassword(layer.Source, "xxxxx")
+		layers[name] = layer
+	}
+	c.Layers = layers
+	return c
+}
+
+// printConfig prints resolved config as json with passwords hidden.
+func printConfig(c Config) error {
+	b, err := json.MarshalIndent(redactConfig(c), "", "    ")
+	if nil != err {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
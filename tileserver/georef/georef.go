@@ -0,0 +1,120 @@
+// Package georef writes georeferencing of map images: world files and .prj
+// sidecars for GIS tools, and GeoTIFF files with embedded georeferencing.
+package georef
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Supported EPSG codes.
+const (
+	WebMercator = 3857
+	WGS84       = 4326
+)
+
+// wkt well known text of the supported coordinate systems, as in .prj files.
+var wkt = map[int]string{
+	WebMercator: `PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]],PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AXIS["X",EAST],AXIS["Y",NORTH],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs"],AUTHORITY["EPSG","3857"]]`,
+	WGS84:       `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`,
+}
+
+// worldFileExtensions world file extensions by image extension.
+var worldFileExtensions = map[string]string{
+	".png":  ".pgw",
+	".jpg":  ".jgw",
+	".jpeg": ".jgw",
+	".tif":  ".tfw",
+	".tiff": ".tfw",
+	".gif":  ".gfw",
+	".webp": ".wld",
+}
+
+// Georeference places an image of Width x Height pixels at Bounds,
+// minx, miny, maxx, maxy in units of the coordinate system SRID.
+type Georeference struct {
+	SRID   int
+	Bounds [4]float64
+	Width  int
+	Height int
+}
+
+// PixelSize returns width and height of a pixel in map units.
+func (self Georeference) PixelSize() (float64, float64) {
+	return (self.Bounds[2] - self.Bounds[0]) / float64(self.Width),
+		(self.Bounds[3] - self.Bounds[1]) / float64(self.Height)
+}
+
+// Validate checks image size and coordinate system.
+func (self Georeference) Validate() error {
+	if self.Width < 1 || self.Height < 1 {
+		return fmt.Errorf("Invalid image size: %vx%v", self.Width, self.Height)
+	}
+	if _, ok := wkt[self.SRID]; !ok {
+		return fmt.Errorf("Unsupported coordinate system: EPSG:%v", self.SRID)
+	}
+	return nil
+}
+
+// WorldFile formats world file: pixel width, two rotation terms, negative
+// pixel height and the center of the upper left pixel.
+func (self Georeference) WorldFile() string {
+	dx, dy := self.PixelSize()
+	values := []float64{dx, 0, 0, -dy, self.Bounds[0] + dx/2, self.Bounds[3] - dy/2}
+	lines := make([]string, len(values))
+	for i, v := range values {
+		lines[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// WorldFilePath returns world file path of image, e.g. map.pgw for map.png.
+func WorldFilePath(image string) string {
+	ext := filepath.Ext(image)
+	worldExt, ok := worldFileExtensions[strings.ToLower(ext)]
+	if !ok {
+		worldExt = ".wld"
+	}
+	return strings.TrimSuffix(image, ext) + worldExt
+}
+
+// PrjPath returns .prj path of image.
+func PrjPath(image string) string {
+	return strings.TrimSuffix(image, filepath.Ext(image)) + ".prj"
+}
+
+// WriteSidecars writes world file and .prj file next to image.
+func WriteSidecars(image string, g Georeference) error {
+	if err := g.Validate(); nil != err {
+		return err
+	}
+	if err := ioutil.WriteFile(WorldFilePath(image), []byte(g.WorldFile()), 0644); nil != err {
+		return err
+	}
+	return ioutil.WriteFile(PrjPath(image), []byte(wkt[g.SRID]), 0644)
+}
+
+// SRIDFromProj4 returns EPSG code of a mapnik srs, if it is supported.
+func SRIDFromProj4(srs string) (int, bool) {
+	srs = strings.ToLower(srs)
+	switch {
+	case strings.Contains(srs, "+init=epsg:3857"), strings.Contains(srs, "+init=epsg:900913"):
+		return WebMercator, true
+	case strings.Contains(srs, "+init=epsg:4326"):
+		return WGS84, true
+	case strings.Contains(srs, "+proj=merc") && strings.Contains(srs, "+a=6378137") && strings.Contains(srs, "+b=6378137"):
+		return WebMercator, true
+	case strings.Contains(srs, "+proj=longlat") && strings.Contains(srs, "wgs84"):
+		return WGS84, true
+	}
+	return 0, false
+}
+
+// IsGeoTIFF checks for .tif and .tiff file names.
+func IsGeoTIFF(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ".tif" == ext || ".tiff" == ext
+}
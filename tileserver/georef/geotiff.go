@@ -0,0 +1,161 @@
+package georef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+)
+
+// TIFF field types.
+const (
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffDouble = 12
+)
+
+// tiffEntry TIFF directory entry with its little endian value.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// shortEntry creates entry of SHORT values.
+func shortEntry(tag uint16, values ...uint16) tiffEntry {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return tiffEntry{tag, tiffShort, uint32(len(values)), b}
+}
+
+// longEntry creates entry of a LONG value.
+func longEntry(tag uint16, value uint32) tiffEntry {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, value)
+	return tiffEntry{tag, tiffLong, 1, b}
+}
+
+// doubleEntry creates entry of DOUBLE values.
+func doubleEntry(tag uint16, values ...float64) tiffEntry {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+	}
+	return tiffEntry{tag, tiffDouble, uint32(len(values)), b}
+}
+
+// geoKeys returns GeoTIFF 1.0 key directory of the coordinate system.
+func geoKeys(srid int) []uint16 {
+	// key id, tag location (0 for inline values), count, value,
+	// sorted by key id
+	keys := [][4]uint16{
+		{1024, 0, 1, 1},            // GTModelTypeGeoKey: ModelTypeProjected
+		{1025, 0, 1, 1},            // GTRasterTypeGeoKey: RasterPixelIsArea
+		{3072, 0, 1, uint16(srid)}, // ProjectedCSTypeGeoKey
+		{3076, 0, 1, 9001},         // ProjLinearUnitsGeoKey: metre
+	}
+	if WGS84 == srid {
+		keys = [][4]uint16{
+			{1024, 0, 1, 2},    // GTModelTypeGeoKey: ModelTypeGeographic
+			{1025, 0, 1, 1},    // GTRasterTypeGeoKey: RasterPixelIsArea
+			{2048, 0, 1, 4326}, // GeographicTypeGeoKey
+			{2054, 0, 1, 9102}, // GeogAngularUnitsGeoKey: degree
+		}
+	}
+	directory := []uint16{1, 1, 0, uint16(len(keys))}
+	for _, key := range keys {
+		directory = append(directory, key[:]...)
+	}
+	return directory
+}
+
+// WriteGeoTIFF writes image as uncompressed 8 bit RGBA GeoTIFF.
+func WriteGeoTIFF(w io.Writer, img image.Image, g Georeference) error {
+	if err := g.Validate(); nil != err {
+		return err
+	}
+	b := img.Bounds()
+	pixels, ok := img.(*image.NRGBA)
+	if !ok || image.ZP != b.Min || len(pixels.Pix) != 4*b.Dx()*b.Dy() {
+		pixels = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(pixels, pixels.Bounds(), img, b.Min, draw.Src)
+	}
+
+	dx, dy := g.PixelSize()
+	entries := []tiffEntry{
+		longEntry(256, uint32(b.Dx())),                           // ImageWidth
+		longEntry(257, uint32(b.Dy())),                           // ImageLength
+		shortEntry(258, 8, 8, 8, 8),                              // BitsPerSample
+		shortEntry(259, 1),                                       // Compression: none
+		shortEntry(262, 2),                                       // PhotometricInterpretation: RGB
+		longEntry(273, 0),                                        // StripOffsets, set below
+		shortEntry(277, 4),                                       // SamplesPerPixel
+		longEntry(278, uint32(b.Dy())),                           // RowsPerStrip
+		longEntry(279, uint32(len(pixels.Pix))),                  // StripByteCounts
+		shortEntry(284, 1),                                       // PlanarConfiguration: chunky
+		shortEntry(338, 2),                                       // ExtraSamples: unassociated alpha
+		doubleEntry(33550, dx, dy, 0),                            // ModelPixelScaleTag
+		doubleEntry(33922, 0, 0, 0, g.Bounds[0], g.Bounds[3], 0), // ModelTiepointTag
+		shortEntry(34735, geoKeys(g.SRID)...),                    // GeoKeyDirectoryTag
+	}
+
+	// header, directory, values not fitting into entries, pixels
+	offset := uint32(8 + 2 + 12*len(entries) + 4)
+	var values bytes.Buffer
+	valueOffsets := make([]uint32, len(entries))
+	for i, entry := range entries {
+		if len(entry.value) > 4 {
+			valueOffsets[i] = offset + uint32(values.Len())
+			values.Write(entry.value)
+			if 0 != values.Len()%2 {
+				values.WriteByte(0)
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(entries[5].value, offset+uint32(values.Len()))
+
+	var header bytes.Buffer
+	header.Write([]byte{'I', 'I', 42, 0})
+	binary.Write(&header, binary.LittleEndian, uint32(8))
+	binary.Write(&header, binary.LittleEndian, uint16(len(entries)))
+	for i, entry := range entries {
+		binary.Write(&header, binary.LittleEndian, entry.tag)
+		binary.Write(&header, binary.LittleEndian, entry.typ)
+		binary.Write(&header, binary.LittleEndian, entry.count)
+		if len(entry.value) > 4 {
+			binary.Write(&header, binary.LittleEndian, valueOffsets[i])
+		} else {
+			inline := make([]byte, 4)
+			copy(inline, entry.value)
+			header.Write(inline)
+		}
+	}
+	// no further directories
+	binary.Write(&header, binary.LittleEndian, uint32(0))
+
+	for _, data := range [][]byte{header.Bytes(), values.Bytes(), pixels.Pix} {
+		if _, err := w.Write(data); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveGeoTIFF writes image as GeoTIFF file.
+func SaveGeoTIFF(path string, img image.Image, g Georeference) error {
+	f, err := os.Create(path)
+	if nil != err {
+		return err
+	}
+	if err := WriteGeoTIFF(f, img, g); nil != err {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
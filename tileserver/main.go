@@ -1,48 +1,68 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 import "maptiles"
 
-type Config struct {
-	Cache  string            `json:"cache"`
-	Engine string            `json:"engine"`
-	Layers map[string]string `json:"layers"`
-	Port   int               `json:"port"`
-}
-
 var (
 	config Config
 	// engine string
 	// port string
 	// db_cache string
-	config_file   string
-	print_version bool
+	config_file    string
+	print_version  bool
+	check_config   bool
+	migrate_engine string
+	migrate_cache  string
+	migrate_layers string
+	migrate_state  string
+	migrate_batch  int
 )
 
 // Serve a single stylesheet via HTTP. Open view_tileserver.html in your browser
 // to see the results.
 // The created tiles are cached in an sqlite database (MBTiles 1.2 conform) so
 // successive access a tile is much faster.
-func TileserverWithCaching(engine string, layer_config map[string]string) {
+func TileserverWithCaching(engine string, layer_config map[string]maptiles.LayerConfig) {
 	bind := fmt.Sprintf("0.0.0.0:%v", config.Port)
 	if engine == "postgres" {
 		t := maptiles.NewTileServerPostgresMux(config.Cache)
+		t.SetConnectionPool(config.Pool)
 
-		// for i := range layer_config {
-		// 	t.AddMapnikLayer(i, layer_config[i])
-		// }
+		t.TmsSchema = "tms" == config.Scheme
+		t.PublicURL = config.PublicURL
+		if 0 != config.WMSMaxSize {
+			t.WMSMaxSize = config.WMSMaxSize
+		}
+		icons, err := maptiles.LoadMarkerIcons(config.MarkerIcons)
+		if nil != err {
+			maptiles.Ligneous.Critical(err)
+			maptiles.Ligneous.Flush()
+			os.Exit(1)
+		}
+		t.MarkerIcons = icons
+
+		if err := t.LoadLayers(layer_config, config.PruneLayers); nil != err {
+			maptiles.Ligneous.Critical(err)
+			maptiles.Ligneous.Flush()
+			os.Exit(1)
+		}
+		t.Router.HandleFunc("/api/v1/admin/reload", reloadHandler(t)).Methods("POST")
+		watchReload(t)
 
 		maptiles.Ligneous.Info("Connecting to postgres database:")
-		maptiles.Ligneous.Info("*** ", config.Cache)
+		maptiles.Ligneous.Info("*** ", redactCache(config.Cache))
 		maptiles.Ligneous.Info(fmt.Sprintf("Magic happens on port %v...", config.Port))
 		srv := &http.Server{
 			Addr:         bind,
@@ -50,16 +70,33 @@ func TileserverWithCaching(engine string, layer_config map[string]string) {
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		}
-		maptiles.Ligneous.Error(srv.ListenAndServe())
+		serveUntilSignal(srv, t.Close)
 	} else {
 		t := maptiles.NewTileServerSqliteMux(config.Cache)
 
-		// for i := range layer_config {
-		// 	t.AddMapnikLayer(i, layer_config[i])
-		// }
+		t.TmsSchema = "tms" == config.Scheme
+		t.PublicURL = config.PublicURL
+		if 0 != config.WMSMaxSize {
+			t.WMSMaxSize = config.WMSMaxSize
+		}
+		icons, err := maptiles.LoadMarkerIcons(config.MarkerIcons)
+		if nil != err {
+			maptiles.Ligneous.Critical(err)
+			maptiles.Ligneous.Flush()
+			os.Exit(1)
+		}
+		t.MarkerIcons = icons
+
+		if err := t.LoadLayers(layer_config, config.PruneLayers); nil != err {
+			maptiles.Ligneous.Critical(err)
+			maptiles.Ligneous.Flush()
+			os.Exit(1)
+		}
+		t.Router.HandleFunc("/api/v1/admin/reload", reloadHandler(t)).Methods("POST")
+		watchReload(t)
 
 		maptiles.Ligneous.Info("Connecting to sqlite3 database:")
-		maptiles.Ligneous.Info("*** ", config.Cache)
+		maptiles.Ligneous.Info("*** ", redactCache(config.Cache))
 		maptiles.Ligneous.Info(fmt.Sprintf("Magic happens on port %v...", config.Port))
 		srv := &http.Server{
 			Addr:         bind,
@@ -67,63 +104,198 @@ func TileserverWithCaching(engine string, layer_config map[string]string) {
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		}
-		maptiles.Ligneous.Error(srv.ListenAndServe())
+		serveUntilSignal(srv, t.Close)
 	}
 }
 
-func init() {
-	// TODO: add config file
-	// flag.StringVar(&port, "p", "8080", "server port")
-	// flag.StringVar(&engine, "e", "sqlite", "database engine [sqlite or postgres]")
-	// flag.StringVar(&db_cache, "d", "tilecache.mbtiles", "tile cache database")
-	flag.StringVar(&config_file, "c", "", "tile server config")
-	flag.BoolVar(&print_version, "v", false, "version")
-	flag.Parse()
-	// if engine != "sqlite" {
-	// 	if engine != "postgres" {
-	// 		logger.Fatal("Unsupported database engines")
-	// 	}
-	// }
-	if print_version {
-		fmt.Println(maptiles.SERVER_NAME + "-" + maptiles.VERSION)
+// serveUntilSignal runs http server until SIGINT or SIGTERM.
+// The server stops accepting connections and waits for active requests,
+// then closeServer stops renderers and flushes the tile cache.
+func serveUntilSignal(srv *http.Server, closeServer func()) {
+	done := make(chan bool)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		s := <-sig
+		maptiles.Ligneous.Info("Shutting down on ", s)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); nil != err {
+			maptiles.Ligneous.Error("Unable to shut down gracefully: ", err)
+		}
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); http.ErrServerClosed != err {
+		maptiles.Ligneous.Critical(err)
+		maptiles.Ligneous.Flush()
 		os.Exit(1)
 	}
+	<-done
+
+	// no config reloads while closing
+	reloadLock.Lock()
+	closeServer()
+	maptiles.Ligneous.Info("Tile server stopped")
+	maptiles.Ligneous.Flush()
 }
 
-func getConfig() {
-	// check if file exists!!!
-	if _, err := os.Stat(config_file); err == nil {
+// command tileserver subcommand.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+// commands subcommands of the tileserver binary.
+// Without a subcommand the tile server is started.
+var commands = []command{
+	{"serve", "run the tile server", serveCommand},
+	{"seed", "render tiles of a layer into the tile cache", seedCommand},
+	{"render", "render a map image of a bounding box to file", renderCommand},
+	{"stitch", "stitch tiles of a layer into a png", stitchCommand},
+	{"export", "export cached tiles as a {layer}/{z}/{x}/{y} file tree", exportCommand},
+	{"purge", "delete cached tiles of a layer", purgeCommand},
+	{"layers", "list, add or remove tile layers of the tile cache", layersCommand},
+	{"migrate", "migrate the tile cache to another database", migrateCommand},
+	{"version", "print version", versionCommand},
+}
+
+// newFlagSet creates flags of a subcommand with the config file flag.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&config_file, "c", "", "tile server config")
+	return flags
+}
 
-		file, err := ioutil.ReadFile(config_file)
-		if err != nil {
-			panic(err)
+// migrateFlags adds tile cache migration flags.
+func migrateFlags(flags *flag.FlagSet, prefix string) {
+	flags.StringVar(&migrate_engine, prefix+"engine", "", "migrate tile cache to database engine [sqlite or postgres]")
+	flags.StringVar(&migrate_cache, prefix+"cache", "", "migrate tile cache to database")
+	flags.StringVar(&migrate_layers, prefix+"layers", "", "comma separated tile layers to migrate (default all)")
+	flags.StringVar(&migrate_state, prefix+"state", "migrate.state", "migration resume point file")
+	flags.IntVar(&migrate_batch, prefix+"batch", 500, "tiles per migration batch")
+}
+
+// parseBounds parses west,south,east,north bounding box.
+func parseBounds(value string) ([4]float64, error) {
+	var bounds [4]float64
+	parts := strings.Split(value, ",")
+	if 4 != len(parts) {
+		return bounds, fmt.Errorf("Expecting west,south,east,north bounds: %v", value)
+	}
+	for i := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if nil != err {
+			return bounds, fmt.Errorf("Invalid bounds: %v", value)
 		}
+		bounds[i] = v
+	}
+	return bounds, nil
+}
+
+// exitOnError prints error and exits.
+func exitOnError(err error) {
+	if nil != err {
+		fmt.Println("error:", err)
+		maptiles.Ligneous.Flush()
+		os.Exit(1)
+	}
+}
 
-		err = json.Unmarshal(file, &config)
-		if err != nil {
+func getConfig() {
+	// check if file exists!!!
+	if _, err := os.Stat(config_file); err == nil {
+		config, err = loadConfig(config_file)
+		if nil != err {
 			fmt.Println("error:", err)
 			os.Exit(1)
 		}
-
-		if config.Engine != "sqlite" {
-			if config.Engine != "postgres" {
-				fmt.Println("Unsupported database engine")
-				os.Exit(1)
-			}
-		}
-
-		maptiles.Ligneous.Debug(config)
+		maptiles.Ligneous.Debug(redactConfig(config))
 	} else {
 		fmt.Println("Config file not found")
 		os.Exit(1)
 	}
 }
 
+// getLayerConfig gets config of tile layer from the config file.
+func getLayerConfig(name string) maptiles.LayerConfig {
+	layer, ok := config.Layers[name]
+	if !ok {
+		exitOnError(fmt.Errorf("Tile layer not found in config: %v", name))
+	}
+	return layer
+}
+
+// openTileDb opens the tile cache of the config file.
+func openTileDb() maptiles.TileDb {
+	db, err := maptiles.NewTileDb(config.Engine, config.Cache)
+	exitOnError(err)
+	return db
+}
+
+// serveCommand runs the tile server.
+func serveCommand(args []string) {
+	flags := newFlagSet("serve")
+	flags.BoolVar(&print_version, "v", false, "version")
+	flags.BoolVar(&check_config, "check", false, "validate config and print the resolved result")
+	migrateFlags(flags, "migrate-")
+	flags.Parse(args)
+
+	if print_version {
+		versionCommand(nil)
+		os.Exit(1)
+	}
+
+	getConfig()
+	if check_config {
+		exitOnError(printConfig(config))
+		return
+	}
+	if "" != migrate_cache {
+		exitOnError(MigrateCache())
+		maptiles.Ligneous.Flush()
+		return
+	}
+	TileserverWithCaching(config.Engine, config.Layers)
+}
+
+// versionCommand prints version.
+func versionCommand(args []string) {
+	fmt.Println(maptiles.SERVER_NAME + "-" + maptiles.VERSION)
+}
+
+// usage prints subcommands.
+func usage() {
+	fmt.Println("Usage: tileserver [command] [flags]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-8v %v\n", cmd.name, cmd.usage)
+	}
+	fmt.Println("")
+	fmt.Println("Run without command to serve, 'tileserver <command> -h' shows flags.")
+}
+
 // Before uncommenting the GenerateOSMTiles call make sure you have
 // the necessary OSM sources. Consult OSM wiki for details.
 func main() {
-	getConfig()
-	TileserverWithCaching(config.Engine, config.Layers)
+	args := os.Args[1:]
+	name := "serve"
+	if 0 != len(args) && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			cmd.run(args)
+			return
+		}
+	}
+	if "help" != name {
+		fmt.Println("Unknown command:", name)
+	}
+	usage()
+	os.Exit(1)
 }
 
 // sudo su mapnik
@@ -5,7 +5,11 @@ package mapnik
 import "C"
 
 import (
+	"encoding/json"
 	"errors"
+	"image/color"
+	"path/filepath"
+	"strings"
 	"unsafe"
 )
 
@@ -19,6 +23,30 @@ func Version() string {
 	return "Mapnik " + C.GoString(C.mapnik_version_string())
 }
 
+// HasCairo checks whether mapnik was built with the cairo renderer,
+// which renders the pdf, svg and ps formats.
+func HasCairo() bool {
+	return C.mapnik_has_cairo() != 0
+}
+
+// IsVectorFormat checks for the formats rendered by cairo.
+func IsVectorFormat(format string) bool {
+	return "pdf" == format || "svg" == format || "ps" == format
+}
+
+// FormatFromPath returns the mapnik format of a file extension,
+// e.g. "jpeg" for map.jpg.
+func FormatFromPath(path string) string {
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	switch format {
+	case "jpg":
+		return "jpeg"
+	case "tif":
+		return "tiff"
+	}
+	return format
+}
+
 func RegisterDatasources(path string) {
 	cs := C.CString(path)
 	defer C.free(unsafe.Pointer(cs))
@@ -56,6 +84,24 @@ func (p Projection) Forward(coord Coord) Coord {
 	return Coord{float64(c.x), float64(c.y)}
 }
 
+// AspectFixMode how the map adjusts a zoomed box, whose aspect ratio
+// differs from the map size, values match mapnik::Map::aspect_fix_mode.
+type AspectFixMode int
+
+const (
+	// GrowBBox grows the box to the aspect ratio of the map, the default
+	GrowBBox AspectFixMode = iota
+	GrowCanvas
+	ShrinkBBox
+	ShrinkCanvas
+	AdjustBBoxWidth
+	AdjustBBoxHeight
+	AdjustCanvasWidth
+	AdjustCanvasHeight
+	// Respect keeps the box, the map is stretched to its size
+	Respect
+)
+
 // Map base type
 type Map struct {
 	m *C.struct__mapnik_map_t
@@ -122,10 +168,27 @@ func (m *Map) ZoomToMinMax(minx, miny, maxx, maxy float64) {
 	C.mapnik_map_zoom_to_box(m.m, bbox)
 }
 
+// CurrentExtent returns the extent of the map in map units. It can be
+// larger than the box zoomed to, to keep the aspect ratio of the map.
+func (m *Map) CurrentExtent() (minx, miny, maxx, maxy float64) {
+	var x0, y0, x1, y1 C.double
+	C.mapnik_map_get_current_extent(m.m, &x0, &y0, &x1, &y1)
+	return float64(x0), float64(y0), float64(x1), float64(y1)
+}
+
+// RenderToFile renders the map to file in the format of its extension.
 func (m *Map) RenderToFile(path string) error {
+	return m.RenderToFileFormat(path, FormatFromPath(path))
+}
+
+// RenderToFileFormat renders the map to file in a mapnik format,
+// pdf, svg and ps are rendered with cairo.
+func (m *Map) RenderToFileFormat(path, format string) error {
 	cs := C.CString(path)
 	defer C.free(unsafe.Pointer(cs))
-	if C.mapnik_map_render_to_file(m.m, cs) != 0 {
+	cf := C.CString(format)
+	defer C.free(unsafe.Pointer(cf))
+	if C.mapnik_map_render_to_file_format(m.m, cs, cf) != 0 {
 		return m.lastError()
 	}
 	return nil
@@ -142,6 +205,42 @@ func (m *Map) RenderToMemoryPng() ([]byte, error) {
 	return C.GoBytes(unsafe.Pointer(b.ptr), C.int(b.len)), nil
 }
 
+// RenderToMemory renders the map to an image encoded in a mapnik
+// format, e.g. "png", "png256", "jpeg" or "webp", or to a pdf, svg
+// or ps document of the map size in points.
+func (m *Map) RenderToMemory(format string) ([]byte, error) {
+	if IsVectorFormat(format) {
+		return m.RenderToVector(format, 1, 1)
+	}
+	i := C.mapnik_map_render_to_image(m.m)
+	if i == nil {
+		return nil, m.lastError()
+	}
+	defer C.mapnik_image_free(i)
+	cs := C.CString(format)
+	defer C.free(unsafe.Pointer(cs))
+	b := C.mapnik_image_to_blob(i, cs)
+	defer C.mapnik_image_blob_free(b)
+	if b.ptr == nil {
+		return nil, errors.New("unable to encode image as " + format)
+	}
+	return C.GoBytes(unsafe.Pointer(b.ptr), C.int(b.len)), nil
+}
+
+// RenderToVector renders the map with cairo to a pdf, svg or ps document.
+// The page is the map size times scale in points, scaleFactor scales
+// line widths, fonts and symbols like in raster renderings.
+func (m *Map) RenderToVector(format string, scale, scaleFactor float64) ([]byte, error) {
+	cs := C.CString(format)
+	defer C.free(unsafe.Pointer(cs))
+	b := C.mapnik_map_render_to_vector(m.m, cs, C.double(scale), C.double(scaleFactor))
+	if b == nil {
+		return nil, m.lastError()
+	}
+	defer C.mapnik_image_blob_free(b)
+	return C.GoBytes(unsafe.Pointer(b.ptr), C.int(b.len)), nil
+}
+
 func (m *Map) Projection() Projection {
 	p := Projection{}
 	p.p = C.mapnik_map_projection(m.m)
@@ -151,3 +250,88 @@ func (m *Map) Projection() Projection {
 func (m *Map) SetBufferSize(s int) {
 	C.mapnik_map_set_buffer_size(m.m, C.int(s))
 }
+
+// SetAspectFixMode sets how boxes zoomed to with ZoomToMinMax are fit
+// to the size of the map.
+func (m *Map) SetAspectFixMode(mode AspectFixMode) {
+	C.mapnik_map_set_aspect_fix_mode(m.m, C.int(mode))
+}
+
+// SetBackgroundColor sets the background color of the map,
+// alpha 0 gives a transparent background.
+func (m *Map) SetBackgroundColor(c color.NRGBA) {
+	C.mapnik_map_set_background(m.m, C.uchar(c.R), C.uchar(c.G), C.uchar(c.B), C.uchar(c.A))
+}
+
+// LayerNames returns the names of the layers of the map.
+func (m *Map) LayerNames() []string {
+	n := int(C.mapnik_map_layer_count(m.m))
+	names := make([]string, n)
+	for i := 0; i < n; i++ {
+		names[i] = C.GoString(C.mapnik_map_layer_name(m.m, C.uint(i)))
+	}
+	return names
+}
+
+func (m *Map) layerIndex(layer string) (int, error) {
+	for i, name := range m.LayerNames() {
+		if name == layer {
+			return i, nil
+		}
+	}
+	return -1, errors.New("mapnik: unknown layer " + layer)
+}
+
+func (m *Map) queryResult(cs *C.char) ([]json.RawMessage, error) {
+	if cs == nil {
+		return nil, m.lastError()
+	}
+	defer C.free(unsafe.Pointer(cs))
+	var features []json.RawMessage
+	if err := json.Unmarshal([]byte(C.GoString(cs)), &features); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+// QueryMapPoint returns GeoJSON features of layer at pixel x, y of the
+// current map extent. Features are hit tested with a tolerance of a few
+// pixels, their geometry is in WGS84.
+func (m *Map) QueryMapPoint(layer string, x, y float64) ([]json.RawMessage, error) {
+	idx, err := m.layerIndex(layer)
+	if err != nil {
+		return nil, err
+	}
+	return m.queryResult(C.mapnik_map_query_map_point(m.m, C.uint(idx), C.double(x), C.double(y)))
+}
+
+// QueryBox returns GeoJSON features of layer intersecting the box given
+// in map coordinates, their geometry is in WGS84.
+func (m *Map) QueryBox(layer string, minx, miny, maxx, maxy float64) ([]json.RawMessage, error) {
+	idx, err := m.layerIndex(layer)
+	if err != nil {
+		return nil, err
+	}
+	return m.queryResult(C.mapnik_map_query_box(m.m, C.uint(idx), C.double(minx), C.double(miny), C.double(maxx), C.double(maxy)))
+}
+
+// RenderGrid renders the UTFGrid of layer for the current map extent,
+// with one grid cell per resolution x resolution pixels. Features are
+// identified by the key attribute, "__id__" for feature ids, and carry
+// the given attribute fields.
+func (m *Map) RenderGrid(layer, key string, fields []string, resolution uint) ([]byte, error) {
+	idx, err := m.layerIndex(layer)
+	if err != nil {
+		return nil, err
+	}
+	ck := C.CString(key)
+	defer C.free(unsafe.Pointer(ck))
+	cf := C.CString(strings.Join(fields, ","))
+	defer C.free(unsafe.Pointer(cf))
+	cs := C.mapnik_map_render_grid(m.m, C.uint(idx), ck, cf, C.uint(resolution))
+	if cs == nil {
+		return nil, m.lastError()
+	}
+	defer C.free(unsafe.Pointer(cs))
+	return []byte(C.GoString(cs)), nil
+}
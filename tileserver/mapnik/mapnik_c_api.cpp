@@ -8,18 +8,74 @@
 #include <mapnik/projection.hpp>
 #include <mapnik/font_engine_freetype.hpp>
 
+#if MAPNIK_VERSION < 300000 || defined(GRID_RENDERER)
+#define MAPNIK_C_API_GRID
+#include <mapnik/feature.hpp>
+#include <mapnik/value.hpp>
+#include <mapnik/grid/grid.hpp>
+#include <mapnik/grid/grid_renderer.hpp>
+#endif
+
 #if MAPNIK_VERSION >= 300000
 #include <mapnik/image.hpp>
+#include <mapnik/layer.hpp>
+#include <mapnik/datasource.hpp>
+#include <mapnik/featureset.hpp>
+#include <mapnik/query.hpp>
+#include <mapnik/feature_layer_desc.hpp>
+#include <mapnik/proj_transform.hpp>
+#include <mapnik/geometry_reprojection.hpp>
+#include <mapnik/util/feature_to_geojson.hpp>
 #define mapnik_image_type mapnik::image_rgba8
 #else
 #include <mapnik/graphics.hpp>
 #define mapnik_image_type mapnik::image_32
 #endif
 
+#if defined(HAVE_CAIRO)
+#include <cairo.h>
+#ifdef CAIRO_HAS_PDF_SURFACE
+#include <cairo-pdf.h>
+#endif
+#ifdef CAIRO_HAS_SVG_SURFACE
+#include <cairo-svg.h>
+#endif
+#ifdef CAIRO_HAS_PS_SURFACE
+#include <cairo-ps.h>
+#endif
+#if MAPNIK_VERSION >= 300000
+#include <mapnik/cairo/cairo_context.hpp>
+#include <mapnik/cairo/cairo_renderer.hpp>
+#include <mapnik/cairo_io.hpp>
+#else
+#include <mapnik/cairo_context.hpp>
+#include <mapnik/cairo_renderer.hpp>
+#endif
+#endif
+
 
 #include "mapnik_c_api.h"
 
 #include <stdlib.h>
+#include <stdio.h>
+#include <float.h>
+#include <set>
+#include <map>
+#include <vector>
+#include <sstream>
+
+#if defined(HAVE_CAIRO)
+// cairo_write_string appends the output of a cairo stream surface
+// to the std::string passed as closure.
+static cairo_status_t cairo_write_string(void * closure, const unsigned char * data, unsigned int length) {
+    static_cast<std::string *>(closure)->append(reinterpret_cast<const char *>(data), length);
+    return CAIRO_STATUS_SUCCESS;
+}
+#endif
+
+static bool is_vector_format(std::string const& format) {
+    return format == "pdf" || format == "svg" || format == "ps";
+}
 
 #ifdef __cplusplus
 extern "C"
@@ -150,6 +206,97 @@ int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath) {
     return -1;
 }
 
+int mapnik_map_render_to_file_format(mapnik_map_t * m, const char* filepath, const char* format) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+        try {
+            std::string type(format);
+            if (is_vector_format(type)) {
+#if defined(HAVE_CAIRO)
+                mapnik::save_to_cairo_file(*m->m, filepath, type);
+#else
+                m->err = new std::string("mapnik was built without cairo renderer");
+                return -1;
+#endif
+            } else {
+                mapnik_image_type buf(m->m->width(),m->m->height());
+                mapnik::agg_renderer<mapnik_image_type> ren(*m->m,buf);
+                ren.apply();
+                mapnik::save_to_file(buf,filepath,type);
+            }
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+            return -1;
+        }
+        return 0;
+    }
+    return -1;
+}
+
+mapnik_image_blob_t * mapnik_map_render_to_vector(mapnik_map_t * m, const char * format, double scale, double scale_factor) {
+    mapnik_map_reset_last_error(m);
+    if (!m || !m->m) {
+        return NULL;
+    }
+#if defined(HAVE_CAIRO)
+    try {
+        std::string type(format);
+        std::string s;
+        double width = m->m->width() * scale;
+        double height = m->m->height() * scale;
+        cairo_surface_t * surface = NULL;
+#ifdef CAIRO_HAS_PDF_SURFACE
+        if (type == "pdf") {
+            surface = cairo_pdf_surface_create_for_stream(cairo_write_string, &s, width, height);
+        }
+#endif
+#ifdef CAIRO_HAS_SVG_SURFACE
+        if (type == "svg") {
+            surface = cairo_svg_surface_create_for_stream(cairo_write_string, &s, width, height);
+        }
+#endif
+#ifdef CAIRO_HAS_PS_SURFACE
+        if (type == "ps") {
+            surface = cairo_ps_surface_create_for_stream(cairo_write_string, &s, width, height);
+        }
+#endif
+        if (surface == NULL) {
+            m->err = new std::string("cairo was built without " + type + " support");
+            return NULL;
+        }
+        mapnik::cairo_surface_ptr surface_ptr(surface, mapnik::cairo_surface_closer());
+        mapnik::cairo_ptr cairo = mapnik::create_context(surface_ptr);
+        // the map is rendered in its pixel size, scaled to the page size
+        cairo_scale(cairo.get(), scale, scale);
+        mapnik::cairo_renderer<mapnik::cairo_ptr> ren(*m->m, cairo, scale_factor);
+        ren.apply();
+        cairo_surface_finish(surface);
+        if (cairo_surface_status(surface) != CAIRO_STATUS_SUCCESS) {
+            m->err = new std::string(cairo_status_to_string(cairo_surface_status(surface)));
+            return NULL;
+        }
+        mapnik_image_blob_t * blob = new mapnik_image_blob_t;
+        blob->len = s.length();
+        blob->ptr = new char[blob->len];
+        memcpy(blob->ptr, s.c_str(), blob->len);
+        return blob;
+    } catch (std::exception const& ex) {
+        m->err = new std::string(ex.what());
+        return NULL;
+    }
+#else
+    m->err = new std::string("mapnik was built without cairo renderer");
+    return NULL;
+#endif
+}
+
+int mapnik_has_cairo() {
+#if defined(HAVE_CAIRO)
+    return 1;
+#else
+    return 0;
+#endif
+}
 
 void mapnik_map_resize(mapnik_map_t *m, unsigned int width, unsigned int height) {
     if (m&& m->m) {
@@ -162,6 +309,18 @@ MAPNIKCAPICALL void mapnik_map_set_buffer_size(mapnik_map_t * m, int buffer_size
     m->m->set_buffer_size(buffer_size);
 }
 
+void mapnik_map_set_background(mapnik_map_t * m, unsigned char r, unsigned char g, unsigned char b, unsigned char a) {
+    if (m && m->m) {
+        m->m->set_background(mapnik::color(r, g, b, a));
+    }
+}
+
+void mapnik_map_set_aspect_fix_mode(mapnik_map_t * m, int mode) {
+    if (m && m->m) {
+        m->m->set_aspect_fix_mode(static_cast<mapnik::Map::aspect_fix_mode>(mode));
+    }
+}
+
 const char *mapnik_map_last_error(mapnik_map_t *m) {
     if (m && m->err) {
         return m->err->c_str();
@@ -219,6 +378,16 @@ void mapnik_map_zoom_to_box(mapnik_map_t * m, mapnik_bbox_t * b) {
     }
 }
 
+void mapnik_map_get_current_extent(mapnik_map_t * m, double * minx, double * miny, double * maxx, double * maxy) {
+    if (m && m->m) {
+        mapnik::box2d<double> e = m->m->get_current_extent();
+        *minx = e.minx();
+        *miny = e.miny();
+        *maxx = e.maxx();
+        *maxy = e.maxy();
+    }
+}
+
 struct _mapnik_image_t {
     mapnik_image_type *i;
 };
@@ -269,6 +438,331 @@ mapnik_image_blob_t * mapnik_image_to_png_blob(mapnik_image_t * i) {
     return blob;
 }
 
+mapnik_image_blob_t * mapnik_image_to_blob(mapnik_image_t * i, const char * format) {
+    mapnik_image_blob_t * blob = new mapnik_image_blob_t;
+    blob->ptr = NULL;
+    blob->len = 0;
+    if (i && i->i) {
+        try {
+            std::string s = save_to_string(*(i->i), format);
+            blob->len = s.length();
+            blob->ptr = new char[blob->len];
+            memcpy(blob->ptr, s.c_str(), blob->len);
+        } catch (std::exception const&) {
+            blob->len = 0;
+        }
+    }
+    return blob;
+}
+
+unsigned int mapnik_map_layer_count(mapnik_map_t * m) {
+    if (m && m->m) {
+        return m->m->layer_count();
+    }
+    return 0;
+}
+
+const char * mapnik_map_layer_name(mapnik_map_t * m, unsigned int idx) {
+    if (m && m->m && idx < m->m->layer_count()) {
+        return m->m->layers()[idx].name().c_str();
+    }
+    return NULL;
+}
+
+#if MAPNIK_VERSION >= 300000
+// features_to_geojson reprojects features from srs to WGS84 and
+// encodes them as json array.
+static char * features_to_geojson(mapnik::featureset_ptr fs, std::string const& srs) {
+    mapnik::projection source(srs);
+    mapnik::projection dest("+proj=longlat +ellps=WGS84 +datum=WGS84 +no_defs");
+    mapnik::proj_transform prj_trans(source, dest);
+    std::string json = "[";
+    if (fs) {
+        mapnik::feature_ptr feature;
+        while ((feature = fs->next())) {
+            unsigned int n_err = 0;
+            feature->set_geometry(mapnik::geometry::reproject_copy(feature->get_geometry(), prj_trans, n_err));
+            std::string f;
+            if (!mapnik::util::to_geojson(f, *feature)) {
+                throw std::runtime_error("unable to encode feature as GeoJSON");
+            }
+            if (json.size() > 1) json += ",";
+            json += f;
+        }
+    }
+    json += "]";
+    return strdup(json.c_str());
+}
+#endif
+
+char * mapnik_map_query_map_point(mapnik_map_t * m, unsigned int idx, double x, double y) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+#if MAPNIK_VERSION >= 300000
+        try {
+            mapnik::featureset_ptr fs = m->m->query_map_point(idx, x, y);
+            return features_to_geojson(fs, m->m->layers()[idx].srs());
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+        }
+#else
+        m->err = new std::string("feature queries require mapnik 3");
+#endif
+    }
+    return NULL;
+}
+
+char * mapnik_map_query_box(mapnik_map_t * m, unsigned int idx, double minx, double miny, double maxx, double maxy) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+#if MAPNIK_VERSION >= 300000
+        try {
+            if (idx >= m->m->layer_count()) {
+                throw std::out_of_range("layer index out of range");
+            }
+            mapnik::layer const& lyr = m->m->layers()[idx];
+            mapnik::datasource_ptr ds = lyr.datasource();
+            if (!ds) {
+                return strdup("[]");
+            }
+            mapnik::projection dest(m->m->srs());
+            mapnik::projection source(lyr.srs());
+            mapnik::proj_transform prj_trans(source, dest);
+            mapnik::box2d<double> box(minx, miny, maxx, maxy);
+            prj_trans.backward(box, 20);
+
+            mapnik::query q(box);
+            for (auto const& desc : ds->get_descriptor().get_descriptors()) {
+                q.add_property_name(desc.get_name());
+            }
+            return features_to_geojson(ds->features(q), lyr.srs());
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+        }
+#else
+        m->err = new std::string("feature queries require mapnik 3");
+#endif
+    }
+    return NULL;
+}
+
+#ifdef MAPNIK_C_API_GRID
+// json_string quotes and escapes a utf-8 string for json.
+static std::string json_string(std::string const& s) {
+    std::ostringstream out;
+    out << '"';
+    for (std::string::const_iterator it = s.begin(); it != s.end(); ++it) {
+        unsigned char c = *it;
+        switch (c) {
+        case '"': out << "\\\""; break;
+        case '\\': out << "\\\\"; break;
+        case '\n': out << "\\n"; break;
+        case '\r': out << "\\r"; break;
+        case '\t': out << "\\t"; break;
+        default:
+            if (c < 0x20) {
+                char buf[8];
+                sprintf(buf, "\\u%04x", c);
+                out << buf;
+            } else {
+                out << *it;
+            }
+        }
+    }
+    out << '"';
+    return out.str();
+}
+
+// utf8_codepoint encodes a UTFGrid codepoint as utf-8.
+static void utf8_codepoint(std::string & s, unsigned int c) {
+    if (c < 0x80) {
+        s += static_cast<char>(c);
+    } else if (c < 0x800) {
+        s += static_cast<char>(0xC0 | (c >> 6));
+        s += static_cast<char>(0x80 | (c & 0x3F));
+    } else {
+        s += static_cast<char>(0xE0 | (c >> 12));
+        s += static_cast<char>(0x80 | ((c >> 6) & 0x3F));
+        s += static_cast<char>(0x80 | (c & 0x3F));
+    }
+}
+
+// value_to_json encodes feature attributes as json.
+#if MAPNIK_VERSION >= 300000
+struct value_to_json
+#else
+struct value_to_json : public boost::static_visitor<std::string>
+#endif
+{
+    std::string operator() (mapnik::value_null const&) const {
+        return "null";
+    }
+    std::string operator() (mapnik::value_bool const& v) const {
+        return v ? "true" : "false";
+    }
+    std::string operator() (mapnik::value_integer const& v) const {
+        std::ostringstream s;
+        s << v;
+        return s.str();
+    }
+    std::string operator() (mapnik::value_double const& v) const {
+        if (v != v || v > DBL_MAX || v < -DBL_MAX) return "null";
+        std::ostringstream s;
+        s.precision(16);
+        s << v;
+        return s.str();
+    }
+    std::string operator() (mapnik::value_unicode_string const& v) const {
+        std::string s;
+        v.toUTF8String(s);
+        return json_string(s);
+    }
+};
+
+static std::string attribute_to_json(mapnik::value const& v) {
+#if MAPNIK_VERSION >= 300000
+    return mapnik::util::apply_visitor(value_to_json(), v);
+#else
+    return boost::apply_visitor(value_to_json(), v.base());
+#endif
+}
+
+// grid_to_utf encodes a rendered grid as UTFGrid with one character
+// per resolution x resolution pixels, like the python bindings do.
+static std::string grid_to_utf(mapnik::grid const& grid, unsigned int resolution) {
+    typedef std::map<mapnik::grid::lookup_type, unsigned int> keys_type;
+    mapnik::grid::feature_key_type const& feature_keys = grid.get_feature_keys();
+    keys_type keys;
+    std::vector<mapnik::grid::lookup_type> key_order;
+    // start at codepoint 32, the space character
+    unsigned int codepoint = 32;
+
+    std::string json = "{\"grid\":[";
+    for (unsigned int y = 0; y < grid.height(); y += resolution) {
+        std::string line;
+        for (unsigned int x = 0; x < grid.width(); x += resolution) {
+            mapnik::grid::value_type feature_id = grid.data()(x, y);
+            mapnik::grid::feature_key_type::const_iterator feature_pos = feature_keys.find(feature_id);
+            if (feature_pos == feature_keys.end()) {
+                continue;
+            }
+            mapnik::grid::lookup_type val = feature_pos->second;
+            if (feature_id == mapnik::grid::base_mask) {
+                val = "";
+            }
+            keys_type::iterator key_pos = keys.find(val);
+            if (key_pos == keys.end()) {
+                // skip codepoints that need escaping in json
+                if (codepoint == 34) ++codepoint;
+                else if (codepoint == 92) ++codepoint;
+                // skip utf-16 surrogates
+                if (codepoint == 0xD800) codepoint = 0xE000;
+                keys[val] = codepoint;
+                key_order.push_back(val);
+                utf8_codepoint(line, codepoint);
+                ++codepoint;
+            } else {
+                utf8_codepoint(line, key_pos->second);
+            }
+        }
+        if (y > 0) json += ",";
+        json += "\"" + line + "\"";
+    }
+
+    json += "],\"keys\":[";
+    for (std::size_t i = 0; i < key_order.size(); ++i) {
+        if (i > 0) json += ",";
+        json += json_string(key_order[i]);
+    }
+
+    json += "],\"data\":{";
+    mapnik::grid::feature_type const& features = grid.get_grid_features();
+#if MAPNIK_VERSION >= 300000
+    std::set<std::string> const& fields = grid.get_fields();
+#else
+    std::set<std::string> const& fields = grid.property_names();
+#endif
+    bool first = true;
+    for (std::size_t i = 0; i < key_order.size(); ++i) {
+        if (key_order[i].empty()) continue;
+        mapnik::grid::feature_type::const_iterator feat = features.find(key_order[i]);
+        if (feat == features.end()) continue;
+        std::string data;
+        for (std::set<std::string>::const_iterator field = fields.begin(); field != fields.end(); ++field) {
+            std::string value;
+            if (*field == "__id__") {
+                std::ostringstream s;
+                s << feat->second->id();
+                value = s.str();
+            } else if (feat->second->has_key(*field)) {
+                value = attribute_to_json(feat->second->get(*field));
+            } else {
+                continue;
+            }
+            if (!data.empty()) data += ",";
+            data += json_string(*field) + ":" + value;
+        }
+        if (data.empty()) continue;
+        if (!first) json += ",";
+        json += json_string(key_order[i]) + ":{" + data + "}";
+        first = false;
+    }
+    json += "}}";
+    return json;
+}
+#endif
+
+char * mapnik_map_render_grid(mapnik_map_t * m, unsigned int idx, const char * key, const char * fields, unsigned int resolution) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+#ifdef MAPNIK_C_API_GRID
+        try {
+            std::vector<mapnik::layer> const& layers = m->m->layers();
+            if (idx >= layers.size()) {
+                throw std::out_of_range("layer index out of range");
+            }
+            if (resolution < 1) resolution = 1;
+#if MAPNIK_VERSION >= 300000
+            mapnik::grid grid(m->m->width(), m->m->height(), key);
+#else
+            mapnik::grid grid(m->m->width(), m->m->height(), key, resolution);
+#endif
+            std::istringstream names(fields);
+            std::string name;
+            while (std::getline(names, name, ',')) {
+                if (name.empty()) continue;
+#if MAPNIK_VERSION >= 300000
+                grid.add_field(name);
+#else
+                grid.add_property_name(name);
+#endif
+            }
+
+            // attributes to fetch, the key is needed to identify features
+#if MAPNIK_VERSION >= 300000
+            std::set<std::string> attributes = grid.get_fields();
+#else
+            std::set<std::string> attributes = grid.property_names();
+#endif
+            std::string const id_key = "__id__";
+            attributes.erase(id_key);
+            if (grid.get_key() != id_key) {
+                attributes.insert(grid.get_key());
+            }
+
+            mapnik::grid_renderer<mapnik::grid> ren(*m->m, grid, 1.0, 0, 0);
+            ren.apply(layers[idx], attributes);
+            return strdup(grid_to_utf(grid, resolution).c_str());
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+        }
+#else
+        m->err = new std::string("mapnik was built without grid renderer");
+#endif
+    }
+    return NULL;
+}
+
 const char * mapnik_version_string() {
 #if MAPNIK_VERSION >= 200100
     return MAPNIK_VERSION_STRING;
@@ -53,6 +53,8 @@ MAPNIKCAPICALL void mapnik_image_blob_free(mapnik_image_blob_t * b);
 
 MAPNIKCAPICALL mapnik_image_blob_t * mapnik_image_to_png_blob(mapnik_image_t * i);
 
+MAPNIKCAPICALL mapnik_image_blob_t * mapnik_image_to_blob(mapnik_image_t * i, const char * format);
+
 
 
 //  Map
@@ -76,16 +78,45 @@ MAPNIKCAPICALL int mapnik_map_zoom_all(mapnik_map_t * m);
 
 MAPNIKCAPICALL int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath);
 
+MAPNIKCAPICALL int mapnik_map_render_to_file_format(mapnik_map_t * m, const char* filepath, const char* format);
+
 MAPNIKCAPICALL void mapnik_map_resize(mapnik_map_t * m, unsigned int width, unsigned int height);
 
 MAPNIKCAPICALL void mapnik_map_set_buffer_size(mapnik_map_t * m, int buffer_size);
 
+MAPNIKCAPICALL void mapnik_map_set_background(mapnik_map_t * m, unsigned char r, unsigned char g, unsigned char b, unsigned char a);
+
+MAPNIKCAPICALL void mapnik_map_set_aspect_fix_mode(mapnik_map_t * m, int mode);
+
 MAPNIKCAPICALL void mapnik_map_zoom_to_box(mapnik_map_t * m, mapnik_bbox_t * b);
 
+MAPNIKCAPICALL void mapnik_map_get_current_extent(mapnik_map_t * m, double * minx, double * miny, double * maxx, double * maxy);
+
 MAPNIKCAPICALL mapnik_projection_t * mapnik_map_projection(mapnik_map_t *m);
 
 MAPNIKCAPICALL mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m);
 
+// Cairo rendering to pdf, svg or ps of a page of the map size times
+// scale, NULL on error or without cairo support.
+MAPNIKCAPICALL mapnik_image_blob_t * mapnik_map_render_to_vector(mapnik_map_t * m, const char * format, double scale, double scale_factor);
+
+MAPNIKCAPICALL int mapnik_has_cairo();
+
+
+// Feature queries return a json array of GeoJSON features in
+// WGS84, which has to be freed by the caller, or NULL on error.
+MAPNIKCAPICALL unsigned int mapnik_map_layer_count(mapnik_map_t * m);
+
+MAPNIKCAPICALL const char * mapnik_map_layer_name(mapnik_map_t * m, unsigned int idx);
+
+MAPNIKCAPICALL char * mapnik_map_query_map_point(mapnik_map_t * m, unsigned int idx, double x, double y);
+
+MAPNIKCAPICALL char * mapnik_map_query_box(mapnik_map_t * m, unsigned int idx, double minx, double miny, double maxx, double maxy);
+
+// UTFGrid json of a layer for the current map extent, which has to be
+// freed by the caller, or NULL on error. fields is comma separated.
+MAPNIKCAPICALL char * mapnik_map_render_grid(mapnik_map_t * m, unsigned int idx, const char * key, const char * fields, unsigned int resolution);
+
 #ifdef __cplusplus
 }
 #endif
@@ -28,7 +28,7 @@ func NewTileLayer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	Ligneous.Info(fmt.Sprintf("%v", api_request))
+	Ligneous.Info(api_request.redacted())
 
 	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 
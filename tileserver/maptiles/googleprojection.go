@@ -32,6 +32,22 @@ func init() {
 	}
 }
 
+// mercatorExtent half width of the Web Mercator (EPSG:3857) world in meters.
+const mercatorExtent = 20037508.342789244
+
+// fromLLtoMercator converts LatLng to Web Mercator (EPSG:3857) meters.
+func fromLLtoMercator(ll [2]float64) [2]float64 {
+	lat := minmax(ll[1], -85.0511287798, 85.0511287798)
+	x := ll[0] * mercatorExtent / 180
+	y := math.Log(math.Tan((90+lat)*math.Pi/360)) * mercatorExtent / math.Pi
+	return [2]float64{x, y}
+}
+
+// mercatorResolution returns meters per pixel of tiles at zoom.
+func mercatorResolution(zoom int, tileSize int) float64 {
+	return 2 * mercatorExtent / (float64(tileSize) * math.Pow(2, float64(zoom)))
+}
+
 // degTorad converts degree to radians.
 func degTorad(deg float64) float64 {
 	return deg * math.Pi / 180
@@ -2,7 +2,9 @@ package maptiles
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"net/http"
+	"strings"
 )
 
 // SendJsonResponseFromByte Sends http json response from byte.
@@ -34,6 +36,36 @@ func SendJsonResponseFromInterface(w http.ResponseWriter, r *http.Request, data
 	return status
 }
 
+// SendXMLResponseFromInterface sends http xml response from interface.
+func SendXMLResponseFromInterface(w http.ResponseWriter, r *http.Request, data interface{}) int {
+	x, err := xml.MarshalIndent(data, "", "  ")
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 500
+	}
+	return SendXMLResponseFromString(xml.Header+string(x), w, r)
+}
+
+// baseURL returns public url of the server. Without configured
+// publicURL it is derived from the request and proxy headers.
+func baseURL(publicURL string, r *http.Request) string {
+	if "" != publicURL {
+		return strings.TrimRight(publicURL, "/")
+	}
+	scheme := "http"
+	if nil != r.TLS {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); "" != proto {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); "" != forwarded {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
+
 // SendXMLResponseFromString sends http xml response from string.
 func SendXMLResponseFromString(content string, w http.ResponseWriter, r *http.Request) int {
 	w.Header().Set("Content-Type", "text/xml")
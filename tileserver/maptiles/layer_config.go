@@ -0,0 +1,248 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// tileFormats maps supported tile formats to their mime type.
+var tileFormats = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"pbf":  mvtMimeType,
+}
+
+// gridResolution pixels per UTFGrid cell in each direction.
+const gridResolution = 4
+
+// LayerInteractivity UTFGrid settings of a tile layer. Grids are rendered
+// from one layer of the stylesheet, features are identified by the Key
+// attribute, "__id__" for feature ids, and carry the Fields attributes.
+type LayerInteractivity struct {
+	Layer  string   `json:"layer"`
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+// LayerConfig configuration of a tile layer.
+// In config files a layer is either an object or just its source string.
+type LayerConfig struct {
+	Source      string            `json:"source"`
+	MinZoom     int               `json:"minzoom"`
+	MaxZoom     int               `json:"maxzoom"`
+	Bounds      [4]float64        `json:"bounds"`
+	Attribution string            `json:"attribution,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Format      string            `json:"format"`
+	TileSize    int               `json:"tile_size"`
+	BufferSize  int               `json:"buffer_size"`
+	TTL         int               `json:"ttl"`
+	Workers     int               `json:"workers"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Interactivity enables UTFGrid tiles of mapnik layers.
+	Interactivity *LayerInteractivity `json:"interactivity,omitempty"`
+}
+
+// NewLayerConfig creates LayerConfig with default values.
+func NewLayerConfig(source string) LayerConfig {
+	return LayerConfig{
+		Source:     source,
+		MinZoom:    0,
+		MaxZoom:    20,
+		Bounds:     [4]float64{-180, -85, 180, 85},
+		Format:     "png",
+		TileSize:   256,
+		BufferSize: 128,
+		TTL:        0,
+		Workers:    1,
+	}
+}
+
+// LayerConfigFromMetadata creates LayerConfig for a layer stored in the
+// tile cache. Settings not kept in the metadata table get default values.
+func LayerConfigFromMetadata(metadata LayerMetadata) LayerConfig {
+	c := NewLayerConfig(metadata.Source)
+	c.MinZoom = metadata.MinZoom
+	c.MaxZoom = metadata.MaxZoom
+	c.Bounds = metadata.Bounds
+	c.Attribution = metadata.Attribution
+	c.Description = metadata.Description
+	if _, ok := tileFormats[metadata.Format]; ok {
+		c.Format = metadata.Format
+	}
+	return c
+}
+
+// UnmarshalJSON reads layer config from a source string or an object.
+// Fields missing from the object keep their default values.
+func (self *LayerConfig) UnmarshalJSON(data []byte) error {
+	var source string
+	if err := json.Unmarshal(data, &source); nil == err {
+		*self = NewLayerConfig(source)
+		return nil
+	}
+	type layerConfig LayerConfig
+	c := layerConfig(NewLayerConfig(""))
+	if err := json.Unmarshal(data, &c); nil != err {
+		return err
+	}
+	*self = LayerConfig(c)
+	return nil
+}
+
+// Validate checks layer config values.
+func (self LayerConfig) Validate() error {
+	if !isValidTileSource(self.Source) {
+		return fmt.Errorf("Tile layer source is not valid: %v", self.RedactedSource())
+	}
+	if self.MinZoom < 0 || self.MaxZoom >= len(gp.Ac) || self.MinZoom > self.MaxZoom {
+		return fmt.Errorf("Invalid zoom range: %v-%v", self.MinZoom, self.MaxZoom)
+	}
+	west, south, east, north := self.Bounds[0], self.Bounds[1], self.Bounds[2], self.Bounds[3]
+	if west < -180 || east > 180 || south < -90 || north > 90 || west >= east || south >= north {
+		return fmt.Errorf("Invalid bounds: %v", joinFloats(self.Bounds[:]))
+	}
+	if _, ok := tileFormats[self.Format]; !ok {
+		return fmt.Errorf("Unsupported tile format: %v", self.Format)
+	}
+	if 256 != self.TileSize && 512 != self.TileSize {
+		return fmt.Errorf("Unsupported tile size: %v", self.TileSize)
+	}
+	if self.BufferSize < 0 {
+		return fmt.Errorf("Invalid buffer size: %v", self.BufferSize)
+	}
+	if self.TTL < 0 {
+		return fmt.Errorf("Invalid ttl: %v", self.TTL)
+	}
+	if self.Workers < 1 {
+		return fmt.Errorf("Invalid number of workers: %v", self.Workers)
+	}
+	if self.IsDatasource() && "pbf" != self.Format {
+		return fmt.Errorf("Datasource sources require pbf format: %v", self.RedactedSource())
+	}
+	if nil != self.Interactivity {
+		if !self.IsStylesheet() {
+			return fmt.Errorf("Interactivity requires a mapnik stylesheet: %v", self.Source)
+		}
+		if "" == self.Interactivity.Layer {
+			return fmt.Errorf("Interactivity layer is missing")
+		}
+	}
+	return nil
+}
+
+// Metadata creates MBTiles metadata for layer.
+func (self LayerConfig) Metadata(name string) LayerMetadata {
+	metadata := NewLayerMetadata(name, self.RedactedSource())
+	metadata.Format = self.Format
+	metadata.MinZoom = self.MinZoom
+	metadata.MaxZoom = self.MaxZoom
+	metadata.Bounds = self.Bounds
+	metadata.Center = [3]float64{
+		(self.Bounds[0] + self.Bounds[2]) / 2,
+		(self.Bounds[1] + self.Bounds[3]) / 2,
+		float64(self.MinZoom),
+	}
+	if "" != self.Attribution {
+		metadata.Attribution = self.Attribution
+	}
+	if "" != self.Description {
+		metadata.Description = self.Description
+	}
+	return metadata
+}
+
+// RedactedSource returns source without the password of PostGIS urls.
+// The password is only kept in memory, it is not stored in the layer
+// metadata nor logged.
+func (self LayerConfig) RedactedSource() string {
+	return RedactPassword(self.Source, "")
+}
+
+// checkRestored checks that a layer restored from its metadata can be
+// rendered. The metadata keep PostGIS urls without their password, so
+// these layers are only restored when libpq reads the password from the
+// environment, PGPASSWORD or a password file. Metadata stored by older
+// versions may still have the password.
+func (self LayerConfig) checkRestored() error {
+	if !strings.HasPrefix(self.Source, postgisScheme) || self.Source != self.RedactedSource() || pgPasswordFromEnvironment() {
+		return nil
+	}
+	return fmt.Errorf("Password of PostGIS source %v is not stored, add the layer to the config file or set PGPASSWORD", self.Source)
+}
+
+// pgPasswordFromEnvironment checks if libpq finds a password in
+// PGPASSWORD or in the password file, PGPASSFILE or ~/.pgpass.
+func pgPasswordFromEnvironment() bool {
+	if "" != os.Getenv("PGPASSWORD") {
+		return true
+	}
+	file := os.Getenv("PGPASSFILE")
+	if "" == file {
+		home, err := os.UserHomeDir()
+		if nil != err {
+			return false
+		}
+		file = filepath.Join(home, ".pgpass")
+	}
+	_, err := os.Stat(file)
+	return nil == err
+}
+
+// MimeType returns mime type of tile format.
+func (self LayerConfig) MimeType() string {
+	return tileFormats[self.Format]
+}
+
+// IsStylesheet checks if the layer is rendered from a mapnik stylesheet
+// rather than proxied from another tile server.
+func (self LayerConfig) IsStylesheet() bool {
+	return strings.Contains(self.Source, ".xml")
+}
+
+// IsDatasource checks if the layer is a shapefile or PostGIS source,
+// rendered as vector tiles without a stylesheet.
+func (self LayerConfig) IsDatasource() bool {
+	return isDatasourceSource(self.Source)
+}
+
+// IsVector checks if the layer is rendered as Mapbox vector tiles.
+func (self LayerConfig) IsVector() bool {
+	return "pbf" == self.Format && (self.IsStylesheet() || self.IsDatasource())
+}
+
+// MaxAge returns how long cached tiles stay valid, zero if they never expire.
+func (self LayerConfig) MaxAge() time.Duration {
+	return time.Duration(self.TTL) * time.Second
+}
+
+// sameTiles checks if tiles and grids rendered with both configs are
+// identical, otherwise cached tiles have to be purged. Passwords are
+// ignored, layers restored from metadata have none.
+func (self LayerConfig) sameTiles(other LayerConfig) bool {
+	return self.RedactedSource() == other.RedactedSource() &&
+		self.Format == other.Format &&
+		self.TileSize == other.TileSize &&
+		self.BufferSize == other.BufferSize &&
+		reflect.DeepEqual(self.Interactivity, other.Interactivity)
+}
+
+// HasGrids checks if UTFGrid tiles are rendered for the layer.
+func (self LayerConfig) HasGrids() bool {
+	return nil != self.Interactivity && self.IsStylesheet()
+}
+
+// gridKey returns the UTFGrid key attribute.
+func (self LayerInteractivity) gridKey() string {
+	if "" == self.Key {
+		return "__id__"
+	}
+	return self.Key
+}
@@ -0,0 +1,14 @@
+package maptiles
+
+import (
+	"os"
+	"testing"
+
+	seelog "github.com/cihub/seelog"
+)
+
+// TestMain keeps tests from writing log files.
+func TestMain(m *testing.M) {
+	Ligneous = seelog.Disabled
+	os.Exit(m.Run())
+}
@@ -0,0 +1,79 @@
+package maptiles
+
+import (
+	"sync"
+)
+
+import "mapnik"
+
+// MapPool keeps loaded mapnik maps of a stylesheet layer, so WMS and
+// feature queries of arbitrary extents do not load the stylesheet for
+// every request. The pool of a layer is closed when the layer is
+// replaced or removed.
+type MapPool struct {
+	lock   sync.Mutex
+	config LayerConfig
+	srs    string
+	maps   []*mapnik.Map
+	closed bool
+}
+
+// newMapPool creates MapPool struct, maps are loaded on demand.
+func newMapPool(config LayerConfig) *MapPool {
+	return &MapPool{config: config}
+}
+
+// Config returns config of the layer of the pool.
+func (self *MapPool) Config() LayerConfig {
+	return self.config
+}
+
+// Get returns an idle map of size width x height in the projection of
+// the stylesheet, or loads the stylesheet into a new map. Callers set
+// the extent and render settings, the map is given back with Put.
+func (self *MapPool) Get(width, height int) (*mapnik.Map, error) {
+	self.lock.Lock()
+	if n := len(self.maps); 0 != n {
+		m := self.maps[n-1]
+		self.maps = self.maps[:n-1]
+		srs := self.srs
+		self.lock.Unlock()
+		m.Resize(uint32(width), uint32(height))
+		m.SetSRS(srs)
+		return m, nil
+	}
+	self.lock.Unlock()
+
+	m := mapnik.NewMap(uint32(width), uint32(height))
+	if err := m.Load(self.config.Source); nil != err {
+		m.Free()
+		return nil, err
+	}
+	self.lock.Lock()
+	self.srs = m.SRS()
+	self.lock.Unlock()
+	return m, nil
+}
+
+// Put gives map back to the pool, maps are freed once the pool is
+// closed. At most one idle map is kept per map slot.
+func (self *MapPool) Put(m *mapnik.Map) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed || len(self.maps) >= cap(mapSlots) {
+		m.Free()
+		return
+	}
+	self.maps = append(self.maps, m)
+}
+
+// Close frees the idle maps of the pool.
+func (self *MapPool) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	for _, m := range self.maps {
+		m.Free()
+	}
+	self.maps = nil
+}
@@ -3,6 +3,9 @@ package maptiles
 import (
 	"database/sql"
 	"fmt"
+	"sync"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -13,8 +16,12 @@ type TileDbSqlite3 struct {
 	db          *sql.DB
 	requestChan chan TileFetchRequest
 	insertChan  chan TileFetchResult
+	purgeChan   chan purgeRequest
 	layerIds    map[string]int
+	layerLock   sync.RWMutex
+	quit        chan bool
 	qc          chan bool
+	closeOnce   sync.Once
 }
 
 // NewTileDbSqlite creates TileDbSqlite3 struct.
@@ -27,26 +34,22 @@ func NewTileDbSqlite(path string) *TileDbSqlite3 {
 		Ligneous.Error("Error opening db", err.Error())
 		return nil
 	}
-	queries := []string{
-		"PRAGMA journal_mode = OFF",
-		"CREATE TABLE IF NOT EXISTS layers(layer_name TEXT PRIMARY KEY NOT NULL)",
-		"CREATE TABLE IF NOT EXISTS metadata (name TEXT NOT NULL, value TEXT NOT NULL, layer_name TEXT NOT NULL)",
-		"CREATE TABLE IF NOT EXISTS tiles (layer_id INTEGER, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data blob, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row))",
+	if _, err = m.db.Exec("PRAGMA journal_mode = OFF"); err != nil {
+		Ligneous.Error("Error setting up db", err.Error())
+		return nil
 	}
-
-	for _, query := range queries {
-		_, err = m.db.Exec(query)
-		if err != nil {
-			Ligneous.Error("Error setting up db", err.Error())
-			Ligneous.Debug(query, "\n")
-			return nil
-		}
+	if err = migrateSchema(m.db, sqliteMigrations, sqliteInsertVersion); err != nil {
+		Ligneous.Error("Error setting up db", err.Error())
+		return nil
 	}
 
 	m.readLayers()
 
-	m.insertChan = make(chan TileFetchResult)
+	m.insertChan = make(chan TileFetchResult, insertQueueSize)
 	m.requestChan = make(chan TileFetchRequest)
+	m.purgeChan = make(chan purgeRequest)
+	m.quit = make(chan bool)
+	m.qc = make(chan bool)
 	go m.Run()
 	return &m
 }
@@ -54,27 +57,40 @@ func NewTileDbSqlite(path string) *TileDbSqlite3 {
 // readLayers reads through tile layers table and sets up
 // lookup table for layer names and indexes.
 func (self *TileDbSqlite3) readLayers() {
-	self.layerIds = make(map[string]int)
+	layerIds := make(map[string]int)
 	rows, err := self.db.Query("SELECT rowid, layer_name FROM layers")
 	if err != nil {
 		Ligneous.Error("Error fetching layer definitions", err.Error())
+		return
 	}
+	defer rows.Close()
 	var s string
 	var i int
 	for rows.Next() {
 		if err := rows.Scan(&i, &s); err != nil {
 			Ligneous.Error(err)
 		}
-		self.layerIds[s] = i
+		layerIds[s] = i
 	}
 	if err := rows.Err(); err != nil {
 		Ligneous.Error(err)
 	}
+	self.layerLock.Lock()
+	self.layerIds = layerIds
+	self.layerLock.Unlock()
+}
+
+// layerId gets index of tile layer from lookup table.
+func (self *TileDbSqlite3) layerId(layer string) (int, bool) {
+	self.layerLock.RLock()
+	defer self.layerLock.RUnlock()
+	i, ok := self.layerIds[layer]
+	return i, ok
 }
 
 // ensureLayer checks if tile layer is in lookup table.
 func (self *TileDbSqlite3) ensureLayer(layer string) {
-	if _, ok := self.layerIds[layer]; !ok {
+	if _, ok := self.layerId(layer); !ok {
 		if _, err := self.db.Exec("INSERT OR IGNORE INTO layers(layer_name) VALUES(?)", layer); err != nil {
 			Ligneous.Error(err)
 		}
@@ -82,89 +98,93 @@ func (self *TileDbSqlite3) ensureLayer(layer string) {
 	}
 }
 
-// Close tile request channels.
+// Close stops Run once pending tile inserts are written and closes
+// the database. Tile requests must not be sent after Close.
 func (self *TileDbSqlite3) Close() {
-	close(self.insertChan)
-	close(self.requestChan)
-	if self.qc != nil {
+	self.closeOnce.Do(func() {
+		close(self.quit)
 		<-self.qc // block until channel qc is closed (meaning Run() is finished)
-	}
-	if err := self.db.Close(); err != nil {
-		Ligneous.Error(err)
-	}
-
+		if err := self.db.Close(); err != nil {
+			Ligneous.Error(err)
+		}
+	})
 }
 
 // InsertQueue gets tile insert channel.
-func (self TileDbSqlite3) InsertQueue() chan<- TileFetchResult {
+func (self *TileDbSqlite3) InsertQueue() chan<- TileFetchResult {
 	return self.insertChan
 }
 
 // RequestQueue gets tile request channel.
-func (self TileDbSqlite3) RequestQueue() chan<- TileFetchRequest {
+func (self *TileDbSqlite3) RequestQueue() chan<- TileFetchRequest {
 	return self.requestChan
 }
 
 // Run runs tile generation.
 // Best executed in a dedicated go routine.
+// Exits on Close after writing queued tile inserts.
 func (self *TileDbSqlite3) Run() {
-	self.qc = make(chan bool)
+	defer close(self.qc)
 	for {
 		select {
 		case r := <-self.requestChan:
 			self.fetch(r)
 		case i := <-self.insertChan:
 			self.insert(i)
+		case p := <-self.purgeChan:
+			self.insertQueued()
+			p.errChan <- self.purgeLayer(p.layer)
+		case <-self.quit:
+			self.insertQueued()
+			return
+		}
+	}
+}
+
+// insertQueued inserts the tiles queued so far.
+func (self *TileDbSqlite3) insertQueued() {
+	for {
+		select {
+		case i := <-self.insertChan:
+			self.insert(i)
+		default:
+			return
 		}
 	}
-	self.qc <- true
 }
 
 // insert tile request into database table.
 func (self *TileDbSqlite3) insert(i TileFetchResult) {
 	i.Coord.setTMS(true)
 	x, y, zoom, l := i.Coord.X, i.Coord.Y, i.Coord.Zoom, i.Coord.Layer
-	queryString := "SELECT tile_data FROM tiles WHERE layer_id=? AND zoom_level=? AND tile_column=? AND tile_row=?"
-	row := self.db.QueryRow(queryString, self.layerIds[l], zoom, x, y)
-	var dummy uint64
-	err := row.Scan(&dummy)
-	switch {
-	case err == sql.ErrNoRows:
-		queryString = "UPDATE tiles SET tile_data=? WHERE layer_id=? AND zoom_level=? AND tile_column=? AND tile_row=?"
-		if _, err = self.db.Exec(queryString, i.BlobPNG, self.layerIds[l], zoom, x, y); err != nil {
-			Ligneous.Error("error during insert", err)
-			return
-		}
-		Ligneous.Trace(fmt.Sprintf("INSERT BLOB %v %v %v %v", l, zoom, x, y))
-	case err != nil:
-		Ligneous.Error(err)
-		return
-	default:
-		Ligneous.Trace(fmt.Sprintf("INSERT BLOB %v %v %v %v", l, zoom, x, y))
-	}
 	self.ensureLayer(l)
-	queryString = "REPLACE INTO tiles VALUES(?, ?, ?, ?, ?)"
-	if _, err = self.db.Exec(queryString, self.layerIds[l], zoom, x, y, i.BlobPNG); err != nil {
-		Ligneous.Error(err)
+	layerId, _ := self.layerId(l)
+	queryString := fmt.Sprintf("REPLACE INTO %v(layer_id, zoom_level, tile_column, tile_row, tile_data, updated_at) VALUES(?, ?, ?, ?, ?, CAST(strftime('%%s', 'now') AS INTEGER))", tileTable(i.Coord))
+	if _, err := self.db.Exec(queryString, layerId, zoom, x, y, i.BlobPNG); err != nil {
+		Ligneous.Error("error during insert", err)
+		return
 	}
+	Ligneous.Trace(fmt.Sprintf("INSERT BLOB %v %v %v %v", l, zoom, x, y))
 }
 
 // fetch gets cached tile from database.
 func (self *TileDbSqlite3) fetch(r TileFetchRequest) {
 	r.Coord.setTMS(true)
 	zoom, x, y, l := r.Coord.Zoom, r.Coord.X, r.Coord.Y, r.Coord.Layer
-	result := TileFetchResult{r.Coord, nil}
-	queryString := `
-		SELECT tile_data
-		FROM tiles
+	result := TileFetchResult{Coord: r.Coord}
+	queryString := fmt.Sprintf(`
+		SELECT tile_data, updated_at
+		FROM %v
 		WHERE zoom_level=?
 			AND tile_column=?
 			AND tile_row=?
 			AND layer_id=?
-		`
+		`, tileTable(r.Coord))
 	var blob []byte
-	row := self.db.QueryRow(queryString, zoom, x, y, self.layerIds[l])
-	err := row.Scan(&blob)
+	var modified int64
+	layerId, _ := self.layerId(l)
+	row := self.db.QueryRow(queryString, zoom, x, y, layerId)
+	err := row.Scan(&blob, &modified)
 	switch {
 	case err == sql.ErrNoRows:
 		result.BlobPNG = nil
@@ -172,45 +192,122 @@ func (self *TileDbSqlite3) fetch(r TileFetchRequest) {
 		Ligneous.Error(err)
 	default:
 		result.BlobPNG = blob
+		result.Modified = time.Unix(modified, 0)
 		Ligneous.Trace(fmt.Sprintf("REUSE BLOB %v %v %v %v", l, zoom, x, y))
 	}
 	r.OutChan <- result
 }
 
-// AddLayerMetadata adds metadata t0 metadata table
-func (self *TileDbSqlite3) AddLayerMetadata(lyr string, stylesheet string) {
-
-	check_query := "SELECT EXISTS(SELECT * FROM metadata WHERE name='name' AND layer_name='" + lyr + "')"
-
-	insert_queries := []string{
-		"INSERT INTO metadata(name, value, layer_name) VALUES('name', '" + lyr + "', '" + lyr + "')",
-		"INSERT INTO metadata(name, value, layer_name) VALUES('source', '" + stylesheet + "', '" + lyr + "')",
-		"INSERT INTO metadata(name, value, layer_name) VALUES('type', 'overlay', '" + lyr + "')",
-		"INSERT INTO metadata(name,value,layer_name) VALUES('version', '1', '" + lyr + "')",
-		"INSERT INTO metadata(name,value,layer_name) VALUES('description', 'Compatible with MBTiles spec 1.2.', '" + lyr + "')",
-		"INSERT INTO metadata(name,value,layer_name) VALUES('format', 'png', '" + lyr + "')",
-		"INSERT INTO metadata(name,value,layer_name) VALUES('bounds', '-180.0,-85,180,85', '" + lyr + "')",
-		"INSERT INTO metadata(name,value,layer_name) VALUES('attribution', 'sjsafranek', '" + lyr + "')",
-	}
-
-	if !self.rowExists(check_query) {
-		Ligneous.Info("Adding metadata for ", lyr)
-		for _, query := range insert_queries {
-			_, err := self.db.Exec(query)
-			if err != nil {
-				Ligneous.Error("Error adding metadata to db", err.Error())
-				Ligneous.Debug(query, "\n")
-			}
+// AddLayerMetadata adds metadata to metadata table.
+// Metadata of an existing layer is left untouched.
+func (self *TileDbSqlite3) AddLayerMetadata(metadata LayerMetadata) error {
+	if self.rowExists("SELECT EXISTS(SELECT * FROM metadata WHERE name='name' AND layer_name=?)", metadata.Name) {
+		return nil
+	}
+	Ligneous.Info("Adding metadata for ", metadata.Name)
+	return self.writeLayerMetadata(metadata)
+}
+
+// UpdateLayerMetadata replaces metadata of layer.
+func (self *TileDbSqlite3) UpdateLayerMetadata(metadata LayerMetadata) error {
+	Ligneous.Info("Updating metadata for ", metadata.Name)
+	return self.writeLayerMetadata(metadata)
+}
+
+// writeLayerMetadata replaces metadata rows of layer in a single transaction.
+func (self *TileDbSqlite3) writeLayerMetadata(metadata LayerMetadata) error {
+	tx, err := self.db.Begin()
+	if nil != err {
+		Ligneous.Error("Error adding metadata to db", err.Error())
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM metadata WHERE layer_name=?", metadata.Name); nil != err {
+		Ligneous.Error("Error adding metadata to db", err.Error())
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO metadata(name, value, layer_name) VALUES(?, ?, ?)")
+	if nil != err {
+		Ligneous.Error("Error adding metadata to db", err.Error())
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range metadata.rows() {
+		if _, err := stmt.Exec(row[0], row[1], metadata.Name); nil != err {
+			Ligneous.Error("Error adding metadata to db", err.Error())
+			tx.Rollback()
+			return err
 		}
-		self.ensureLayer(lyr)
 	}
+	if err := tx.Commit(); nil != err {
+		Ligneous.Error("Error adding metadata to db", err.Error())
+		return err
+	}
+
+	self.ensureLayer(metadata.Name)
+	return nil
+}
+
+// DeleteLayer removes metadata of layer.
+// With purge the cached tiles of the layer are deleted as well,
+// otherwise they are kept for the layer to be added again.
+func (self *TileDbSqlite3) DeleteLayer(lyr string, purge bool) error {
+	Ligneous.Info("Deleting metadata for ", lyr)
+	if _, err := self.db.Exec("DELETE FROM metadata WHERE layer_name=?", lyr); nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+	if !purge {
+		return nil
+	}
+	if err := self.PurgeLayer(lyr); nil != err {
+		return err
+	}
+	if _, err := self.db.Exec("DELETE FROM layers WHERE layer_name=?", lyr); nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+	self.readLayers()
+	return nil
+}
 
+// PurgeLayer deletes cached tiles and grids of layer.
+// The purge is run by Run after the tile inserts queued before it.
+func (self *TileDbSqlite3) PurgeLayer(lyr string) error {
+	p := purgeRequest{layer: lyr, errChan: make(chan error, 1)}
+	select {
+	case self.purgeChan <- p:
+		return <-p.errChan
+	case <-self.quit:
+		return ErrTileDbClosed
+	}
+}
+
+// purgeLayer deletes cached tiles and grids of layer.
+func (self *TileDbSqlite3) purgeLayer(lyr string) error {
+	layerId, ok := self.layerId(lyr)
+	if !ok {
+		return nil
+	}
+	if _, err := self.db.Exec("DELETE FROM grids WHERE layer_id=?", layerId); nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+	result, err := self.db.Exec("DELETE FROM tiles WHERE layer_id=?", layerId)
+	if nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+	n, _ := result.RowsAffected()
+	Ligneous.Info(fmt.Sprintf("Purged %v tiles of %v", n, lyr))
+	return nil
 }
 
 // rowExists checks if row exists in table
-func (self *TileDbSqlite3) rowExists(query string) bool {
+func (self *TileDbSqlite3) rowExists(query string, args ...interface{}) bool {
 	var exists bool
-	err := self.db.QueryRow(query).Scan(&exists)
+	err := self.db.QueryRow(query, args...).Scan(&exists)
 	if nil != err {
 		Ligneous.Error(err)
 	}
@@ -218,33 +315,46 @@ func (self *TileDbSqlite3) rowExists(query string) bool {
 }
 
 // MetaDataHandler gets metadata from database.
-func (self *TileDbSqlite3) MetaDataHandler(lyr string) (map[string]string, error) {
-	metadata := make(map[string]string)
+func (self *TileDbSqlite3) MetaDataHandler(lyr string) (LayerMetadata, error) {
 	rows, err := self.db.Query("SELECT name, value FROM metadata WHERE layer_name=?", lyr)
 	if nil != err {
 		Ligneous.Error(err)
-		return metadata, err
+		return LayerMetadata{}, err
 	}
+	defer rows.Close()
+	values := make(map[string]string)
 	for rows.Next() {
 		var name string
 		var value string
-		rows.Scan(&name, &value)
-		metadata[name] = value
+		if err := rows.Scan(&name, &value); nil != err {
+			Ligneous.Error(err)
+			return LayerMetadata{}, err
+		}
+		values[name] = value
 	}
-	return metadata, nil
+	return parseLayerMetadata(lyr, values), rows.Err()
 }
 
 // GetTileLayers get metadata for all tilelayers.
-func (self *TileDbSqlite3) GetTileLayers() (map[string]map[string]string, error) {
-	layers := make(map[string]map[string]string)
-	rows, err := self.db.Query("SELECT layer_name FROM layers")
+func (self *TileDbSqlite3) GetTileLayers() (map[string]LayerMetadata, error) {
+	layers := make(map[string]LayerMetadata)
+	rows, err := self.db.Query("SELECT layer_name FROM layers WHERE layer_name IN (SELECT layer_name FROM metadata)")
 	if nil != err {
 		Ligneous.Error(err)
 		return layers, err
 	}
+	var names []string
 	for rows.Next() {
 		var layer_name string
-		rows.Scan(&layer_name)
+		if err := rows.Scan(&layer_name); nil != err {
+			rows.Close()
+			Ligneous.Error(err)
+			return layers, err
+		}
+		names = append(names, layer_name)
+	}
+	rows.Close()
+	for _, layer_name := range names {
 		metadata, err := self.MetaDataHandler(layer_name)
 		if nil != err {
 			Ligneous.Error(err)
@@ -254,3 +364,139 @@ func (self *TileDbSqlite3) GetTileLayers() (map[string]map[string]string, error)
 	}
 	return layers, nil
 }
+
+// CountTiles counts cached tiles of layer.
+func (self *TileDbSqlite3) CountTiles(lyr string) (int64, error) {
+	var count int64
+	queryString := "SELECT COUNT(*) FROM tiles JOIN layers ON tiles.layer_id = layers.rowid WHERE layers.layer_name=?"
+	err := self.db.QueryRow(queryString, lyr).Scan(&count)
+	return count, err
+}
+
+// ReadTiles reads a batch of cached tiles, or UTFGrids with grids, of
+// layer ordered by zoom level, column and row, starting after the given
+// position. Coordinates are returned as stored, in TMS schema, with the
+// time the tiles were rendered.
+func (self *TileDbSqlite3) ReadTiles(lyr string, grids bool, zoom, column, row int64, limit int) ([]TileFetchResult, error) {
+	var tiles []TileFetchResult
+	table := tileTable(TileCoord{Grid: grids})
+	queryString := fmt.Sprintf(`
+		SELECT zoom_level, tile_column, tile_row, tile_data, updated_at
+		FROM %[1]v
+		JOIN layers ON %[1]v.layer_id = layers.rowid
+		WHERE layers.layer_name=?
+			AND (zoom_level, tile_column, tile_row) > (?, ?, ?)
+		ORDER BY zoom_level, tile_column, tile_row
+		LIMIT ?
+		`, table)
+	rows, err := self.db.Query(queryString, lyr, zoom, column, row, limit)
+	if nil != err {
+		return tiles, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		result := TileFetchResult{Coord: TileCoord{Tms: true, Layer: lyr, Grid: grids}}
+		var modified int64
+		if err := rows.Scan(&result.Coord.Zoom, &result.Coord.X, &result.Coord.Y, &result.BlobPNG, &modified); nil != err {
+			return tiles, err
+		}
+		result.Modified = time.Unix(modified, 0)
+		tiles = append(tiles, result)
+	}
+	return tiles, rows.Err()
+}
+
+// WriteTiles writes a batch of tiles and UTFGrids in a single transaction,
+// replacing tiles that are already cached. Tiles keep their Modified time,
+// tiles without one are stamped with the current time.
+func (self *TileDbSqlite3) WriteTiles(tiles []TileFetchResult) error {
+	for _, i := range tiles {
+		self.ensureLayer(i.Coord.Layer)
+	}
+
+	tx, err := self.db.Begin()
+	if nil != err {
+		return err
+	}
+	stmts := make(map[string]*sql.Stmt)
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}()
+	for _, i := range tiles {
+		table := tileTable(i.Coord)
+		stmt, ok := stmts[table]
+		if !ok {
+			stmt, err = tx.Prepare(fmt.Sprintf("REPLACE INTO %v(layer_id, zoom_level, tile_column, tile_row, tile_data, updated_at) VALUES(?, ?, ?, ?, ?, ?)", table))
+			if nil != err {
+				tx.Rollback()
+				return err
+			}
+			stmts[table] = stmt
+		}
+		i.Coord.setTMS(true)
+		layerId, _ := self.layerId(i.Coord.Layer)
+		if _, err := stmt.Exec(layerId, i.Coord.Zoom, i.Coord.X, i.Coord.Y, i.BlobPNG, i.renderTime().Unix()); nil != err {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetLayerStats gets tile count, size and age per zoom level of layer.
+func (self *TileDbSqlite3) GetLayerStats(lyr string) (LayerStats, error) {
+	metadata, err := self.MetaDataHandler(lyr)
+	if nil != err {
+		return LayerStats{}, err
+	}
+
+	var zooms []ZoomStats
+	queryString := `
+		SELECT zoom_level, COUNT(*), SUM(LENGTH(tile_data)), MIN(updated_at), MAX(updated_at)
+		FROM tiles
+		JOIN layers ON tiles.layer_id = layers.rowid
+		WHERE layers.layer_name=?
+		GROUP BY zoom_level
+		ORDER BY zoom_level
+		`
+	rows, err := self.db.Query(queryString, lyr)
+	if nil != err {
+		return LayerStats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var zoom ZoomStats
+		var oldest, newest int64
+		if err := rows.Scan(&zoom.Zoom, &zoom.Tiles, &zoom.Bytes, &oldest, &newest); nil != err {
+			return LayerStats{}, err
+		}
+		oldestTime, newestTime := time.Unix(oldest, 0).UTC(), time.Unix(newest, 0).UTC()
+		zoom.Oldest, zoom.Newest = &oldestTime, &newestTime
+		zooms = append(zooms, zoom)
+	}
+	if err := rows.Err(); nil != err {
+		return LayerStats{}, err
+	}
+
+	return newLayerStats(metadata, zooms, self.tileCounter(lyr))
+}
+
+// tileCounter counts cached tiles of layer within a tile range.
+func (self *TileDbSqlite3) tileCounter(lyr string) tileCounter {
+	return func(zoom, x0, y0, x1, y1 uint64) (int64, error) {
+		var count int64
+		queryString := `
+			SELECT COUNT(*)
+			FROM tiles
+			JOIN layers ON tiles.layer_id = layers.rowid
+			WHERE layers.layer_name=?
+				AND zoom_level=?
+				AND tile_column BETWEEN ? AND ?
+				AND tile_row BETWEEN ? AND ?
+			`
+		err := self.db.QueryRow(queryString, lyr, zoom, x0, x1, y0, y1).Scan(&count)
+		return count, err
+	}
+}
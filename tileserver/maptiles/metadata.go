@@ -0,0 +1,123 @@
+package maptiles
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LayerMetadata MBTiles metadata for a tile layer.
+// Stored as name/value rows in the metadata table of the tile cache.
+type LayerMetadata struct {
+	Name        string     `json:"name"`
+	Source      string     `json:"source"`
+	Type        string     `json:"type"`
+	Version     string     `json:"version"`
+	Format      string     `json:"format"`
+	Bounds      [4]float64 `json:"bounds"`
+	Center      [3]float64 `json:"center"`
+	MinZoom     int        `json:"minzoom"`
+	MaxZoom     int        `json:"maxzoom"`
+	Attribution string     `json:"attribution"`
+	Description string     `json:"description"`
+}
+
+// NewLayerMetadata creates LayerMetadata with default values.
+func NewLayerMetadata(name string, source string) LayerMetadata {
+	return LayerMetadata{
+		Name:        name,
+		Source:      source,
+		Type:        "overlay",
+		Version:     "1",
+		Format:      "png",
+		Bounds:      [4]float64{-180, -85, 180, 85},
+		Center:      [3]float64{0, 0, 2},
+		MinZoom:     0,
+		MaxZoom:     20,
+		Attribution: "sjsafranek",
+		Description: "Compatible with MBTiles spec 1.2.",
+	}
+}
+
+// rows formats metadata as name/value pairs for the metadata table.
+func (self LayerMetadata) rows() [][2]string {
+	return [][2]string{
+		{"name", self.Name},
+		{"source", self.Source},
+		{"type", self.Type},
+		{"version", self.Version},
+		{"description", self.Description},
+		{"format", self.Format},
+		{"bounds", joinFloats(self.Bounds[:])},
+		{"center", joinFloats(self.Center[:])},
+		{"minzoom", strconv.Itoa(self.MinZoom)},
+		{"maxzoom", strconv.Itoa(self.MaxZoom)},
+		{"attribution", self.Attribution},
+	}
+}
+
+// parseLayerMetadata builds LayerMetadata from metadata table rows.
+// Rows missing from older databases keep their default values.
+func parseLayerMetadata(lyr string, rows map[string]string) LayerMetadata {
+	metadata := NewLayerMetadata(lyr, rows["source"])
+	for name, value := range rows {
+		switch name {
+		case "name":
+			metadata.Name = value
+		case "type":
+			metadata.Type = value
+		case "version":
+			metadata.Version = value
+		case "description":
+			metadata.Description = value
+		case "format":
+			metadata.Format = value
+		case "attribution":
+			metadata.Attribution = value
+		case "bounds":
+			if err := splitFloats(value, metadata.Bounds[:]); nil != err {
+				Ligneous.Warn("Invalid bounds for ", lyr, ": ", err)
+			}
+		case "center":
+			if err := splitFloats(value, metadata.Center[:]); nil != err {
+				Ligneous.Warn("Invalid center for ", lyr, ": ", err)
+			}
+		case "minzoom":
+			if z, err := strconv.Atoi(value); nil == err {
+				metadata.MinZoom = z
+			}
+		case "maxzoom":
+			if z, err := strconv.Atoi(value); nil == err {
+				metadata.MaxZoom = z
+			}
+		}
+	}
+	return metadata
+}
+
+// joinFloats formats floats as a comma separated list.
+func joinFloats(values []float64) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitFloats parses a comma separated list into values.
+func splitFloats(value string, values []float64) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != len(values) {
+		return fmt.Errorf("expected %v values, got %v", len(values), len(parts))
+	}
+	parsed := make([]float64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if nil != err {
+			return err
+		}
+		parsed[i] = v
+	}
+	copy(values, parsed)
+	return nil
+}
@@ -0,0 +1,198 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// CacheMigration copies tile layers, metadata, tiles and UTFGrids between
+// tile caches, e.g. from a TileDbSqlite3 cache to a TileDbPostgresql cache
+// or vice versa. Tiles, then grids, are streamed in batches. When StateFile is set the position of the
+// last copied batch is saved there, so an interrupted migration resumes
+// where it stopped.
+type CacheMigration struct {
+	Src       TileDb
+	Dst       TileDb
+	Layers    []string
+	BatchSize int
+	StateFile string
+}
+
+// MigrationState resume point of a cache migration.
+// Grids is set once the tiles of Layer are copied and its grids are next.
+type MigrationState struct {
+	Done   []string `json:"done"`
+	Layer  string   `json:"layer"`
+	Grids  bool     `json:"grids"`
+	Zoom   int64    `json:"zoom"`
+	Column int64    `json:"column"`
+	Row    int64    `json:"row"`
+	Copied int64    `json:"copied"`
+}
+
+// Run copies all layers. Layers listed in Layers are copied, or every
+// layer of the source cache when Layers is empty.
+func (self *CacheMigration) Run() error {
+	if 0 >= self.BatchSize {
+		self.BatchSize = 500
+	}
+
+	state, err := self.readState()
+	if nil != err {
+		return err
+	}
+
+	layers, err := self.Src.GetTileLayers()
+	if nil != err {
+		return err
+	}
+
+	names := self.Layers
+	if 0 == len(names) {
+		for name := range layers {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metadata, ok := layers[name]
+		if !ok {
+			return fmt.Errorf("Tile layer not found: %v", name)
+		}
+		if state.isDone(name) {
+			Ligneous.Info("Skipping migrated tilelayer: ", name)
+			continue
+		}
+		if err := self.migrateLayer(metadata, state); nil != err {
+			return err
+		}
+	}
+
+	Ligneous.Info(fmt.Sprintf("Migration complete, %v layers", len(names)))
+	return nil
+}
+
+// migrateLayer copies metadata, tiles and grids of a single layer.
+func (self *CacheMigration) migrateLayer(metadata LayerMetadata, state *MigrationState) error {
+	lyr := metadata.Name
+
+	if state.Layer != lyr {
+		state.Layer = lyr
+		state.Grids = false
+		state.Zoom, state.Column, state.Row = -1, -1, -1
+		state.Copied = 0
+	}
+
+	total, err := self.Src.CountTiles(lyr)
+	if nil != err {
+		return err
+	}
+
+	Ligneous.Info(fmt.Sprintf("Migrating tilelayer %v, %v tiles", lyr, total))
+
+	if err := self.Dst.AddLayerMetadata(metadata); nil != err {
+		return err
+	}
+
+	if !state.Grids {
+		if err := self.copyTiles(lyr, false, total, state); nil != err {
+			return err
+		}
+		state.Grids = true
+		state.Zoom, state.Column, state.Row = -1, -1, -1
+		state.Copied = 0
+		if err := self.writeState(state); nil != err {
+			return err
+		}
+	}
+	if err := self.copyTiles(lyr, true, 0, state); nil != err {
+		return err
+	}
+
+	state.Done = append(state.Done, lyr)
+	state.Layer = ""
+	state.Grids = false
+	return self.writeState(state)
+}
+
+// copyTiles copies tiles, or grids, of layer in batches from the
+// position of state on. Total is only used for progress messages.
+func (self *CacheMigration) copyTiles(lyr string, grids bool, total int64, state *MigrationState) error {
+	for {
+		tiles, err := self.Src.ReadTiles(lyr, grids, state.Zoom, state.Column, state.Row, self.BatchSize)
+		if nil != err {
+			return err
+		}
+		if 0 == len(tiles) {
+			return nil
+		}
+
+		if err := self.Dst.WriteTiles(tiles); nil != err {
+			return err
+		}
+
+		last := tiles[len(tiles)-1].Coord
+		state.Zoom, state.Column, state.Row = int64(last.Zoom), int64(last.X), int64(last.Y)
+		state.Copied += int64(len(tiles))
+		if err := self.writeState(state); nil != err {
+			return err
+		}
+
+		if grids {
+			Ligneous.Info(fmt.Sprintf("Migrated %v grids of %v (zoom %v)", state.Copied, lyr, last.Zoom))
+		} else {
+			Ligneous.Info(fmt.Sprintf("Migrated %v/%v tiles of %v (zoom %v)", state.Copied, total, lyr, last.Zoom))
+		}
+	}
+}
+
+// readState reads resume point from StateFile.
+func (self *CacheMigration) readState() (*MigrationState, error) {
+	state := &MigrationState{}
+	if "" == self.StateFile {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(self.StateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if nil != err {
+		return state, err
+	}
+	err = json.Unmarshal(data, state)
+	if nil == err && "" != state.Layer {
+		Ligneous.Info(fmt.Sprintf("Resuming migration of %v after %v tiles", state.Layer, state.Copied))
+	}
+	return state, err
+}
+
+// writeState saves resume point to StateFile.
+func (self *CacheMigration) writeState(state *MigrationState) error {
+	if "" == self.StateFile {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if nil != err {
+		return err
+	}
+	// write and rename, so an interrupted write never corrupts the resume point
+	tmp := self.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); nil != err {
+		return err
+	}
+	return os.Rename(tmp, self.StateFile)
+}
+
+// isDone checks if layer has been migrated.
+func (self *MigrationState) isDone(lyr string) bool {
+	for _, name := range self.Done {
+		if name == lyr {
+			return true
+		}
+	}
+	return false
+}
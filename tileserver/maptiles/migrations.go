@@ -0,0 +1,61 @@
+package maptiles
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaMigration upgrades a tile cache database by one schema version.
+type schemaMigration struct {
+	Version     int
+	Description string
+	Queries     []string
+}
+
+// migrateSchema applies pending schema migrations in order.
+// Applied versions are recorded in the schema_version table with
+// insertVersion, which binds version and description in the placeholder
+// syntax of the database driver. Databases created by older releases are
+// upgraded in place. Each migration runs in its own transaction.
+func migrateSchema(db *sql.DB, migrations []schemaMigration, insertVersion string) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY NOT NULL, description TEXT)")
+	if nil != err {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	if nil != err {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		Ligneous.Info(fmt.Sprintf("Migrating schema to version %v: %v", migration.Version, migration.Description))
+
+		tx, err := db.Begin()
+		if nil != err {
+			return err
+		}
+		for _, query := range migration.Queries {
+			if _, err := tx.Exec(query); nil != err {
+				Ligneous.Debug(query, "\n")
+				tx.Rollback()
+				return fmt.Errorf("schema migration %v failed: %v", migration.Version, err)
+			}
+		}
+		if _, err := tx.Exec(insertVersion, migration.Version, migration.Description); nil != err {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); nil != err {
+			return err
+		}
+		current = migration.Version
+	}
+
+	return nil
+}
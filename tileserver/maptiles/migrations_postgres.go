@@ -0,0 +1,85 @@
+package maptiles
+
+// postgresInsertVersion records an applied schema version.
+const postgresInsertVersion = "INSERT INTO schema_version(version, description) VALUES($1, $2)"
+
+// postgresMigrations lists the schema versions of the PostgreSQL tile cache.
+var postgresMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "layers, metadata and tiles tables",
+		Queries: []string{
+			// Table: layers
+			"CREATE TABLE IF NOT EXISTS layers (layer_name TEXT PRIMARY KEY NOT NULL, rowid SERIAL);",
+			"COMMENT ON TABLE layers IS 'Names of tile layers';",
+			"COMMENT ON COLUMN layers.layer_name IS 'Tile layer name';",
+			"COMMENT ON COLUMN layers.rowid IS 'Tile layer index';",
+
+			// Table: metadata
+			"CREATE TABLE IF NOT EXISTS metadata (name TEXT NOT NULL, value TEXT NOT NULL, layer_name TEXT NOT NULL);",
+			"COMMENT ON TABLE metadata IS 'Metadata for tile server layers';",
+			"COMMENT ON COLUMN metadata.name IS 'metadata map name';",
+			"COMMENT ON COLUMN metadata.value IS 'metadata map value';",
+			"COMMENT ON COLUMN metadata.layer_name IS 'metadata map layer_name';",
+
+			// Table: tiles
+			"CREATE TABLE IF NOT EXISTS tiles (layer_id INTEGER, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BYTEA);",
+			"COMMENT ON TABLE tiles IS 'Cached png map tiles';",
+			"COMMENT ON COLUMN tiles.layer_id IS 'layer id for table join';",
+			"COMMENT ON COLUMN tiles.zoom_level IS 'png tile zoom';",
+			"COMMENT ON COLUMN tiles.tile_column IS 'png tile column';",
+			"COMMENT ON COLUMN tiles.tile_row IS 'png tile row';",
+			"COMMENT ON COLUMN tiles.tile_data IS 'png tile data';",
+		},
+	},
+	{
+		Version:     2,
+		Description: "tiles primary key",
+		Queries: []string{
+			// Databases created before this migration may hold duplicate tiles.
+			// Tiles have no write time yet, ctid only tells rows apart, so an
+			// arbitrary one of the duplicates is kept.
+			`DELETE FROM tiles a
+				USING tiles b
+				WHERE a.ctid < b.ctid
+					AND a.layer_id = b.layer_id
+					AND a.zoom_level = b.zoom_level
+					AND a.tile_column = b.tile_column
+					AND a.tile_row = b.tile_row;`,
+			"DELETE FROM tiles WHERE layer_id IS NULL OR zoom_level IS NULL OR tile_column IS NULL OR tile_row IS NULL;",
+			"ALTER TABLE tiles ADD CONSTRAINT tiles_pkey PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row);",
+		},
+	},
+	{
+		Version:     3,
+		Description: "metadata unique index",
+		Queries: []string{
+			// keeps an arbitrary one of duplicate metadata rows, like above
+			`DELETE FROM metadata a
+				USING metadata b
+				WHERE a.ctid < b.ctid
+					AND a.layer_name = b.layer_name
+					AND a.name = b.name;`,
+			"CREATE UNIQUE INDEX IF NOT EXISTS metadata_layer_name_idx ON metadata (layer_name, name);",
+		},
+	},
+	{
+		Version:     4,
+		Description: "tiles updated_at",
+		Queries: []string{
+			"ALTER TABLE tiles ADD COLUMN updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();",
+			"COMMENT ON COLUMN tiles.updated_at IS 'png tile render time';",
+		},
+	},
+	{
+		Version:     5,
+		Description: "grids table",
+		Queries: []string{
+			"CREATE TABLE IF NOT EXISTS grids (layer_id INTEGER, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BYTEA, updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(), PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row));",
+			"COMMENT ON TABLE grids IS 'Cached UTFGrid json of map tiles';",
+			"COMMENT ON COLUMN grids.layer_id IS 'layer id for table join';",
+			"COMMENT ON COLUMN grids.tile_data IS 'UTFGrid json';",
+			"COMMENT ON COLUMN grids.updated_at IS 'UTFGrid render time';",
+		},
+	},
+}
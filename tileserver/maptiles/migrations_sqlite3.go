@@ -0,0 +1,34 @@
+package maptiles
+
+// sqliteInsertVersion records an applied schema version.
+const sqliteInsertVersion = "INSERT INTO schema_version(version, description) VALUES(?, ?)"
+
+// sqliteMigrations lists the schema versions of the SQLite3 tile cache.
+var sqliteMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "layers, metadata and tiles tables",
+		Queries: []string{
+			"CREATE TABLE IF NOT EXISTS layers(layer_name TEXT PRIMARY KEY NOT NULL)",
+			"CREATE TABLE IF NOT EXISTS metadata (name TEXT NOT NULL, value TEXT NOT NULL, layer_name TEXT NOT NULL)",
+			"CREATE TABLE IF NOT EXISTS tiles (layer_id INTEGER, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data blob, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row))",
+		},
+	},
+	{
+		Version:     2,
+		Description: "tiles updated_at",
+		Queries: []string{
+			// SQLite only allows constant defaults when adding a column,
+			// so existing tiles are stamped with the migration time.
+			"ALTER TABLE tiles ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0",
+			"UPDATE tiles SET updated_at = CAST(strftime('%s', 'now') AS INTEGER)",
+		},
+	},
+	{
+		Version:     3,
+		Description: "grids table",
+		Queries: []string{
+			"CREATE TABLE IF NOT EXISTS grids (layer_id INTEGER, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data blob, updated_at INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row))",
+		},
+	},
+}
@@ -1,5 +1,9 @@
 package maptiles
 
+import (
+	"fmt"
+)
+
 type ApiRequest struct {
 	Method string        `json:"method"`
 	Data   ApiReqestData `json:"data"`
@@ -9,3 +13,8 @@ type ApiReqestData struct {
 	TileLayerSource string `json:"source"`
 	TileLayerName   string `json:"name"`
 }
+
+// redacted formats request for logs, without the password of the source.
+func (self ApiRequest) redacted() string {
+	return fmt.Sprintf("%v %v %v", self.Method, self.Data.TileLayerName, RedactPassword(self.Data.TileLayerSource, ""))
+}
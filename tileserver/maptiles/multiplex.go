@@ -1,14 +1,121 @@
 package maptiles
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrLayerNotFound is returned for requests on unknown tile layers.
+var ErrLayerNotFound = errors.New("Tile layer not found")
+
+// ErrMultiplexClosed is returned for layers added after Close.
+var ErrMultiplexClosed = errors.New("Layer multiplex closed")
+
+// layerSource request channel, config, vector layer names and mapnik
+// maps of a tile layer.
+// Closing the channel stops the renderer goroutines reading from it.
+// Requests are sent without holding the lock, senders counts the
+// submits sending on the channel so it is only closed once they are
+// done, done releases submits blocked on a stopped source.
+type layerSource struct {
+	lock         sync.RWMutex
+	config       LayerConfig
+	vectorLayers []string
+	maps         *MapPool
+	fetchChan    chan<- TileFetchRequest
+	done         chan struct{}
+	stopped      bool
+	senders      sync.WaitGroup
+	requests     sync.WaitGroup
+}
+
+// newLayerSource creates layerSource struct.
+func newLayerSource(config LayerConfig, vectorLayers []string, fetchChan chan<- TileFetchRequest) *layerSource {
+	source := &layerSource{config: config, vectorLayers: vectorLayers, fetchChan: fetchChan, done: make(chan struct{})}
+	if config.IsStylesheet() {
+		source.maps = newMapPool(config)
+	}
+	return source
+}
+
+// layerVectorNames returns names of the layers of vector tile layers
+// for TileJSON, the stylesheet is only loaded for vector tile layers.
+func layerVectorNames(config LayerConfig) []string {
+	if !config.IsVector() {
+		return nil
+	}
+	names, err := vectorLayerNames(config)
+	if nil != err {
+		Ligneous.Error(err)
+	}
+	return names
+}
+
+// submit sends tile request to the layer source.
+// Returns false if the source has been stopped. An accepted request
+// is pending until release is called.
+func (s *layerSource) submit(r TileFetchRequest) (release func(), ok bool) {
+	s.lock.RLock()
+	if s.stopped {
+		s.lock.RUnlock()
+		return nil, false
+	}
+	s.senders.Add(1)
+	s.requests.Add(1)
+	s.lock.RUnlock()
+	defer s.senders.Done()
+
+	select {
+	case s.fetchChan <- r:
+		return s.requests.Done, true
+	case <-s.done:
+		s.requests.Done()
+		return nil, false
+	}
+}
+
+// stop closes the request channel once pending submits are done.
+// Requests already accepted are still rendered.
+func (s *layerSource) stop() {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.done)
+	s.lock.Unlock()
+
+	s.senders.Wait()
+	close(s.fetchChan)
+	if nil != s.maps {
+		s.maps.Close()
+	}
+}
+
+// wait blocks until the requests accepted by a stopped source
+// are released.
+func (s *layerSource) wait() {
+	s.requests.Wait()
+}
+
 // LayerMultiplex manages channels for tile requests.
+// Safe for concurrent use. The multiplex owns the channels of its
+// layers and closes them when a layer is removed or replaced, which
+// stops renderers created by NewTileRendererChan.
 type LayerMultiplex struct {
-	layerChans map[string]chan<- TileFetchRequest
+	lock       sync.RWMutex
+	layerChans map[string]*layerSource
+	renderers  sync.WaitGroup
+	closed     bool
 }
 
 // NewLayerMultiplex creates LayerMultiplex struct.
 func NewLayerMultiplex() *LayerMultiplex {
 	l := LayerMultiplex{}
-	l.layerChans = make(map[string]chan<- TileFetchRequest)
+	l.layerChans = make(map[string]*layerSource)
 	return &l
 }
 
@@ -23,22 +130,211 @@ func DefaultRenderMultiplex(defaultStylesheet string) *LayerMultiplex {
 */
 
 // AddRenderer addes render for tile layer.
-func (l *LayerMultiplex) AddRenderer(name string, stylesheet string) {
-	l.layerChans[name] = NewTileRendererChan(stylesheet)
+// The renderer is only started if the layer does not exist yet.
+func (l *LayerMultiplex) AddRenderer(name string, config LayerConfig) error {
+	if l.HasLayer(name) {
+		return fmt.Errorf("Tile layer already exists: %v", name)
+	}
+	return l.addSource(name, config, layerVectorNames(config), func() chan<- TileFetchRequest {
+		return newLayerRendererChan(config, &l.renderers)
+	})
 }
 
 // AddSource manages tile requests.
-func (l *LayerMultiplex) AddSource(name string, fetchChan chan<- TileFetchRequest) {
-	l.layerChans[name] = fetchChan
+// Fails if the layer already exists, in which case fetchChan is closed.
+func (l *LayerMultiplex) AddSource(name string, config LayerConfig, fetchChan chan<- TileFetchRequest) error {
+	err := l.addSource(name, config, nil, func() chan<- TileFetchRequest {
+		return fetchChan
+	})
+	if nil != err {
+		close(fetchChan)
+	}
+	return err
+}
+
+// addSource adds tile layer with the request channel created by
+// newChan. The name is checked under the lock, so newChan is only
+// called for new layers.
+func (l *LayerMultiplex) addSource(name string, config LayerConfig, vectorLayers []string, newChan func() chan<- TileFetchRequest) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrMultiplexClosed
+	}
+	if _, ok := l.layerChans[name]; ok {
+		return fmt.Errorf("Tile layer already exists: %v", name)
+	}
+	l.layerChans[name] = newLayerSource(config, vectorLayers, newChan())
+	return nil
+}
+
+// ReplaceRenderer swaps the renderer of a tile layer.
+// The new renderer is set up before the swap, so requests never
+// see a layer without renderer. The old renderer finishes requests
+// already submitted to it and is stopped.
+func (l *LayerMultiplex) ReplaceRenderer(name string, config LayerConfig) error {
+	if !l.HasLayer(name) {
+		return ErrLayerNotFound
+	}
+	return l.replaceSource(name, config, layerVectorNames(config), func() chan<- TileFetchRequest {
+		return newLayerRendererChan(config, &l.renderers)
+	})
+}
+
+// ReplaceSource swaps the request channel and config of a tile layer.
+// Fails if the layer does not exist, in which case fetchChan is closed.
+func (l *LayerMultiplex) ReplaceSource(name string, config LayerConfig, fetchChan chan<- TileFetchRequest) error {
+	err := l.replaceSource(name, config, nil, func() chan<- TileFetchRequest {
+		return fetchChan
+	})
+	if nil != err {
+		close(fetchChan)
+	}
+	return err
+}
+
+// replaceSource swaps the request channel of a tile layer for the one
+// created by newChan. Returns once the requests accepted by the old
+// channel are released, so their results are handled.
+func (l *LayerMultiplex) replaceSource(name string, config LayerConfig, vectorLayers []string, newChan func() chan<- TileFetchRequest) error {
+	l.lock.Lock()
+	old, ok := l.layerChans[name]
+	if ok {
+		l.layerChans[name] = newLayerSource(config, vectorLayers, newChan())
+	}
+	l.lock.Unlock()
+	if !ok {
+		return ErrLayerNotFound
+	}
+	old.stop()
+	old.wait()
+	return nil
+}
+
+// RemoveLayer removes tile layer and stops its renderer.
+// Returns once the requests accepted by the layer are released.
+func (l *LayerMultiplex) RemoveLayer(name string) error {
+	l.lock.Lock()
+	source, ok := l.layerChans[name]
+	delete(l.layerChans, name)
+	l.lock.Unlock()
+	if !ok {
+		return ErrLayerNotFound
+	}
+	source.stop()
+	source.wait()
+	return nil
+}
+
+// Close removes all tile layers and stops their renderers.
+// Blocks until renderers added with AddRenderer and ReplaceRenderer
+// have finished their requests and freed their mapnik maps.
+// Layers can not be added after Close.
+func (l *LayerMultiplex) Close() {
+	l.lock.Lock()
+	sources := l.layerChans
+	l.layerChans = make(map[string]*layerSource)
+	l.closed = true
+	l.lock.Unlock()
+	for _, source := range sources {
+		source.stop()
+	}
+	for _, source := range sources {
+		source.wait()
+	}
+	l.renderers.Wait()
+}
+
+// HasLayer checks if tile layer exists.
+func (l *LayerMultiplex) HasLayer(name string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.layerChans[name]
+	return ok
+}
+
+// LayerConfig returns config of tile layer.
+func (l *LayerMultiplex) LayerConfig(name string) (LayerConfig, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	source, ok := l.layerChans[name]
+	if !ok {
+		return LayerConfig{}, false
+	}
+	return source.config, true
+}
+
+// VectorLayers returns names of the layers of a vector tile layer,
+// loaded once when the renderer is added or replaced.
+func (l *LayerMultiplex) VectorLayers(name string) ([]string, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	source, ok := l.layerChans[name]
+	if !ok {
+		return nil, false
+	}
+	return source.vectorLayers, true
+}
+
+// MapPool returns the pool of loaded mapnik maps of a stylesheet layer.
+func (l *LayerMultiplex) MapPool(name string) (*MapPool, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	source, ok := l.layerChans[name]
+	if !ok || nil == source.maps {
+		return nil, false
+	}
+	return source.maps, true
+}
+
+// LayerConfigs returns configs of all tile layers.
+func (l *LayerMultiplex) LayerConfigs() map[string]LayerConfig {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	configs := make(map[string]LayerConfig)
+	for name, source := range l.layerChans {
+		configs[name] = source.config
+	}
+	return configs
+}
+
+// Layers returns sorted names of tile layers.
+func (l *LayerMultiplex) Layers() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	layers := make([]string, 0, len(l.layerChans))
+	for k := range l.layerChans {
+		layers = append(layers, k)
+	}
+	sort.Strings(layers)
+	return layers
 }
 
 // SubmitRequest submits tile request.
-func (l LayerMultiplex) SubmitRequest(r TileFetchRequest) bool {
-	c, ok := l.layerChans[r.Coord.Layer]
+// A request racing with ReplaceRenderer is resubmitted to the new renderer.
+func (l *LayerMultiplex) SubmitRequest(r TileFetchRequest) bool {
+	release, ok := l.submitRequest(r)
 	if ok {
-		c <- r
-	} else {
-		Ligneous.Warn("No such layer ", r.Coord.Layer)
+		release()
 	}
 	return ok
 }
+
+// submitRequest submits tile request. The request is pending until
+// release is called, ReplaceRenderer and RemoveLayer wait for pending
+// requests of the old renderer, so callers caching the result release
+// it once the result is queued for insert.
+func (l *LayerMultiplex) submitRequest(r TileFetchRequest) (release func(), ok bool) {
+	for {
+		l.lock.RLock()
+		source, ok := l.layerChans[r.Coord.Layer]
+		l.lock.RUnlock()
+		if !ok {
+			Ligneous.Warn("No such layer ", r.Coord.Layer)
+			return nil, false
+		}
+		if release, ok := source.submit(r); ok {
+			return release, true
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package maptiles
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRenderer starts a fake renderer answering requests with its
+// name until its channel is closed. Taken requests are reported on
+// taken and wait for gate, if given. wg is done once the renderer
+// has stopped.
+func newTestRenderer(name string, taken chan<- TileCoord, gate <-chan struct{}, wg *sync.WaitGroup) chan TileFetchRequest {
+	c := make(chan TileFetchRequest)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for request := range c {
+			if nil != taken {
+				taken <- request.Coord
+			}
+			if nil != gate {
+				<-gate
+			}
+			request.OutChan <- TileFetchResult{Coord: request.Coord, BlobPNG: []byte(name)}
+		}
+	}()
+	return c
+}
+
+// waitTimeout waits for wg and fails the test after a timeout.
+func waitTimeout(t *testing.T, wg *sync.WaitGroup, what string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for %v", what)
+	}
+}
+
+func TestLayerMultiplexConcurrent(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	var renderers, workers sync.WaitGroup
+	layers := []string{"a", "b", "c"}
+	for _, lyr := range layers {
+		if err := lmp.AddSource(lyr, LayerConfig{}, newTestRenderer(lyr, nil, nil, &renderers)); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		workers.Add(4)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < 50; j++ {
+				lyr := layers[(i+j)%len(layers)]
+				lmp.AddSource(lyr, LayerConfig{}, newTestRenderer(lyr, nil, nil, &renderers))
+			}
+		}(i)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < 50; j++ {
+				lyr := layers[(i+j)%len(layers)]
+				lmp.ReplaceSource(lyr, LayerConfig{}, newTestRenderer(lyr, nil, nil, &renderers))
+			}
+		}(i)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < 20; j++ {
+				lmp.RemoveLayer(layers[(i+j)%len(layers)])
+			}
+		}(i)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < 200; j++ {
+				lyr := layers[(i+j)%len(layers)]
+				ch := make(chan TileFetchResult, 1)
+				if !lmp.SubmitRequest(TileFetchRequest{TileCoord{Layer: lyr}, ch}) {
+					continue
+				}
+				if result := <-ch; lyr != string(result.BlobPNG) {
+					t.Errorf("Request on %v rendered by %q", lyr, result.BlobPNG)
+				}
+			}
+		}(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	lmp.Close()
+
+	waitTimeout(t, &workers, "workers")
+	// Every channel was closed, either on failure or by the multiplex
+	waitTimeout(t, &renderers, "renderers")
+	if 0 != len(lmp.Layers()) {
+		t.Errorf("Layers after Close: %v", lmp.Layers())
+	}
+}
+
+func TestLayerMultiplexReplaceCompletesRequests(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	var renderers sync.WaitGroup
+	taken := make(chan TileCoord, 1)
+	gate := make(chan struct{})
+	if err := lmp.AddSource("a", LayerConfig{}, newTestRenderer("old", taken, gate, &renderers)); nil != err {
+		t.Fatal(err)
+	}
+
+	ch := make(chan TileFetchResult, 1)
+	release, ok := lmp.submitRequest(TileFetchRequest{TileCoord{Layer: "a"}, ch})
+	if !ok {
+		t.Fatal("Request not submitted")
+	}
+	<-taken
+
+	replaced := make(chan error, 1)
+	go func() {
+		replaced <- lmp.ReplaceSource("a", LayerConfig{}, newTestRenderer("new", nil, nil, &renderers))
+	}()
+	select {
+	case <-replaced:
+		t.Fatal("ReplaceSource returned before the old request was rendered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The request taken by the old renderer still completes
+	close(gate)
+	if result := <-ch; "old" != string(result.BlobPNG) {
+		t.Errorf("In-flight request rendered by %q", result.BlobPNG)
+	}
+	select {
+	case <-replaced:
+		t.Fatal("ReplaceSource returned before the old request was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case err := <-replaced:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for ReplaceSource")
+	}
+
+	if !lmp.SubmitRequest(TileFetchRequest{TileCoord{Layer: "a"}, ch}) {
+		t.Fatal("Request after replace not submitted")
+	}
+	if result := <-ch; "new" != string(result.BlobPNG) {
+		t.Errorf("Request after replace rendered by %q", result.BlobPNG)
+	}
+	lmp.Close()
+	waitTimeout(t, &renderers, "renderers")
+}
+
+func TestLayerMultiplexClosed(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	var renderers sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		lyr := fmt.Sprintf("lyr%v", i)
+		if err := lmp.AddSource(lyr, LayerConfig{}, newTestRenderer(lyr, nil, nil, &renderers)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	lmp.Close()
+	waitTimeout(t, &renderers, "renderers")
+
+	ch := make(chan TileFetchResult, 1)
+	if lmp.SubmitRequest(TileFetchRequest{TileCoord{Layer: "lyr0"}, ch}) {
+		t.Error("Request submitted after Close")
+	}
+	if err := lmp.AddSource("lyr0", LayerConfig{}, newTestRenderer("lyr0", nil, nil, &renderers)); ErrMultiplexClosed != err {
+		t.Errorf("AddSource after Close: %v", err)
+	}
+	if err := lmp.ReplaceSource("lyr0", LayerConfig{}, newTestRenderer("lyr0", nil, nil, &renderers)); ErrLayerNotFound != err {
+		t.Errorf("ReplaceSource after Close: %v", err)
+	}
+	if err := lmp.RemoveLayer("lyr0"); ErrLayerNotFound != err {
+		t.Errorf("RemoveLayer after Close: %v", err)
+	}
+	// Channels of failed adds are closed
+	waitTimeout(t, &renderers, "renderers")
+}
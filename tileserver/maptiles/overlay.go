@@ -0,0 +1,571 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Overlay kinds drawn on static maps.
+const (
+	OverlayMarker = iota
+	OverlayPath
+	OverlayPolygon
+)
+
+// Default overlay styles of the simplestyle spec.
+// https://github.com/mapbox/simplestyle-spec/tree/master/1.1.0
+var (
+	overlayMarkerColor = color.NRGBA{0x7e, 0x7e, 0x7e, 255}
+	overlayStroke      = color.NRGBA{0x55, 0x55, 0x55, 255}
+	overlayFill        = color.NRGBA{0x55, 0x55, 0x55, 153}
+)
+
+// overlayStrokeWidth default stroke width in pixels.
+const overlayStrokeWidth = 2
+
+// overlayMaxStrokeWidth maximum stroke width in pixels.
+const overlayMaxStrokeWidth = 64
+
+// overlayMaxPoints maximum number of marker, path and polygon points
+// of the overlays of a static map.
+const overlayMaxPoints = 2000
+
+// overlayColors named overlay colors.
+var overlayColors = map[string]color.NRGBA{
+	"black":  {0, 0, 0, 255},
+	"white":  {255, 255, 255, 255},
+	"gray":   {128, 128, 128, 255},
+	"red":    {231, 76, 60, 255},
+	"orange": {230, 126, 34, 255},
+	"yellow": {241, 196, 15, 255},
+	"green":  {46, 204, 113, 255},
+	"blue":   {52, 152, 219, 255},
+	"purple": {155, 89, 182, 255},
+}
+
+// MapOverlay marker, path or polygon drawn on a static map. Markers have
+// a point, paths a line and polygons rings of lon, lat coordinates.
+// Symbol is a built-in marker, "pin" or "dot", or the name of a marker icon.
+type MapOverlay struct {
+	Kind   int
+	Points [][2]float64
+	Rings  [][][2]float64
+	Symbol string
+	Color  color.NRGBA
+	Fill   color.NRGBA
+	Width  float64
+}
+
+// newMapOverlay creates overlay with default style.
+func newMapOverlay(kind int) MapOverlay {
+	overlay := MapOverlay{Kind: kind, Symbol: "pin", Color: overlayStroke, Fill: overlayFill, Width: overlayStrokeWidth}
+	if OverlayMarker == kind {
+		overlay.Color = overlayMarkerColor
+	}
+	return overlay
+}
+
+// LoadMarkerIcons loads png marker icons by name.
+func LoadMarkerIcons(paths map[string]string) (map[string]image.Image, error) {
+	icons := make(map[string]image.Image)
+	for name, path := range paths {
+		f, err := os.Open(path)
+		if nil != err {
+			return icons, err
+		}
+		icon, err := png.Decode(f)
+		f.Close()
+		if nil != err {
+			return icons, fmt.Errorf("Invalid marker icon %v: %v", name, err)
+		}
+		icons[name] = icon
+	}
+	return icons, nil
+}
+
+// parseOverlayColor parses color name or hex color RGB, RRGGBB or
+// RRGGBBAA, with or without #.
+func parseOverlayColor(value string) (color.NRGBA, error) {
+	value = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(value, "#"), "0x"))
+	if c, ok := overlayColors[value]; ok {
+		return c, nil
+	}
+	if 3 == len(value) {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if 6 == len(value) {
+		value += "ff"
+	}
+	if 8 != len(value) {
+		return color.NRGBA{}, fmt.Errorf("Invalid color: %v", value)
+	}
+	rgba, err := strconv.ParseUint(value, 16, 32)
+	if nil != err {
+		return color.NRGBA{}, fmt.Errorf("Invalid color: %v", value)
+	}
+	return color.NRGBA{uint8(rgba >> 24), uint8(rgba >> 16), uint8(rgba >> 8), uint8(rgba)}, nil
+}
+
+// parseOverlayParam parses overlay request parameter of style:value
+// and lon,lat parts separated by |, e.g. color:red|width:3|8.5,47.3|8.6,47.4.
+// Each point of a markers parameter is a marker.
+func parseOverlayParam(kind int, value string) ([]MapOverlay, error) {
+	overlay := newMapOverlay(kind)
+	for _, part := range strings.Split(value, "|") {
+		if i := strings.Index(part, ":"); -1 != i {
+			var err error
+			switch name, style := part[:i], part[i+1:]; name {
+			case "color":
+				overlay.Color, err = parseOverlayColor(style)
+			case "fill":
+				overlay.Fill, err = parseOverlayColor(style)
+			case "width":
+				overlay.Width, err = strconv.ParseFloat(style, 64)
+				if nil == err && (overlay.Width < 0 || overlay.Width > overlayMaxStrokeWidth) {
+					err = fmt.Errorf("Invalid width: %v, expecting 0 to %v", style, overlayMaxStrokeWidth)
+				}
+			case "symbol":
+				overlay.Symbol = style
+			default:
+				err = fmt.Errorf("Unknown overlay style: %v", name)
+			}
+			if nil != err {
+				return nil, err
+			}
+			continue
+		}
+		values, err := parseQueryFloats(part, 2)
+		if nil != err {
+			return nil, err
+		}
+		overlay.Points = append(overlay.Points, [2]float64{values[0], values[1]})
+	}
+
+	switch kind {
+	case OverlayMarker:
+		var markers []MapOverlay
+		for _, p := range overlay.Points {
+			marker := overlay
+			marker.Points = [][2]float64{p}
+			markers = append(markers, marker)
+		}
+		return markers, nil
+	case OverlayPath:
+		if 2 > len(overlay.Points) {
+			return nil, errors.New("Paths need at least 2 points")
+		}
+	case OverlayPolygon:
+		if 3 > len(overlay.Points) {
+			return nil, errors.New("Polygons need at least 3 points")
+		}
+		overlay.Rings = [][][2]float64{overlay.Points}
+		overlay.Points = nil
+	}
+	return []MapOverlay{overlay}, nil
+}
+
+// parseOverlayParams parses markers, path and polygon request parameters.
+func parseOverlayParams(params map[string][]string) ([]MapOverlay, error) {
+	var overlays []MapOverlay
+	for _, param := range []struct {
+		name string
+		kind int
+	}{{"polygon", OverlayPolygon}, {"path", OverlayPath}, {"markers", OverlayMarker}} {
+		for _, value := range params[param.name] {
+			parsed, err := parseOverlayParam(param.kind, value)
+			if nil != err {
+				return nil, err
+			}
+			overlays = append(overlays, parsed...)
+		}
+	}
+	return overlays, nil
+}
+
+// geoJSONObject GeoJSON feature collection, feature or geometry.
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONFeature       `json:"features"`
+	Geometry    *geoJSONGeometry       `json:"geometry"`
+	Properties  map[string]interface{} `json:"properties"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+	Geometries  []geoJSONGeometry      `json:"geometries"`
+}
+
+// parseGeoJSONOverlays creates overlays from GeoJSON. Points are markers,
+// lines paths and polygons polygons, styled by simplestyle properties.
+func parseGeoJSONOverlays(data []byte) ([]MapOverlay, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); nil != err {
+		return nil, err
+	}
+	var features []geoJSONFeature
+	switch obj.Type {
+	case "FeatureCollection":
+		features = obj.Features
+	case "Feature":
+		features = []geoJSONFeature{{Geometry: obj.Geometry, Properties: obj.Properties}}
+	case "":
+		return nil, errors.New("GeoJSON without type")
+	default:
+		geometry := geoJSONGeometry{Type: obj.Type, Coordinates: obj.Coordinates, Geometries: obj.Geometries}
+		features = []geoJSONFeature{{Geometry: &geometry}}
+	}
+
+	var overlays []MapOverlay
+	for _, feature := range features {
+		if nil == feature.Geometry {
+			continue
+		}
+		var err error
+		overlays, err = appendGeoJSONOverlays(overlays, *feature.Geometry, feature.Properties)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return overlays, nil
+}
+
+// styleOverlay applies simplestyle properties to overlay.
+func styleOverlay(overlay MapOverlay, properties map[string]interface{}) (MapOverlay, error) {
+	colorProperty := func(name string, c *color.NRGBA) error {
+		if value, ok := properties[name].(string); ok {
+			parsed, err := parseOverlayColor(value)
+			if nil != err {
+				return err
+			}
+			parsed.A = c.A
+			*c = parsed
+		}
+		return nil
+	}
+	opacityProperty := func(name string, c *color.NRGBA) {
+		if value, ok := properties[name].(float64); ok {
+			c.A = uint8(math.Max(0, math.Min(1, value)) * 255)
+		}
+	}
+
+	if OverlayMarker == overlay.Kind {
+		if value, ok := properties["marker-symbol"].(string); ok && "" != value {
+			overlay.Symbol = value
+		}
+		return overlay, colorProperty("marker-color", &overlay.Color)
+	}
+	if err := colorProperty("stroke", &overlay.Color); nil != err {
+		return overlay, err
+	}
+	opacityProperty("stroke-opacity", &overlay.Color)
+	if value, ok := properties["stroke-width"].(float64); ok && value > overlayMaxStrokeWidth {
+		return overlay, fmt.Errorf("Invalid stroke-width: %v, expecting 0 to %v", value, overlayMaxStrokeWidth)
+	} else if ok && value >= 0 {
+		overlay.Width = value
+	}
+	if err := colorProperty("fill", &overlay.Fill); nil != err {
+		return overlay, err
+	}
+	opacityProperty("fill-opacity", &overlay.Fill)
+	return overlay, nil
+}
+
+// appendGeoJSONOverlays appends overlays of geometry.
+func appendGeoJSONOverlays(overlays []MapOverlay, geometry geoJSONGeometry, properties map[string]interface{}) ([]MapOverlay, error) {
+	var points [][][][2]float64
+	kind := OverlayMarker
+	var err error
+	switch geometry.Type {
+	case "Point":
+		var c [2]float64
+		err = json.Unmarshal(geometry.Coordinates, &c)
+		points = [][][][2]float64{{{c}}}
+	case "MultiPoint":
+		var c [][2]float64
+		err = json.Unmarshal(geometry.Coordinates, &c)
+		for _, p := range c {
+			points = append(points, [][][2]float64{{p}})
+		}
+	case "LineString":
+		kind = OverlayPath
+		var c [][2]float64
+		err = json.Unmarshal(geometry.Coordinates, &c)
+		points = [][][][2]float64{{c}}
+	case "MultiLineString":
+		kind = OverlayPath
+		var c [][][2]float64
+		err = json.Unmarshal(geometry.Coordinates, &c)
+		for _, line := range c {
+			points = append(points, [][][2]float64{line})
+		}
+	case "Polygon":
+		kind = OverlayPolygon
+		var c [][][2]float64
+		err = json.Unmarshal(geometry.Coordinates, &c)
+		points = [][][][2]float64{c}
+	case "MultiPolygon":
+		kind = OverlayPolygon
+		err = json.Unmarshal(geometry.Coordinates, &points)
+	case "GeometryCollection":
+		for _, part := range geometry.Geometries {
+			overlays, err = appendGeoJSONOverlays(overlays, part, properties)
+			if nil != err {
+				return nil, err
+			}
+		}
+		return overlays, nil
+	default:
+		return nil, fmt.Errorf("Unsupported geometry type: %v", geometry.Type)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	for _, part := range points {
+		overlay, err := styleOverlay(newMapOverlay(kind), properties)
+		if nil != err {
+			return nil, err
+		}
+		if OverlayPolygon == kind {
+			overlay.Rings = part
+		} else {
+			overlay.Points = part[0]
+		}
+		overlays = append(overlays, overlay)
+	}
+	return overlays, nil
+}
+
+// blendPixel blends color c with coverage into pixel x, y of img.
+func blendPixel(img *image.RGBA, x, y int, c color.NRGBA, coverage float64) {
+	if !image.Pt(x, y).In(img.Rect) {
+		return
+	}
+	a := float64(c.A) / 255 * coverage
+	if a <= 0 {
+		return
+	}
+	i := img.PixOffset(x, y)
+	pix := img.Pix[i : i+4 : i+4]
+	for j, v := range []uint8{c.R, c.G, c.B, 255} {
+		pix[j] = uint8(float64(v)*a + float64(pix[j])*(1-a) + 0.5)
+	}
+}
+
+// fillRings fills rings of pixel coordinates with the even-odd rule.
+func fillRings(img *image.RGBA, rings [][][2]float64, c color.NRGBA) {
+	miny, maxy := math.Inf(1), math.Inf(-1)
+	for _, ring := range rings {
+		for _, p := range ring {
+			miny = math.Min(miny, p[1])
+			maxy = math.Max(maxy, p[1])
+		}
+	}
+	y0 := int(math.Max(math.Floor(miny), float64(img.Rect.Min.Y)))
+	y1 := int(math.Min(math.Ceil(maxy), float64(img.Rect.Max.Y)))
+	for y := y0; y < y1; y++ {
+		cy := float64(y) + 0.5
+		var xs []float64
+		for _, ring := range rings {
+			for i := range ring {
+				a, b := ring[i], ring[(i+1)%len(ring)]
+				if (a[1] <= cy) != (b[1] <= cy) {
+					xs = append(xs, a[0]+(cy-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+				}
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			x0 := int(math.Max(math.Ceil(xs[i]-0.5), float64(img.Rect.Min.X)))
+			x1 := int(math.Min(math.Ceil(xs[i+1]-0.5), float64(img.Rect.Max.X)))
+			for x := x0; x < x1; x++ {
+				blendPixel(img, x, y, c, 1)
+			}
+		}
+	}
+}
+
+// strokeLine draws antialiased line of pixel coordinates. Coverage is
+// collected per pixel first, so joints of translucent lines are not
+// blended twice. Only pixels near each segment are visited, row by row.
+func strokeLine(img *image.RGBA, line [][2]float64, width float64, c color.NRGBA) {
+	if 0 == len(line) || 0 == width {
+		return
+	}
+	half := width / 2
+	coverage := make(map[image.Point]float64)
+	for i := 0; i < len(line); i++ {
+		a, b := line[i], line[i]
+		if i+1 < len(line) {
+			b = line[i+1]
+		} else if 1 < len(line) {
+			break
+		}
+		y0 := int(math.Max(math.Floor(math.Min(a[1], b[1])-half-1), float64(img.Rect.Min.Y)))
+		y1 := int(math.Min(math.Ceil(math.Max(a[1], b[1])+half+1), float64(img.Rect.Max.Y)))
+		for y := y0; y < y1; y++ {
+			x0, x1, ok := segmentRow(a, b, float64(y)+0.5, half+0.5)
+			if !ok {
+				continue
+			}
+			x0 = math.Max(x0, float64(img.Rect.Min.X))
+			x1 = math.Min(x1, float64(img.Rect.Max.X))
+			for x := int(x0); x < int(x1); x++ {
+				d := segmentDistance([2]float64{float64(x) + 0.5, float64(y) + 0.5}, a, b)
+				cover := math.Min(1, half+0.5-d)
+				if p := image.Pt(x, y); cover > coverage[p] {
+					coverage[p] = cover
+				}
+			}
+		}
+	}
+	for p, cover := range coverage {
+		blendPixel(img, p.X, p.Y, c, cover)
+	}
+}
+
+// segmentRow returns the columns x0 to x1, exclusive, of the pixels of
+// the row with center y that are closer than r to segment a, b.
+func segmentRow(a, b [2]float64, y, r float64) (x0, x1 float64, ok bool) {
+	// part of the segment within r of the row
+	t0, t1 := 0.0, 1.0
+	if dy := b[1] - a[1]; 0 != dy {
+		t0, t1 = (y-r-a[1])/dy, (y+r-a[1])/dy
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		t0, t1 = math.Max(t0, 0), math.Min(t1, 1)
+	} else if math.Abs(y-a[1]) >= r {
+		return 0, 0, false
+	}
+	if t0 > t1 {
+		return 0, 0, false
+	}
+	xa, xb := a[0]+t0*(b[0]-a[0]), a[0]+t1*(b[0]-a[0])
+	return math.Floor(math.Min(xa, xb) - r), math.Ceil(math.Max(xa, xb) + r), true
+}
+
+// segmentDistance returns distance of point p to segment a, b.
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; 0 != l {
+		t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
+
+// circle returns polygon approximating circle around center.
+func circle(center [2]float64, radius float64) [][2]float64 {
+	points := make([][2]float64, 32)
+	for i := range points {
+		angle := 2 * math.Pi * float64(i) / float64(len(points))
+		points[i] = [2]float64{center[0] + radius*math.Cos(angle), center[1] + radius*math.Sin(angle)}
+	}
+	return points
+}
+
+// drawMarker draws marker with its tip at pixel p. Icons are anchored
+// at their bottom center.
+func drawMarker(img *image.RGBA, p [2]float64, overlay MapOverlay, icons map[string]image.Image) error {
+	outline := color.NRGBA{0, 0, 0, 160}
+	white := color.NRGBA{255, 255, 255, 255}
+	switch overlay.Symbol {
+	case "dot":
+		dot := circle(p, 6)
+		fillRings(img, [][][2]float64{dot}, overlay.Color)
+		strokeLine(img, append(dot, dot[0]), 2, white)
+	case "pin":
+		// head of the pin above a triangle down to the tip
+		head := [2]float64{p[0], p[1] - 22}
+		body := [][2]float64{{p[0] - 8, head[1] + 4}, {p[0] + 8, head[1] + 4}, p}
+		fillRings(img, [][][2]float64{body}, overlay.Color)
+		fillRings(img, [][][2]float64{circle(head, 10)}, overlay.Color)
+		ring := circle(head, 10.5)
+		strokeLine(img, append(ring, ring[0]), 1, outline)
+		fillRings(img, [][][2]float64{circle(head, 4)}, white)
+	default:
+		icon, ok := icons[overlay.Symbol]
+		if !ok {
+			return fmt.Errorf("Unknown marker symbol: %v", overlay.Symbol)
+		}
+		size := icon.Bounds().Size()
+		at := image.Pt(int(math.Floor(p[0]+0.5))-size.X/2, int(math.Floor(p[1]+0.5))-size.Y)
+		draw.Draw(img, image.Rectangle{at, at.Add(size)}, icon, icon.Bounds().Min, draw.Over)
+	}
+	return nil
+}
+
+// checkMarkerSymbols checks that marker symbols are built-in or icons.
+func checkMarkerSymbols(overlays []MapOverlay, icons map[string]image.Image) error {
+	for _, overlay := range overlays {
+		if _, ok := icons[overlay.Symbol]; OverlayMarker == overlay.Kind && !ok && "pin" != overlay.Symbol && "dot" != overlay.Symbol {
+			return fmt.Errorf("Unknown marker symbol: %v", overlay.Symbol)
+		}
+	}
+	return nil
+}
+
+// checkOverlayPoints checks that overlays have at most overlayMaxPoints
+// points, so drawing them is bounded.
+func checkOverlayPoints(overlays []MapOverlay) error {
+	points := 0
+	for _, overlay := range overlays {
+		points += len(overlay.Points)
+		for _, ring := range overlay.Rings {
+			points += len(ring)
+		}
+		if points > overlayMaxPoints {
+			return fmt.Errorf("Too many overlay points, at most %v are drawn", overlayMaxPoints)
+		}
+	}
+	return nil
+}
+
+// DrawOverlays draws overlays of static map on its image. Polygons are
+// drawn below paths and markers, otherwise overlays keep their order.
+func (self StaticMap) DrawOverlays(img *image.RGBA, icons map[string]image.Image) error {
+	overlays := append([]MapOverlay{}, self.Overlays...)
+	sort.SliceStable(overlays, func(i, j int) bool {
+		return overlays[i].Kind > overlays[j].Kind
+	})
+	pixels := func(points [][2]float64) [][2]float64 {
+		px := make([][2]float64, len(points))
+		for i, p := range points {
+			w := worldPixel(p, self.Zoom, self.TileSize)
+			px[i] = [2]float64{w[0] - self.Origin[0], w[1] - self.Origin[1]}
+		}
+		return px
+	}
+	for _, overlay := range overlays {
+		switch overlay.Kind {
+		case OverlayMarker:
+			for _, p := range pixels(overlay.Points) {
+				if err := drawMarker(img, p, overlay, icons); nil != err {
+					return err
+				}
+			}
+		case OverlayPath:
+			strokeLine(img, pixels(overlay.Points), overlay.Width, overlay.Color)
+		case OverlayPolygon:
+			var rings [][][2]float64
+			for _, ring := range overlay.Rings {
+				rings = append(rings, pixels(ring))
+			}
+			fillRings(img, rings, overlay.Fill)
+			for _, ring := range rings {
+				if 0 != len(ring) {
+					strokeLine(img, append(ring, ring[0]), overlay.Width, overlay.Color)
+				}
+			}
+		}
+	}
+	return nil
+}
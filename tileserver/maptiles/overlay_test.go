@@ -0,0 +1,81 @@
+package maptiles
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestOverlayStrokeWidthLimit(t *testing.T) {
+	for _, test := range []struct {
+		width float64
+		ok    bool
+	}{{0, true}, {3, true}, {64, true}, {65, false}, {-1, false}, {1e9, false}} {
+		_, err := parseOverlayParam(OverlayPath, fmt.Sprintf("width:%v|8.5,47.3|8.6,47.4", test.width))
+		if test.ok != (nil == err) {
+			t.Errorf("path width %v: %v", test.width, err)
+		}
+	}
+	// negative stroke-width properties keep the default width
+	for _, test := range []struct {
+		width float64
+		ok    bool
+	}{{0, true}, {64, true}, {-1, true}, {65, false}, {1e9, false}} {
+		_, err := styleOverlay(newMapOverlay(OverlayPath), map[string]interface{}{"stroke-width": test.width})
+		if test.ok != (nil == err) {
+			t.Errorf("stroke-width %v: %v", test.width, err)
+		}
+	}
+}
+
+func TestCheckOverlayPoints(t *testing.T) {
+	points := strings.Repeat("|8.5,47.3", overlayMaxPoints)
+	overlays, err := parseOverlayParam(OverlayPath, points[1:])
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := checkOverlayPoints(overlays); nil != err {
+		t.Errorf("%v points: %v", overlayMaxPoints, err)
+	}
+	overlays = append(overlays, newMapOverlay(OverlayMarker))
+	overlays[1].Points = [][2]float64{{8.5, 47.3}}
+	if err := checkOverlayPoints(overlays); nil == err {
+		t.Errorf("%v points accepted", overlayMaxPoints+1)
+	}
+}
+
+// TestStrokeLineRows compares the pixels of strokeLine with the pixels
+// within the stroke width of the whole image.
+func TestStrokeLineRows(t *testing.T) {
+	for _, line := range [][][2]float64{
+		{{10.3, 10.7}, {90.2, 60.1}},
+		{{5, 50}, {95, 50}},
+		{{50, 5}, {50, 95}},
+		{{80, 10}, {20, 90}, {90, 90}},
+		{{-50, -20}, {150, 130}},
+		{{40.5, 40.5}},
+	} {
+		for _, width := range []float64{1, 2.5, 9} {
+			img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+			strokeLine(img, line, width, color.NRGBA{255, 0, 0, 255})
+			for y := 0; y < 100; y++ {
+				for x := 0; x < 100; x++ {
+					d := math.Inf(1)
+					for i := range line {
+						b := line[i]
+						if i+1 < len(line) {
+							b = line[i+1]
+						}
+						d = math.Min(d, segmentDistance([2]float64{float64(x) + 0.5, float64(y) + 0.5}, line[i], b))
+					}
+					if want, got := d < width/2+0.5, 0 != img.RGBAAt(x, y).A; want != got {
+						t.Fatalf("line %v width %v: pixel %v,%v drawn %v, want %v", line, width, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
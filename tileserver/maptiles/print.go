@@ -0,0 +1,183 @@
+package maptiles
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "mapnik"
+
+// PrintDefaultDPI resolution of prints without dpi.
+const PrintDefaultDPI = 150
+
+// printMaxDPI maximum resolution of prints.
+const printMaxDPI = 600
+
+// mapnikPixelDPI resolution of the 0.28mm standard rendering pixel,
+// mapnik styles are drawn at scale factor 1 at this resolution.
+const mapnikPixelDPI = 25.4 / 0.28
+
+// paperSizes width and height of portrait paper in millimeters.
+var paperSizes = map[string][2]float64{
+	"a0":      {841, 1189},
+	"a1":      {594, 841},
+	"a2":      {420, 594},
+	"a3":      {297, 420},
+	"a4":      {210, 297},
+	"a5":      {148, 210},
+	"letter":  {215.9, 279.4},
+	"legal":   {215.9, 355.6},
+	"tabloid": {279.4, 431.8},
+}
+
+// printFormats maps print formats to their mime type.
+var printFormats = map[string]string{
+	"pdf": "application/pdf",
+	"svg": "image/svg+xml",
+	"ps":  "application/postscript",
+}
+
+// PrintRequest print of a bounding box, minlon, minlat, maxlon, maxlat,
+// of a mapnik layer on a page of Width x Height millimeters. The whole
+// bounding box is printed, centered on the page.
+type PrintRequest struct {
+	BBox   [4]float64
+	Width  float64
+	Height float64
+	DPI    int
+	Format string
+}
+
+// PixelSize returns the size of the mapnik map of the page.
+func (self PrintRequest) PixelSize() (int, int) {
+	return int(self.Width / 25.4 * float64(self.DPI)), int(self.Height / 25.4 * float64(self.DPI))
+}
+
+// newPrintRequest creates print request from bbox, paper, orientation,
+// dpi and format parameters.
+func newPrintRequest(params map[string][]string) (PrintRequest, error) {
+	req := PrintRequest{DPI: PrintDefaultDPI, Format: "pdf"}
+	get := func(key string) string {
+		if values := params[key]; 0 != len(values) {
+			return values[0]
+		}
+		return ""
+	}
+
+	bbox := get("bbox")
+	if "" == bbox {
+		return req, fmt.Errorf("Missing bbox")
+	}
+	values, err := parseQueryFloats(bbox, 4)
+	if nil != err || values[0] >= values[2] || values[1] >= values[3] {
+		return req, fmt.Errorf("Invalid bbox: %v", bbox)
+	}
+	copy(req.BBox[:], values)
+
+	paper := strings.ToLower(get("paper"))
+	if "" == paper {
+		paper = "a4"
+	}
+	size, ok := paperSizes[paper]
+	if !ok {
+		return req, fmt.Errorf("Unknown paper: %v", paper)
+	}
+	req.Width, req.Height = size[0], size[1]
+	switch get("orientation") {
+	case "", "portrait":
+	case "landscape":
+		req.Width, req.Height = req.Height, req.Width
+	default:
+		return req, fmt.Errorf("orientation must be portrait or landscape")
+	}
+
+	if dpi := get("dpi"); "" != dpi {
+		req.DPI, err = strconv.Atoi(dpi)
+		if nil != err || req.DPI < 72 || req.DPI > printMaxDPI {
+			return req, fmt.Errorf("dpi must be between 72 and %v", printMaxDPI)
+		}
+	}
+
+	if format := get("format"); "" != format {
+		req.Format = format
+	}
+	if _, ok := printFormats[req.Format]; !ok {
+		return req, fmt.Errorf("Unsupported format: %v", req.Format)
+	}
+	return req, nil
+}
+
+// RenderPrint renders print of a mapnik layer with cairo. The map is
+// rendered at the resolution of the print and scaled to the page size,
+// so symbols and labels keep their size in millimeters.
+func RenderPrint(config LayerConfig, req PrintRequest) ([]byte, error) {
+	mapSlots <- struct{}{}
+	defer func() { <-mapSlots }()
+
+	width, height := req.PixelSize()
+	m := mapnik.NewMap(uint32(width), uint32(height))
+	defer m.Free()
+	if err := m.Load(config.Source); nil != err {
+		return nil, err
+	}
+
+	// Project bounds from LatLong(EPSG:4326) to the map projection
+	p := m.Projection()
+	defer p.Free()
+	ll := p.Forward(mapnik.Coord{X: req.BBox[0], Y: req.BBox[1]})
+	ur := p.Forward(mapnik.Coord{X: req.BBox[2], Y: req.BBox[3]})
+	m.SetBufferSize(config.BufferSize)
+	m.ZoomToMinMax(ll.X, ll.Y, ur.X, ur.Y)
+
+	dpi := float64(req.DPI)
+	return m.RenderToVector(req.Format, 72/dpi, dpi/mapnikPixelDPI)
+}
+
+// PrintHandler returns a pdf, svg or ps print of a bounding box
+// of a mapnik layer.
+func PrintHandler(lmp *LayerMultiplex, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	params := r.URL.Query()
+	config, ok := lmp.LayerConfig(params.Get("layer"))
+	if !ok {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if !config.IsStylesheet() {
+		http.Error(w, "layer is not a mapnik stylesheet", http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if !mapnik.HasCairo() {
+		http.Error(w, "mapnik was built without cairo", http.StatusNotImplemented)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [501]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	req, err := newPrintRequest(params)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	blob, err := RenderPrint(config, req)
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	w.Header().Set("Content-Type", printFormats[req.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%v.%v\"", params.Get("layer"), req.Format))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(blob); nil != err {
+		Ligneous.Error(err)
+	}
+	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+}
@@ -0,0 +1,231 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+import "mapnik"
+
+// ErrQueryLayerNotFound is returned for queries of layers
+// missing in the stylesheet of a tile layer.
+var ErrQueryLayerNotFound = errors.New("Query layer not found")
+
+// FeatureCollection GeoJSON features found by a feature query.
+// Features have a layer member with the name of their stylesheet layer.
+type FeatureCollection struct {
+	Type     string                   `json:"type"`
+	Features []map[string]interface{} `json:"features"`
+}
+
+// FeatureQuery query of the features of a mapnik layer. Point queries
+// hit test features at pixel X, Y of a Width x Height map of BBox, box
+// queries return the features intersecting BBox. BBox is given in SRS
+// units, SRS defaults to the projection of the stylesheet.
+type FeatureQuery struct {
+	SRS    string
+	BBox   [4]float64
+	Width  int
+	Height int
+	X, Y   float64
+	Box    bool
+	Layers []string
+	Limit  int
+}
+
+// QueryFeatures returns features of the stylesheet layers of a tile
+// layer, all stylesheet layers are queried if none are given.
+// At most query.Limit features are returned, all if the limit is 0.
+// The query takes a mapnik map of the layer from maps.
+func QueryFeatures(maps *MapPool, query FeatureQuery) (FeatureCollection, error) {
+	result := FeatureCollection{Type: "FeatureCollection", Features: []map[string]interface{}{}}
+
+	mapSlots <- struct{}{}
+	defer func() { <-mapSlots }()
+
+	m, err := maps.Get(query.Width, query.Height)
+	if nil != err {
+		return result, err
+	}
+	defer maps.Put(m)
+	if "" != query.SRS {
+		m.SetSRS(query.SRS)
+	}
+	// pixels map to exactly BBox, whatever its aspect ratio
+	m.SetAspectFixMode(mapnik.Respect)
+	m.ZoomToMinMax(query.BBox[0], query.BBox[1], query.BBox[2], query.BBox[3])
+
+	names := m.LayerNames()
+	layers := query.Layers
+	if 0 == len(layers) {
+		layers = names
+	}
+	for _, layer := range layers {
+		found := false
+		for _, name := range names {
+			found = found || name == layer
+		}
+		if !found {
+			return result, ErrQueryLayerNotFound
+		}
+	}
+
+	for _, layer := range layers {
+		var features []json.RawMessage
+		var err error
+		if query.Box {
+			features, err = m.QueryBox(layer, query.BBox[0], query.BBox[1], query.BBox[2], query.BBox[3])
+		} else {
+			features, err = m.QueryMapPoint(layer, query.X, query.Y)
+		}
+		if nil != err {
+			return result, err
+		}
+		for _, raw := range features {
+			if 0 != query.Limit && len(result.Features) >= query.Limit {
+				return result, nil
+			}
+			var feature map[string]interface{}
+			if err := json.Unmarshal(raw, &feature); nil != err {
+				return result, err
+			}
+			feature["layer"] = layer
+			result.Features = append(result.Features, feature)
+		}
+	}
+	return result, nil
+}
+
+// parseQueryFloats parses comma separated numbers.
+func parseQueryFloats(value string, n int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if n != len(parts) {
+		return nil, fmt.Errorf("Expecting %v comma separated numbers", n)
+	}
+	values := make([]float64, n)
+	for i := range parts {
+		var err error
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if nil != err {
+			return nil, fmt.Errorf("Invalid number: %v", parts[i])
+		}
+	}
+	return values, nil
+}
+
+// newLayerQuery creates feature query of a tile layer from lon, lat and z
+// parameters, or from bbox=minlon,minlat,maxlon,maxlat. Point queries
+// use the hit tolerance of a tile at zoom level z, the max zoom
+// of the layer if z is not given.
+func newLayerQuery(config LayerConfig, params map[string][]string) (FeatureQuery, error) {
+	size := config.TileSize
+	query := FeatureQuery{SRS: wmsMercator, Width: size, Height: size}
+	if layers := params["layers"]; 0 != len(layers) && "" != layers[0] {
+		query.Layers = strings.Split(layers[0], ",")
+	}
+	if limit := params["limit"]; 0 != len(limit) {
+		n, err := strconv.Atoi(limit[0])
+		if nil != err || n < 0 {
+			return query, fmt.Errorf("Invalid limit: %v", limit[0])
+		}
+		query.Limit = n
+	}
+
+	if bbox := params["bbox"]; 0 != len(bbox) {
+		values, err := parseQueryFloats(bbox[0], 4)
+		if nil != err {
+			return query, err
+		}
+		min := fromLLtoMercator([2]float64{values[0], values[1]})
+		max := fromLLtoMercator([2]float64{values[2], values[3]})
+		if min[0] >= max[0] || min[1] >= max[1] {
+			return query, fmt.Errorf("Invalid bbox: %v", bbox[0])
+		}
+		query.BBox = [4]float64{min[0], min[1], max[0], max[1]}
+		query.Box = true
+		return query, nil
+	}
+
+	lon, err := strconv.ParseFloat(strings.Join(params["lon"], ""), 64)
+	if nil != err || lon < -180 || lon > 180 {
+		return query, errors.New("Expecting lon between -180 and 180")
+	}
+	lat, err := strconv.ParseFloat(strings.Join(params["lat"], ""), 64)
+	if nil != err || lat < -90 || lat > 90 {
+		return query, errors.New("Expecting lat between -90 and 90")
+	}
+	zoom := config.MaxZoom
+	if z := params["z"]; 0 != len(z) {
+		zoom, err = strconv.Atoi(z[0])
+		if nil != err || zoom < config.MinZoom || zoom > config.MaxZoom {
+			return query, fmt.Errorf("Expecting z between %v and %v", config.MinZoom, config.MaxZoom)
+		}
+	}
+
+	// map of one tile size centered on the point
+	c := fromLLtoMercator([2]float64{lon, lat})
+	half := float64(size) / 2 * mercatorResolution(zoom, size)
+	query.BBox = [4]float64{c[0] - half, c[1] - half, c[0] + half, c[1] + half}
+	query.X = float64(size) / 2
+	query.Y = float64(size) / 2
+	return query, nil
+}
+
+// QueryLayerHandler returns features of a tile layer at a point
+// or within a bounding box as GeoJSON.
+func QueryLayerHandler(lmp *LayerMultiplex, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lyr := mux.Vars(r)["lyr"]
+	config, ok := lmp.LayerConfig(lyr)
+	if !ok {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if !config.IsStylesheet() {
+		http.Error(w, "layer is not a mapnik stylesheet", http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	maps, ok := lmp.MapPool(lyr)
+	if !ok {
+		// removed or replaced since
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	query, err := newLayerQuery(config, r.URL.Query())
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	features, err := QueryFeatures(maps, query)
+	if ErrQueryLayerNotFound == err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["status"] = "ok"
+	response["data"] = features
+	status := SendJsonResponseFromInterface(w, r, response)
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
@@ -1,11 +1,13 @@
 package maptiles
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,10 +19,12 @@ var ProxyClient = &http.Client{
 }
 
 // TileCoord struct for tile requests.
+// Grid selects the UTFGrid of the tile instead of its image.
 type TileCoord struct {
 	X, Y, Zoom uint64
 	Tms        bool
 	Layer      string
+	Grid       bool
 }
 
 // OSMFilename formats png filename.
@@ -29,9 +33,20 @@ func (c TileCoord) OSMFilename() string {
 }
 
 // TileFetchResult struct for tile result.
+// Modified is the time the tile was rendered.
 type TileFetchResult struct {
-	Coord   TileCoord
-	BlobPNG []byte
+	Coord    TileCoord
+	BlobPNG  []byte
+	Modified time.Time
+}
+
+// renderTime returns Modified, or the current time for results
+// without a render time.
+func (self TileFetchResult) renderTime() time.Time {
+	if self.Modified.IsZero() {
+		return time.Now()
+	}
+	return self.Modified
 }
 
 // TileFetchRequest struct for tile request.
@@ -48,47 +63,107 @@ func (c *TileCoord) setTMS(tms bool) {
 	}
 }
 
-// NewTileRendererChan creates channel for tile rendering
+// mapnikFormats maps tile formats to mapnik image formats.
+var mapnikFormats = map[string]string{
+	"png":  "png256",
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"webp": "webp",
+}
+
+// NewTileRendererChan creates channel for tile rendering.
+// The renderer goroutine runs until the channel is closed and
+// frees its mapnik map on exit.
 func NewTileRendererChan(stylesheet string) chan<- TileFetchRequest {
+	return NewLayerRendererChan(NewLayerConfig(stylesheet))
+}
+
+// NewLayerRendererChan creates channel for tile rendering with the
+// settings of a tile layer. The requests are shared by config.Workers
+// renderer goroutines, each with its own mapnik map.
+func NewLayerRendererChan(config LayerConfig) chan<- TileFetchRequest {
+	return newLayerRendererChan(config, nil)
+}
+
+// newLayerRendererChan creates channel for tile rendering.
+// Renderer goroutines are added to wg, if given, and are done
+// once their mapnik map is freed.
+func newLayerRendererChan(config LayerConfig, wg *sync.WaitGroup) chan<- TileFetchRequest {
 	c := make(chan TileFetchRequest)
 
-	go func(requestChan <-chan TileFetchRequest) {
-		var err error
-		t := NewTileRenderer(stylesheet)
-		for request := range requestChan {
-			result := TileFetchResult{request.Coord, nil}
-			result.BlobPNG, err = t.RenderTile(request.Coord)
-			if err != nil {
-				Ligneous.Error("Error while rendering", request.Coord, ":", err.Error())
-				result.BlobPNG = nil
-			}
-			request.OutChan <- result
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		if nil != wg {
+			wg.Add(1)
 		}
-	}(c)
+		go func(requestChan <-chan TileFetchRequest) {
+			if nil != wg {
+				defer wg.Done()
+			}
+			var err error
+			t := NewLayerRenderer(config)
+			defer t.Close()
+			for request := range requestChan {
+				result := TileFetchResult{Coord: request.Coord, Modified: time.Now()}
+				result.BlobPNG, err = t.RenderTile(request.Coord)
+				if err != nil {
+					Ligneous.Error("Error while rendering", request.Coord, ":", err.Error())
+					result.BlobPNG = nil
+				}
+				request.OutChan <- result
+			}
+			Ligneous.Debug("Stopped renderer ", config.RedactedSource())
+		}(c)
+	}
 
 	return c
 }
 
 // TileRenderer renders images as Web Mercator tiles.
 type TileRenderer struct {
-	m     *mapnik.Map
-	mp    mapnik.Projection
-	proxy bool
-	s     string
+	m             *mapnik.Map
+	mp            mapnik.Projection
+	proxy         bool
+	vector        bool
+	s             string
+	size          int
+	buffer        int
+	format        string
+	headers       map[string]string
+	interactivity *LayerInteractivity
 }
 
 // NewTileRenderer creates TileRenderer struct.
 func NewTileRenderer(stylesheet string) *TileRenderer {
+	return NewLayerRenderer(NewLayerConfig(stylesheet))
+}
+
+// NewLayerRenderer creates TileRenderer struct with the settings
+// of a tile layer.
+func NewLayerRenderer(config LayerConfig) *TileRenderer {
 	t := new(TileRenderer)
-	var err error
-	if err != nil {
-		Ligneous.Critical(err)
+	stylesheet := config.Source
+	t.size = config.TileSize
+	t.buffer = config.BufferSize
+	t.format = mapnikFormats[config.Format]
+	if "" == t.format {
+		t.format = "png256"
+	}
+	t.headers = config.Headers
+	t.interactivity = config.Interactivity
+	t.vector = config.IsVector()
+	t.m = mapnik.NewMap(uint32(t.size), uint32(t.size))
+	if config.IsStylesheet() || config.IsDatasource() {
+		if err := loadLayerMap(t.m, config); nil != err {
+			Ligneous.Error("Error while loading ", stylesheet, ": ", err)
+		}
 	}
-	t.m = mapnik.NewMap(256, 256)
-	t.m.Load(stylesheet)
 	t.mp = t.m.Projection()
 
-	if strings.Contains(stylesheet, ".xml") {
+	if config.IsStylesheet() || config.IsDatasource() {
 		t.proxy = false
 		t.s = stylesheet
 	} else if strings.Contains(stylesheet, "http") && strings.Contains(stylesheet, "{z}/{x}/{y}") {
@@ -102,11 +177,22 @@ func NewTileRenderer(stylesheet string) *TileRenderer {
 	return t
 }
 
-// RenderTile renders map tile.
+// Close frees the mapnik map of the renderer.
+func (t *TileRenderer) Close() {
+	t.mp.Free()
+	t.m.Free()
+}
+
+// RenderTile renders map tile, vector tile or its UTFGrid.
 func (t *TileRenderer) RenderTile(c TileCoord) ([]byte, error) {
 	c.setTMS(false)
+	if c.Grid {
+		return t.RenderGridZXY(c.Zoom, c.X, c.Y)
+	}
 	if t.proxy {
 		return t.HttpGetTileZXY(c.Zoom, c.X, c.Y)
+	} else if t.vector {
+		return t.RenderVectorZXY(c.Zoom, c.X, c.Y)
 	} else {
 		return t.RenderTileZXY(c.Zoom, c.X, c.Y)
 	}
@@ -119,6 +205,57 @@ func (t *TileRenderer) RenderTile(c TileCoord) ([]byte, error) {
 // threads or setup multiple goroutinesand communicate with channels,
 // see NewTileRendererChan.
 func (t *TileRenderer) RenderTileZXY(zoom, x, y uint64) ([]byte, error) {
+	t.zoomToTile(zoom, x, y)
+
+	blob, err := t.m.RenderToMemory(t.format)
+
+	Ligneous.Trace(fmt.Sprintf("RENDER BLOB %v %v %v %v", t.s, zoom, x, y))
+
+	return blob, err
+}
+
+// RenderGridZXY renders UTFGrid json of a map tile.
+// Same as RenderTileZXY, the method is not thread-safe.
+func (t *TileRenderer) RenderGridZXY(zoom, x, y uint64) ([]byte, error) {
+	if t.proxy || nil == t.interactivity {
+		return nil, errors.New("Layer has no interactivity")
+	}
+	t.zoomToTile(zoom, x, y)
+
+	grid, err := t.m.RenderGrid(t.interactivity.Layer, t.interactivity.gridKey(), t.interactivity.Fields, gridResolution)
+
+	Ligneous.Trace(fmt.Sprintf("RENDER GRID %v %v %v %v", t.s, zoom, x, y))
+
+	return grid, err
+}
+
+// RenderVectorZXY renders gzipped Mapbox vector tile with the features of
+// all layers of the map. Same as RenderTileZXY, the method is not thread-safe.
+func (t *TileRenderer) RenderVectorZXY(zoom, x, y uint64) ([]byte, error) {
+	t.zoomToTile(zoom, x, y)
+
+	// Features are queried within the buffered tile
+	b := float64(t.buffer) * 256 / float64(t.size)
+	l0 := fromPixelToLL([2]float64{float64(x)*256 - b, (float64(y)+1)*256 + b}, zoom)
+	l1 := fromPixelToLL([2]float64{(float64(x)+1)*256 + b, float64(y)*256 - b}, zoom)
+	c0 := t.mp.Forward(mapnik.Coord{X: l0[0], Y: l0[1]})
+	c1 := t.mp.Forward(mapnik.Coord{X: l1[0], Y: l1[1]})
+
+	buffer := float64(t.buffer) * mvtExtent / float64(t.size)
+	tile, err := encodeVectorTile(zoom, x, y, buffer, t.m.LayerNames(), func(layer string) ([]json.RawMessage, error) {
+		return t.m.QueryBox(layer, c0.X, c0.Y, c1.X, c1.Y)
+	})
+
+	Ligneous.Trace(fmt.Sprintf("RENDER VECTOR %v %v %v %v", t.s, zoom, x, y))
+
+	if nil != err {
+		return nil, err
+	}
+	return gzipBytes(tile)
+}
+
+// zoomToTile sets map extent to a tile in Google tile format.
+func (t *TileRenderer) zoomToTile(zoom, x, y uint64) {
 	// Calculate pixel positions of bottom left & top right
 	p0 := [2]float64{float64(x) * 256, (float64(y) + 1) * 256}
 	p1 := [2]float64{(float64(x) + 1) * 256, float64(y) * 256}
@@ -132,15 +269,9 @@ func (t *TileRenderer) RenderTileZXY(zoom, x, y uint64) ([]byte, error) {
 	c1 := t.mp.Forward(mapnik.Coord{l1[0], l1[1]})
 
 	// Bounding box for the Tile
-	t.m.Resize(256, 256)
+	t.m.Resize(uint32(t.size), uint32(t.size))
 	t.m.ZoomToMinMax(c0.X, c0.Y, c1.X, c1.Y)
-	t.m.SetBufferSize(128)
-
-	blob, err := t.m.RenderToMemoryPng()
-
-	Ligneous.Trace(fmt.Sprintf("RENDER BLOB %v %v %v %v", t.s, zoom, x, y))
-
-	return blob, err
+	t.m.SetBufferSize(t.buffer)
 }
 
 // subDomain selects random sub domain for proxy tile server.
@@ -169,6 +300,9 @@ func (t *TileRenderer) HttpGetTileZXY(zoom, x, y uint64) ([]byte, error) {
 		//req.Header.Set("User-Agent", "Golang_TileServer/1.2")
 		// Look like a web browser running leaflet
 		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/54.0.2840.71 Safari/537.36")
+		for k, v := range t.headers {
+			req.Header.Set(k, v)
+		}
 		resp, err := ProxyClient.Do(req)
 		//.end
 
@@ -0,0 +1,109 @@
+package maptiles
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Seeder renders tiles of a layer into the tile cache.
+type Seeder struct {
+	Db        TileDb
+	Layer     string
+	Config    LayerConfig
+	Bounds    [4]float64
+	MinZoom   uint64
+	MaxZoom   uint64
+	BatchSize int
+}
+
+// seedCount returns number of tiles within bounds and zoom range.
+func (self *Seeder) seedCount() uint64 {
+	var count uint64
+	for z := self.MinZoom; z <= self.MaxZoom; z++ {
+		if x0, y0, x1, y1, ok := TileRange(self.Bounds, z); ok {
+			count += (x1 - x0 + 1) * (y1 - y0 + 1)
+		}
+	}
+	return count
+}
+
+// seedTiles sends requests for the tiles within bounds and zoom range
+// until all are sent or cancel is closed, then closes requests.
+func (self *Seeder) seedTiles(requests chan<- TileFetchRequest, results chan<- TileFetchResult, cancel <-chan struct{}) {
+	defer close(requests)
+	for z := self.MinZoom; z <= self.MaxZoom; z++ {
+		x0, y0, x1, y1, ok := TileRange(self.Bounds, z)
+		if !ok {
+			continue
+		}
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				tile := TileCoord{X: x, Y: y, Zoom: z, Layer: self.Layer}
+				select {
+				case requests <- TileFetchRequest{tile, results}:
+				case <-cancel:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Run renders the tiles with config.Workers renderers and writes them
+// to the tile cache in batches, replacing cached tiles.
+// Returns number of cached tiles, tiles that fail to render are skipped.
+// Seeding stops on the first failed write.
+func (self *Seeder) Run() (int, error) {
+	if err := self.Config.Validate(); nil != err {
+		return 0, err
+	}
+	if self.BatchSize < 1 {
+		self.BatchSize = 100
+	}
+	err := self.Db.AddLayerMetadata(self.Config.Metadata(self.Layer))
+	if nil != err {
+		return 0, err
+	}
+
+	total := self.seedCount()
+	Ligneous.Info(fmt.Sprintf("Seeding %v tiles of layer %v", total, self.Layer))
+
+	var renderers sync.WaitGroup
+	requests := newLayerRendererChan(self.Config, &renderers)
+	results := make(chan TileFetchResult)
+	cancel := make(chan struct{})
+	go self.seedTiles(requests, results, cancel)
+	go func() {
+		renderers.Wait()
+		close(results)
+	}()
+
+	// keep reading results after an error, so the renderers can finish
+	// the requests they already took
+	var batch []TileFetchResult
+	seeded := 0
+	for result := range results {
+		if nil == result.BlobPNG || nil != err {
+			continue
+		}
+		batch = append(batch, result)
+		if len(batch) < self.BatchSize {
+			continue
+		}
+		err = self.Db.WriteTiles(batch)
+		if nil != err {
+			close(cancel)
+			continue
+		}
+		seeded += len(batch)
+		Ligneous.Info(fmt.Sprintf("Seeded %v/%v tiles of layer %v", seeded, total, self.Layer))
+		batch = batch[:0]
+	}
+	if nil == err && 0 != len(batch) {
+		err = self.Db.WriteTiles(batch)
+		if nil == err {
+			seeded += len(batch)
+		}
+	}
+	return seeded, err
+}
@@ -0,0 +1,290 @@
+package maptiles
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticMapDefaultSize width and height of static maps without size.
+const StaticMapDefaultSize = 512
+
+// staticMapMaxBody maximum size of GeoJSON overlays posted to static maps.
+const staticMapMaxBody = 10 << 20
+
+// staticMapFormats maps static map formats to their mime type.
+var staticMapFormats = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+}
+
+// StaticMap image of a tile layer composited from its tiles, with overlays
+// drawn on top. Origin is the world pixel of the top left corner at Zoom,
+// in TileSize pixels of the layer.
+type StaticMap struct {
+	Layer    string
+	Zoom     int
+	TileSize int
+	Width    int
+	Height   int
+	Origin   [2]float64
+	Format   string
+	Overlays []MapOverlay
+}
+
+// worldPixel converts lon, lat to world pixel at zoom for tiles of tileSize.
+func worldPixel(ll [2]float64, zoom int, tileSize int) [2]float64 {
+	m := fromLLtoMercator(ll)
+	res := mercatorResolution(zoom, tileSize)
+	return [2]float64{(m[0] + mercatorExtent) / res, (mercatorExtent - m[1]) / res}
+}
+
+// parseStaticMapSize parses size as WIDTHxHEIGHT.
+func parseStaticMapSize(value string, maxSize int) (int, int, error) {
+	parts := strings.Split(strings.ToLower(value), "x")
+	if 2 != len(parts) {
+		return 0, 0, fmt.Errorf("Expecting size as WIDTHxHEIGHT: %v", value)
+	}
+	width, err := strconv.Atoi(parts[0])
+	if nil != err {
+		return 0, 0, fmt.Errorf("Invalid size: %v", value)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if nil != err {
+		return 0, 0, fmt.Errorf("Invalid size: %v", value)
+	}
+	if width < 1 || height < 1 || (0 != maxSize && (width > maxSize || height > maxSize)) {
+		return 0, 0, fmt.Errorf("Size out of range: %v", value)
+	}
+	return width, height, nil
+}
+
+// newStaticMap creates static map of a tile layer from center=lon,lat,
+// zoom and size=WIDTHxHEIGHT parameters, or from bbox=minlon,minlat,maxlon,maxlat.
+// Maps of a bbox are cropped to the bbox at zoom, which defaults to the
+// highest zoom level with the bbox fitting into size.
+func newStaticMap(lyr string, config LayerConfig, params map[string][]string, maxSize int) (StaticMap, error) {
+	sm := StaticMap{Layer: lyr, Zoom: -1, TileSize: config.TileSize, Width: StaticMapDefaultSize, Height: StaticMapDefaultSize, Format: "png"}
+	if format := params["format"]; 0 != len(format) && "" != format[0] {
+		if _, ok := staticMapFormats[format[0]]; !ok {
+			return sm, fmt.Errorf("Unsupported format: %v", format[0])
+		}
+		sm.Format = format[0]
+	}
+	if size := params["size"]; 0 != len(size) {
+		var err error
+		sm.Width, sm.Height, err = parseStaticMapSize(size[0], maxSize)
+		if nil != err {
+			return sm, err
+		}
+	}
+	if z := params["zoom"]; 0 != len(z) {
+		var err error
+		sm.Zoom, err = strconv.Atoi(z[0])
+		if nil != err || sm.Zoom < config.MinZoom || sm.Zoom > config.MaxZoom {
+			return sm, fmt.Errorf("Expecting zoom between %v and %v", config.MinZoom, config.MaxZoom)
+		}
+	}
+
+	if bbox := params["bbox"]; 0 != len(bbox) {
+		values, err := parseQueryFloats(bbox[0], 4)
+		if nil != err {
+			return sm, err
+		}
+		if values[0] >= values[2] || values[1] >= values[3] {
+			return sm, fmt.Errorf("Invalid bbox: %v", bbox[0])
+		}
+		if -1 == sm.Zoom {
+			sm.Zoom = config.MinZoom
+			for z := config.MaxZoom; z > config.MinZoom; z-- {
+				p0 := worldPixel([2]float64{values[0], values[3]}, z, config.TileSize)
+				p1 := worldPixel([2]float64{values[2], values[1]}, z, config.TileSize)
+				if p1[0]-p0[0] <= float64(sm.Width) && p1[1]-p0[1] <= float64(sm.Height) {
+					sm.Zoom = z
+					break
+				}
+			}
+		}
+		p0 := worldPixel([2]float64{values[0], values[3]}, sm.Zoom, config.TileSize)
+		p1 := worldPixel([2]float64{values[2], values[1]}, sm.Zoom, config.TileSize)
+		sm.Origin = p0
+		sm.Width = int(math.Max(math.Ceil(p1[0]-p0[0]), 1))
+		sm.Height = int(math.Max(math.Ceil(p1[1]-p0[1]), 1))
+		if 0 != maxSize && (sm.Width > maxSize || sm.Height > maxSize) {
+			return sm, fmt.Errorf("Map of bbox at zoom %v exceeds %v pixels", sm.Zoom, maxSize)
+		}
+		return sm, nil
+	}
+
+	center := params["center"]
+	if 0 == len(center) {
+		return sm, errors.New("Expecting center or bbox")
+	}
+	values, err := parseQueryFloats(center[0], 2)
+	if nil != err {
+		return sm, err
+	}
+	if values[0] < -180 || values[0] > 180 || values[1] < -90 || values[1] > 90 {
+		return sm, fmt.Errorf("Invalid center: %v", center[0])
+	}
+	if -1 == sm.Zoom {
+		return sm, errors.New("Expecting zoom with center")
+	}
+	c := worldPixel([2]float64{values[0], values[1]}, sm.Zoom, config.TileSize)
+	sm.Origin = [2]float64{c[0] - float64(sm.Width)/2, c[1] - float64(sm.Height)/2}
+	return sm, nil
+}
+
+// RenderStaticMap composites static map from the tiles of its layer,
+// fetched from the tile cache or rendered. Tiles wrap around the
+// antimeridian, areas without tiles are left transparent.
+func RenderStaticMap(db TileDb, lmp *LayerMultiplex, sm StaticMap) (*image.RGBA, error) {
+	config, ok := lmp.LayerConfig(sm.Layer)
+	if !ok {
+		return nil, ErrLayerNotFound
+	}
+	size := config.TileSize
+	n := 1 << uint(sm.Zoom)
+	x0 := int(math.Floor(sm.Origin[0] / float64(size)))
+	y0 := int(math.Floor(sm.Origin[1] / float64(size)))
+	x1 := int(math.Floor((sm.Origin[0] + float64(sm.Width) - 1) / float64(size)))
+	y1 := int(math.Floor((sm.Origin[1] + float64(sm.Height) - 1) / float64(size)))
+
+	type tileImage struct {
+		x, y int
+		img  image.Image
+		err  error
+	}
+	results := make(chan tileImage)
+	total := 0
+	for y := y0; y <= y1; y++ {
+		if y < 0 || y >= n {
+			continue
+		}
+		for x := x0; x <= x1; x++ {
+			total++
+			go func(x, y int) {
+				coord := TileCoord{X: uint64((x%n + n) % n), Y: uint64(y), Zoom: uint64(sm.Zoom), Layer: sm.Layer}
+				result, _, err := fetchTile(db, lmp, coord)
+				if nil != err {
+					results <- tileImage{x: x, y: y, err: err}
+					return
+				}
+				img, _, err := image.Decode(bytes.NewReader(result.BlobPNG))
+				results <- tileImage{x: x, y: y, img: img, err: err}
+			}(x, y)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, sm.Width, sm.Height))
+	offset := image.Pt(int(math.Floor(sm.Origin[0])), int(math.Floor(sm.Origin[1])))
+	for i := 0; i < total; i++ {
+		tile := <-results
+		if nil != tile.err {
+			Ligneous.Warn("Missing static map tile ", sm.Layer, " ", sm.Zoom, "/", tile.x, "/", tile.y, ": ", tile.err)
+			continue
+		}
+		r := tile.img.Bounds().Add(image.Pt(tile.x*size, tile.y*size).Sub(offset))
+		draw.Draw(img, r, tile.img, tile.img.Bounds().Min, draw.Src)
+	}
+	return img, nil
+}
+
+// encodeStaticMap encodes image in the format of static map,
+// jpeg images get a white background.
+func encodeStaticMap(img *image.RGBA, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if "png" == format {
+		if err := png.Encode(&buf, img); nil != err {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	background := image.NewRGBA(img.Bounds())
+	draw.Draw(background, background.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(background, background.Bounds(), img, img.Bounds().Min, draw.Over)
+	if err := jpeg.Encode(&buf, background, &jpeg.Options{Quality: 90}); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// StaticMapHandler returns image of a tile layer composited from its
+// png or jpeg tiles, with overlays of markers, path and polygon parameters
+// and of GeoJSON posted in the request body. Width and height are limited
+// to maxSize, if not 0.
+func StaticMapHandler(db TileDb, lmp *LayerMultiplex, maxSize int, icons map[string]image.Image, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	params := r.URL.Query()
+	lyr := params.Get("layer")
+	config, ok := lmp.LayerConfig(lyr)
+	if !ok {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if _, ok := staticMapFormats[config.Format]; !ok {
+		http.Error(w, "static maps require png or jpeg tiles", http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	sm, err := newStaticMap(lyr, config, params, maxSize)
+	if nil == err {
+		sm.Overlays, err = parseOverlayParams(params)
+	}
+	if nil == err && "POST" == r.Method {
+		var body []byte
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, staticMapMaxBody))
+		if nil == err {
+			var overlays []MapOverlay
+			overlays, err = parseGeoJSONOverlays(body)
+			sm.Overlays = append(sm.Overlays, overlays...)
+		}
+	}
+	if nil == err {
+		err = checkMarkerSymbols(sm.Overlays, icons)
+	}
+	if nil == err {
+		err = checkOverlayPoints(sm.Overlays)
+	}
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	img, err := RenderStaticMap(db, lmp, sm)
+	if nil == err {
+		err = sm.DrawOverlays(img, icons)
+	}
+	var blob []byte
+	if nil == err {
+		blob, err = encodeStaticMap(img, sm.Format)
+	}
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	w.Header().Set("Content-Type", staticMapFormats[sm.Format])
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(blob); nil != err {
+		Ligneous.Error(err)
+	}
+	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+}
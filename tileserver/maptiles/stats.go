@@ -0,0 +1,98 @@
+package maptiles
+
+import (
+	"time"
+)
+
+// ZoomStats cache statistics of a zoom level.
+// Tiles counts all cached tiles, Coverage is the percentage of the tiles
+// within the layer bounds that are cached. Oldest and Newest are nil for
+// zoom levels without cached tiles.
+type ZoomStats struct {
+	Zoom     uint64     `json:"zoom"`
+	Tiles    int64      `json:"tiles"`
+	Bytes    int64      `json:"bytes"`
+	Oldest   *time.Time `json:"oldest"`
+	Newest   *time.Time `json:"newest"`
+	Coverage float64    `json:"coverage"`
+}
+
+// LayerStats cache statistics of a tile layer.
+// Coverage is the percentage of the tiles within the layer bounds from
+// the layer's minzoom to maxzoom that are cached.
+type LayerStats struct {
+	Layer    string      `json:"layer"`
+	Tiles    int64       `json:"tiles"`
+	Bytes    int64       `json:"bytes"`
+	Oldest   *time.Time  `json:"oldest"`
+	Newest   *time.Time  `json:"newest"`
+	Coverage float64     `json:"coverage"`
+	Zooms    []ZoomStats `json:"zooms"`
+}
+
+// tileCounter counts cached tiles of a layer at zoom level within
+// columns x0 to x1 and TMS rows y0 to y1.
+type tileCounter func(zoom, x0, y0, x1, y1 uint64) (int64, error)
+
+// newLayerStats sums up the statistics of the cached zoom levels, ordered
+// by zoom level, and computes coverage relative to the layer bounds. Every
+// zoom level from the layer's minzoom to maxzoom is listed, levels without
+// cached tiles have no coverage. Only tiles within the bounds, counted with
+// count, add to coverage.
+func newLayerStats(metadata LayerMetadata, cached []ZoomStats, count tileCounter) (LayerStats, error) {
+	stats := LayerStats{Layer: metadata.Name, Zooms: []ZoomStats{}}
+	first, last := int64(metadata.MinZoom), int64(metadata.MaxZoom)
+	if 0 > first {
+		first = 0
+	}
+	if max := int64(len(gp.Ac)) - 1; last > max {
+		last = max
+	}
+	if 0 != len(cached) {
+		if z := int64(cached[0].Zoom); z < first {
+			first = z
+		}
+		if z := int64(cached[len(cached)-1].Zoom); z > last {
+			last = z
+		}
+	}
+
+	var covered, total float64
+	for z := first; z <= last; z++ {
+		zoom := ZoomStats{Zoom: uint64(z)}
+		if 0 != len(cached) && cached[0].Zoom == zoom.Zoom {
+			zoom, cached = cached[0], cached[1:]
+		}
+		if x0, y0, x1, y1, ok := TileRange(metadata.Bounds, zoom.Zoom); ok {
+			var inBounds int64
+			if 0 != zoom.Tiles {
+				// tiles are stored with TMS rows
+				n := uint64(1) << zoom.Zoom
+				var err error
+				inBounds, err = count(zoom.Zoom, x0, n-1-y1, x1, n-1-y0)
+				if nil != err {
+					return stats, err
+				}
+			}
+			tiles := float64((x1 - x0 + 1) * (y1 - y0 + 1))
+			zoom.Coverage = 100 * float64(inBounds) / tiles
+			if int64(metadata.MinZoom) <= z && z <= int64(metadata.MaxZoom) {
+				covered += float64(inBounds)
+				total += tiles
+			}
+		}
+		stats.Tiles += zoom.Tiles
+		stats.Bytes += zoom.Bytes
+		if nil != zoom.Oldest && (nil == stats.Oldest || zoom.Oldest.Before(*stats.Oldest)) {
+			stats.Oldest = zoom.Oldest
+		}
+		if nil != zoom.Newest && (nil == stats.Newest || zoom.Newest.After(*stats.Newest)) {
+			stats.Newest = zoom.Newest
+		}
+		stats.Zooms = append(stats.Zooms, zoom)
+	}
+	if 0 != total {
+		stats.Coverage = 100 * covered / total
+	}
+	return stats, nil
+}
@@ -0,0 +1,66 @@
+package maptiles
+
+import (
+	"testing"
+)
+
+func TestLayerStatsCoverage(t *testing.T) {
+	db := newTestSqlite(t, "stats.mbtiles")
+	metadata := NewLayerMetadata("osm", "osm.xml")
+	// north western quarter of the world, tile 0/0 at zoom 1
+	metadata.Bounds = [4]float64{-170, 10, -10, 80}
+	metadata.MinZoom, metadata.MaxZoom = 0, 3
+	if err := db.AddLayerMetadata(metadata); nil != err {
+		t.Fatal(err)
+	}
+
+	var tiles []TileFetchResult
+	// zoom 1: the tile within bounds and two outside
+	for _, c := range [][2]uint64{{0, 0}, {1, 0}, {1, 1}} {
+		tiles = append(tiles, TileFetchResult{Coord: TileCoord{Zoom: 1, X: c[0], Y: c[1], Layer: "osm"}, BlobPNG: []byte("png")})
+	}
+	// zoom 2: the bounds cover columns 0 and 1 of rows 0 and 1,
+	// one of these tiles and three outside are cached
+	for _, c := range [][2]uint64{{0, 1}, {2, 2}, {3, 3}, {3, 0}} {
+		tiles = append(tiles, TileFetchResult{Coord: TileCoord{Zoom: 2, X: c[0], Y: c[1], Layer: "osm"}, BlobPNG: []byte("png")})
+	}
+	if err := db.WriteTiles(tiles); nil != err {
+		t.Fatal(err)
+	}
+
+	stats, err := db.GetLayerStats("osm")
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := []struct {
+		zoom     uint64
+		tiles    int64
+		coverage float64
+	}{
+		{0, 0, 0},
+		{1, 3, 100},
+		{2, 4, 25},
+		{3, 0, 0},
+	}
+	if len(stats.Zooms) != len(want) {
+		t.Fatalf("got %v zoom levels, want %v", len(stats.Zooms), len(want))
+	}
+	for i, w := range want {
+		z := stats.Zooms[i]
+		if z.Zoom != w.zoom || z.Tiles != w.tiles || z.Coverage != w.coverage {
+			t.Errorf("zoom %v: got %v tiles, %v%%, want %v tiles, %v%%", w.zoom, z.Tiles, z.Coverage, w.tiles, w.coverage)
+		}
+	}
+	for _, i := range []int{0, 3} {
+		if z := stats.Zooms[i]; nil != z.Oldest || nil != z.Newest {
+			t.Errorf("zoom %v without tiles: oldest %v, newest %v", z.Zoom, z.Oldest, z.Newest)
+		}
+	}
+	if 7 != stats.Tiles {
+		t.Errorf("got %v tiles, want 7", stats.Tiles)
+	}
+	// 2 of the 1 + 1 + 4 + 16 tiles within bounds are cached
+	if want := 100 * 2.0 / 22; stats.Coverage != want {
+		t.Errorf("got %v%% coverage, want %v%%", stats.Coverage, want)
+	}
+}
@@ -0,0 +1,153 @@
+package maptiles
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrTileNotFound is returned for tiles outside the zoom range of a
+// layer, grids of layers without interactivity or tiles that could
+// not be rendered.
+var ErrTileNotFound = errors.New("Tile not found")
+
+// fetchTile gets tile from the tile cache or renders it if it is
+// missing or expired. Rendered tiles are queued for insert into the cache.
+func fetchTile(db TileDb, lmp *LayerMultiplex, coord TileCoord) (TileFetchResult, LayerConfig, error) {
+	config, ok := lmp.LayerConfig(coord.Layer)
+	if !ok {
+		return TileFetchResult{}, config, ErrLayerNotFound
+	}
+	if coord.Zoom < uint64(config.MinZoom) || coord.Zoom > uint64(config.MaxZoom) {
+		return TileFetchResult{}, config, ErrTileNotFound
+	}
+	if coord.X >= 1<<coord.Zoom || coord.Y >= 1<<coord.Zoom {
+		return TileFetchResult{}, config, ErrTileNotFound
+	}
+	if coord.Grid && !config.HasGrids() {
+		return TileFetchResult{}, config, ErrTileNotFound
+	}
+
+	ch := make(chan TileFetchResult)
+	tr := TileFetchRequest{coord, ch}
+	db.RequestQueue() <- tr
+	result := <-ch
+
+	if maxAge := config.MaxAge(); nil != result.BlobPNG && 0 != maxAge && time.Since(result.Modified) > maxAge {
+		// Cached tile has expired
+		result.BlobPNG = nil
+	}
+	if nil != result.BlobPNG {
+		return result, config, nil
+	}
+
+	// Tile was not provided by DB, so submit the tile request to the renderer.
+	// The request is released once the tile is queued for insert, so a
+	// purge after ReplaceRenderer is ordered after the insert.
+	release, ok := lmp.submitRequest(tr)
+	if !ok {
+		return result, config, ErrLayerNotFound
+	}
+	defer release()
+	result = <-ch
+	if nil == result.BlobPNG {
+		// The tile could not be rendered, now we need to bail out.
+		return result, config, ErrTileNotFound
+	}
+	db.InsertQueue() <- result // insert newly rendered tile into cache db
+	return result, config, nil
+}
+
+// isTileExtension checks if file extension of a tile request
+// matches the tile format of layer.
+func isTileExtension(ext string, config LayerConfig) bool {
+	mimeType, ok := tileFormats[ext]
+	return ok && mimeType == config.MimeType()
+}
+
+// tileCoordFromVars creates tile coord from route variables.
+func tileCoordFromVars(vars map[string]string, tms bool) TileCoord {
+	z, _ := strconv.ParseUint(vars["z"], 10, 64)
+	x, _ := strconv.ParseUint(vars["x"], 10, 64)
+	y, _ := strconv.ParseUint(vars["y"], 10, 64)
+	return TileCoord{X: x, Y: y, Zoom: z, Tms: tms, Layer: vars["lyr"]}
+}
+
+// tileContentEncoding returns tile data to send for request. Gzipped vector
+// tiles are sent as is to clients accepting gzip and decompressed otherwise.
+func tileContentEncoding(config LayerConfig, blob []byte, w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if "pbf" != config.Format || !isGzipped(blob) {
+		return blob, nil
+	}
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		return blob, nil
+	}
+	return gunzipBytes(blob)
+}
+
+// serveTile serves tile request, y is a TMS row if tms is set
+// and a XYZ row otherwise.
+func serveTile(db TileDb, lmp *LayerMultiplex, tms bool, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	vars := mux.Vars(r)
+	lyr := vars["lyr"]
+	tc := tileCoordFromVars(vars, tms)
+
+	var result TileFetchResult
+	config, ok := lmp.LayerConfig(lyr)
+	err := ErrLayerNotFound
+	if ext, hasExt := vars["ext"]; ok && hasExt && !isTileExtension(ext, config) {
+		err = ErrTileNotFound
+	} else if ok {
+		result, config, err = fetchTile(db, lmp, tc)
+	}
+	if nil != err {
+		http.NotFound(w, r)
+		Ligneous.Info(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	blob, err := tileContentEncoding(config, result.BlobPNG, w, r)
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	w.Header().Set("Content-Type", config.MimeType())
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(blob)
+	if err != nil {
+		Ligneous.Error(err)
+	}
+
+	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+}
+
+// serveGrid serves UTFGrid request, y is a TMS row if tms is set
+// and a XYZ row otherwise.
+func serveGrid(db TileDb, lmp *LayerMultiplex, tms bool, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	tc := tileCoordFromVars(mux.Vars(r), tms)
+	tc.Grid = true
+
+	result, _, err := fetchTile(db, lmp, tc)
+	if nil != err {
+		http.NotFound(w, r)
+		Ligneous.Info(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	status := SendJsonResponseFromByte(result.BlobPNG, w, r)
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
@@ -3,11 +3,39 @@ package maptiles
 import (
 	"fmt"
 	"math"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
+// dsnPassword matches password of key=value postgres connection strings.
+var dsnPassword = regexp.MustCompile(`password=('[^']*'|\S*)`)
+
+// RedactPassword replaces the password of a postgres or PostGIS url,
+// or of a key=value connection string, with mask. The password is
+// removed if mask is empty. Other sources are returned unchanged.
+func RedactPassword(source string, mask string) string {
+	if u, err := url.Parse(source); nil == err && nil != u.User {
+		if _, ok := u.User.Password(); !ok {
+			return source
+		}
+		if "" == mask {
+			u.User = url.User(u.User.Username())
+		} else {
+			u.User = url.UserPassword(u.User.Username(), mask)
+		}
+		return u.String()
+	}
+	if !dsnPassword.MatchString(source) {
+		return source
+	}
+	if "" == mask {
+		return strings.Join(strings.Fields(dsnPassword.ReplaceAllString(source, "")), " ")
+	}
+	return dsnPassword.ReplaceAllString(source, "password="+mask)
+}
+
 // ParseTileUrl validates tile url and returns layer, x, y and z parameters
 // for tile lookup.
 func ParseTileUrl(url_path string) (string, []uint64, error) {
@@ -29,9 +57,24 @@ func GetTileUrlParts(path []string) (string, []uint64) {
 	return l, []uint64{x, y, z}
 }
 
-// unitsPerPixel converts zoom_level to units per pixel
-func unitsPerPixel(zoom_level int) float64 {
-	return 0.703125 / math.Pow(2, float64(zoom_level))
+// TileRange returns the columns and rows of xyz tiles covering
+// bounds (west, south, east, north) at zoom.
+// ok is false if the bounds cover no tile.
+func TileRange(bounds [4]float64, zoom uint64) (x0, y0, x1, y1 uint64, ok bool) {
+	if zoom >= uint64(len(gp.Ac)) {
+		return 0, 0, 0, 0, false
+	}
+	px0 := fromLLtoPixel([2]float64{bounds[0], bounds[3]}, zoom)
+	px1 := fromLLtoPixel([2]float64{bounds[2], bounds[1]}, zoom)
+	max := gp.Ac[zoom]/256 - 1
+	fx0 := math.Max(math.Min(math.Floor(px0[0]/256), max), 0)
+	fy0 := math.Max(math.Min(math.Floor(px0[1]/256), max), 0)
+	fx1 := math.Max(math.Min(math.Floor(px1[0]/256), max), 0)
+	fy1 := math.Max(math.Min(math.Floor(px1[1]/256), max), 0)
+	if fx1 < fx0 || fy1 < fy0 {
+		return 0, 0, 0, 0, false
+	}
+	return uint64(fx0), uint64(fy0), uint64(fx1), uint64(fy1), true
 }
 
 func isValidTileSource(source string) bool {
@@ -40,6 +83,8 @@ func isValidTileSource(source string) bool {
 		return true
 	} else if strings.Contains(source, ".xml") {
 		return true
+	} else if isDatasourceSource(source) {
+		return true
 	}
 	return false
 }
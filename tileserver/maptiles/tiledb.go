@@ -0,0 +1,65 @@
+package maptiles
+
+import (
+	"errors"
+	"fmt"
+)
+
+// insertQueueSize number of rendered tiles queued for insert into
+// the tile cache.
+const insertQueueSize = 256
+
+// ErrTileDbClosed is returned for purges of a closed tile cache.
+var ErrTileDbClosed = errors.New("Tile cache closed")
+
+// purgeRequest purge of the cached tiles of a layer, sent to Run so
+// it is ordered after the tile inserts queued before it.
+type purgeRequest struct {
+	layer   string
+	errChan chan error
+}
+
+// tileTable returns the cache table of a tile,
+// UTFGrids are kept apart from tile images.
+func tileTable(coord TileCoord) string {
+	if coord.Grid {
+		return "grids"
+	}
+	return "tiles"
+}
+
+// TileDb tile cache database.
+// Implemented by TileDbSqlite3 and TileDbPostgresql.
+type TileDb interface {
+	InsertQueue() chan<- TileFetchResult
+	RequestQueue() chan<- TileFetchRequest
+	AddLayerMetadata(metadata LayerMetadata) error
+	UpdateLayerMetadata(metadata LayerMetadata) error
+	DeleteLayer(lyr string, purge bool) error
+	PurgeLayer(lyr string) error
+	MetaDataHandler(lyr string) (LayerMetadata, error)
+	GetTileLayers() (map[string]LayerMetadata, error)
+	CountTiles(lyr string) (int64, error)
+	ReadTiles(lyr string, grids bool, zoom, column, row int64, limit int) ([]TileFetchResult, error)
+	WriteTiles(tiles []TileFetchResult) error
+	GetLayerStats(lyr string) (LayerStats, error)
+	Close()
+}
+
+// NewTileDb opens tile cache database for engine.
+// Supported engines are sqlite and postgres.
+func NewTileDb(engine string, path string) (TileDb, error) {
+	switch engine {
+	case "sqlite":
+		if m := NewTileDbSqlite(path); nil != m {
+			return m, nil
+		}
+	case "postgres":
+		if m := NewTileDbPostgresql(path); nil != m {
+			return m, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported database engine: %v", engine)
+	}
+	return nil, fmt.Errorf("Unable to open %v tile cache: %v", engine, path)
+}
@@ -0,0 +1,87 @@
+package maptiles
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TileJSON TileJSON 3.0.0 document of a tile layer.
+// https://github.com/mapbox/tilejson-spec/tree/master/3.0.0
+type TileJSON struct {
+	TileJSON    string     `json:"tilejson"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Version     string     `json:"version"`
+	Attribution string     `json:"attribution,omitempty"`
+	Scheme      string     `json:"scheme"`
+	Tiles       []string   `json:"tiles"`
+	Grids       []string   `json:"grids,omitempty"`
+	MinZoom     int        `json:"minzoom"`
+	MaxZoom     int        `json:"maxzoom"`
+	Bounds      [4]float64 `json:"bounds"`
+	Center      [3]float64 `json:"center"`
+	Format      string     `json:"format"`
+	// VectorLayers layers of vector tiles.
+	VectorLayers []TileJSONVectorLayer `json:"vector_layers,omitempty"`
+}
+
+// TileJSONVectorLayer layer of vector tiles. Feature attributes
+// depend on the datasource and are not listed.
+type TileJSONVectorLayer struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+// NewTileJSON creates TileJSON from layer metadata.
+// Tile urls start with base and use TMS rows if tms is set.
+func NewTileJSON(base string, metadata LayerMetadata, tms bool) TileJSON {
+	scheme := "xyz"
+	tiles := fmt.Sprintf("%v/xyz/%v/{z}/{x}/{y}.%v", base, metadata.Name, metadata.Format)
+	if tms {
+		scheme = "tms"
+		tiles = fmt.Sprintf("%v/tms/1.0/%v/{z}/{x}/{y}.%v", base, metadata.Name, metadata.Format)
+	}
+	// TileJSON versions are semver, MBTiles versions plain numbers
+	version := metadata.Version
+	switch strings.Count(version, ".") {
+	case 0:
+		version += ".0.0"
+	case 1:
+		version += ".0"
+	}
+	if "" == metadata.Version {
+		version = "1.0.0"
+	}
+	return TileJSON{
+		TileJSON:    "3.0.0",
+		Name:        metadata.Name,
+		Description: metadata.Description,
+		Version:     version,
+		Attribution: metadata.Attribution,
+		Scheme:      scheme,
+		Tiles:       []string{tiles},
+		MinZoom:     metadata.MinZoom,
+		MaxZoom:     metadata.MaxZoom,
+		Bounds:      metadata.Bounds,
+		Center:      metadata.Center,
+		Format:      metadata.Format,
+	}
+}
+
+// TileJSONHandler returns TileJSON of layer, with UTFGrid urls for layers
+// with interactivity and vectorLayers, the layers of vector tiles.
+func TileJSONHandler(start time.Time, base string, metadata LayerMetadata, tms bool, config LayerConfig, vectorLayers []string, w http.ResponseWriter, r *http.Request) {
+	tileJSON := NewTileJSON(base, metadata, tms)
+	for _, name := range vectorLayers {
+		tileJSON.VectorLayers = append(tileJSON.VectorLayers, TileJSONVectorLayer{ID: name, Fields: map[string]string{}})
+	}
+	if config.HasGrids() {
+		for _, tiles := range tileJSON.Tiles {
+			tileJSON.Grids = append(tileJSON.Grids, strings.TrimSuffix(tiles, "."+metadata.Format)+".grid.json")
+		}
+	}
+	status := SendJsonResponseFromInterface(w, r, tileJSON)
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
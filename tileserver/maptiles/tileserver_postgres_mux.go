@@ -3,8 +3,11 @@ package maptiles
 import (
 	"encoding/json"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
 	"time"
 
@@ -15,12 +18,15 @@ import (
 // Handles HTTP requests for map tiles, caching any produced tiles
 // in an MBtiles 1.2 compatible sqlite db.
 type TileServerPostgresMux struct {
-	engine    string
-	m         *TileDbPostgresql
-	lmp       *LayerMultiplex
-	TmsSchema bool
-	startTime time.Time
-	Router    *mux.Router
+	engine      string
+	m           *TileDbPostgresql
+	lmp         *LayerMultiplex
+	TmsSchema   bool
+	PublicURL   string
+	WMSMaxSize  int
+	MarkerIcons map[string]image.Image
+	startTime   time.Time
+	Router      *mux.Router
 }
 
 // NewTileServerPostgresMux creates TileServerPostgresMux object.
@@ -36,52 +42,251 @@ func NewTileServerPostgresMux(cacheFile string) *TileServerPostgresMux {
 	}
 	Ligneous.Debug(tilelayers)
 	for i := range tilelayers {
-		t.AddMapnikLayer(tilelayers[i]["name"], tilelayers[i]["source"])
+		config := LayerConfigFromMetadata(tilelayers[i])
+		if err := config.checkRestored(); nil != err {
+			Ligneous.Error(fmt.Sprintf("Tile layer %v not restored: %v", tilelayers[i].Name, err))
+			continue
+		}
+		t.AddMapnikLayer(tilelayers[i].Name, config)
 	}
 
+	t.WMSMaxSize = WMSDefaultMaxSize
 	t.startTime = time.Now()
 
 	t.Router = mux.NewRouter()
 	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}", t.GetTileLayer).Methods("Get")
+	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}", t.UpdateTileLayer).Methods("PUT")
+	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}", t.DeleteTileLayer).Methods("DELETE")
+	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}/stats", t.TileLayerStats).Methods("GET")
+	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}/tilejson", t.TileJSON).Methods("GET")
+	t.Router.HandleFunc("/api/v1/tilelayer/{lyr}/query", t.QueryLayer).Methods("GET")
 	t.Router.HandleFunc("/api/v1/tilelayer", t.NewTileLayer).Methods("POST")
 	t.Router.HandleFunc("/api/v1/tilelayers", t.TileLayersHandler).Methods("GET")
+	t.Router.HandleFunc("/api/v1/staticmap", t.StaticMap).Methods("GET")
+	t.Router.HandleFunc("/api/v1/staticmap", t.StaticMap).Methods("POST")
+	t.Router.HandleFunc("/api/v1/print", t.Print).Methods("GET")
 	t.Router.HandleFunc("/ping", PingHandler).Methods("GET")
 	t.Router.HandleFunc("/server", t.ServerProfileHandler).Methods("GET")
-	t.Router.HandleFunc("/", TMSRootHandler).Methods("GET")
+	t.Router.HandleFunc("/", t.TMSRootHandler).Methods("GET")
+	t.Router.HandleFunc("/{lyr}.json", t.TileJSON).Methods("GET")
 	t.Router.HandleFunc("/tms/1.0", t.TMSTileMaps).Methods("GET")
 	t.Router.HandleFunc("/tms/1.0/{lyr}", t.TMSTileMap).Methods("GET")
 	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}", TMSErrorTile).Methods("GET")
 	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}", TMSErrorTile).Methods("GET")
-	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", t.ServeTileRequest).Methods("GET")
-	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", t.ServeTileRequest).Methods("GET")
+	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", t.ServeTMSTileRequest).Methods("GET")
+	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.grid.json", t.ServeTMSGridRequest).Methods("GET")
+	t.Router.HandleFunc("/tms/1.0/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{ext}", t.ServeTMSTileRequest).Methods("GET")
+	t.Router.HandleFunc("/wms", t.WMS).Methods("GET")
+	t.Router.HandleFunc("/wmts", t.WMTS).Methods("GET")
+	t.Router.HandleFunc("/wmts/1.0.0/WMTSCapabilities.xml", t.WMTSCapabilities).Methods("GET")
+	t.Router.HandleFunc("/wmts/1.0.0/{lyr}/WMTSCapabilities.xml", t.WMTSCapabilities).Methods("GET")
+	t.Router.HandleFunc("/wmts/1.0.0/{lyr}/{style}/{set}/{z:[0-9]+}/{y:[0-9]+}/{x:[0-9]+}.{ext}", t.WMTSTile).Methods("GET")
+	t.Router.HandleFunc("/xyz/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.grid.json", t.ServeXYZGridRequest).Methods("GET")
+	t.Router.HandleFunc("/xyz/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{ext}", t.ServeXYZTileRequest).Methods("GET")
+	t.Router.HandleFunc("/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.grid.json", t.ServeGridRequest).Methods("GET")
+	t.Router.HandleFunc("/{lyr}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{ext}", t.ServeTileRequest).Methods("GET")
 
 	return &t
 }
 
 // AddMapnikLayer adds mapnik layer to server.
-func (self *TileServerPostgresMux) AddMapnikLayer(layerName string, stylesheet string) error {
-	Ligneous.Info("Adding tilelayer: ", layerName, " ", stylesheet)
-
-	// check if same layerName exists
-	for k := range self.lmp.layerChans {
-		if k == layerName {
-			Ligneous.Error("Tile layer already exists: ", k)
-			return fmt.Errorf("Tile layer already exists: %v", k)
+func (self *TileServerPostgresMux) AddMapnikLayer(layerName string, config LayerConfig) error {
+	Ligneous.Info("Adding tilelayer: ", layerName, " ", config.RedactedSource())
+
+	if "" == layerName {
+		Ligneous.Error("Tile layer name is empty")
+		return fmt.Errorf("Tile layer name is empty")
+	}
+
+	// Validate config
+	if err := config.Validate(); nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+
+	// add tile layer, fails if same layerName exists
+	err := self.lmp.AddRenderer(layerName, config)
+	if nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+	err = self.m.AddLayerMetadata(config.Metadata(layerName))
+	if nil != err {
+		self.lmp.RemoveLayer(layerName)
+		return err
+	}
+	return nil
+}
+
+// SetConnectionPool applies connection pool settings to the tile cache database.
+func (self *TileServerPostgresMux) SetConnectionPool(pool ConnectionPool) {
+	self.m.SetConnectionPool(pool)
+}
+
+// LoadLayers registers tile layers from the server config.
+// Registered layers whose config changed are updated and the layer
+// metadata is kept in sync with the config. With prune, layers
+// missing from the config are deleted from the server and the tile cache.
+func (self *TileServerPostgresMux) LoadLayers(layers map[string]LayerConfig, prune bool) error {
+	var names []string
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config := layers[name]
+		current, ok := self.lmp.LayerConfig(name)
+		var err error
+		switch {
+		case !ok:
+			err = self.AddMapnikLayer(name, config)
+		case !reflect.DeepEqual(current, config):
+			err = self.UpdateMapnikLayer(name, config)
+		}
+		if nil == err {
+			var metadata LayerMetadata
+			metadata, err = self.m.MetaDataHandler(name)
+			if expected := config.Metadata(name); nil == err && !reflect.DeepEqual(metadata, expected) {
+				err = self.m.UpdateLayerMetadata(expected)
+			}
+		}
+		if nil != err {
+			return fmt.Errorf("Unable to load tile layer %v: %v", name, err)
 		}
 	}
 
-	// Validate source
-	if !isValidTileSource(stylesheet) {
-		Ligneous.Error("Tile layer source is not valid: ", stylesheet)
-		return fmt.Errorf("Tile layer source is not valid: %v", stylesheet)
+	if prune {
+		for _, name := range self.lmp.Layers() {
+			if _, ok := layers[name]; ok {
+				continue
+			}
+			Ligneous.Info("Pruning tilelayer: ", name)
+			if err := self.DeleteMapnikLayer(name, true); nil != err {
+				return err
+			}
+		}
 	}
 
-	// add tile layer
-	self.m.AddLayerMetadata(layerName, stylesheet)
-	self.lmp.AddRenderer(layerName, stylesheet)
 	return nil
 }
 
+// Close stops renderers and closes the tile cache once pending
+// tile inserts are written. Call after the http server is shut down.
+func (self *TileServerPostgresMux) Close() {
+	self.lmp.Close()
+	self.m.Close()
+}
+
+// DeleteMapnikLayer removes tile layer from server.
+// With purge the cached tiles of the layer are deleted.
+func (self *TileServerPostgresMux) DeleteMapnikLayer(layerName string, purge bool) error {
+	Ligneous.Info("Deleting tilelayer: ", layerName)
+	if err := self.lmp.RemoveLayer(layerName); nil != err {
+		return err
+	}
+	return self.m.DeleteLayer(layerName, purge)
+}
+
+// UpdateMapnikLayer swaps the config of a tile layer. Cached tiles are
+// invalidated if the change affects rendered tiles.
+func (self *TileServerPostgresMux) UpdateMapnikLayer(layerName string, config LayerConfig) error {
+	Ligneous.Info("Updating tilelayer: ", layerName, " ", config.RedactedSource())
+
+	current, ok := self.lmp.LayerConfig(layerName)
+	if !ok {
+		return ErrLayerNotFound
+	}
+
+	// Validate config
+	if err := config.Validate(); nil != err {
+		Ligneous.Error(err)
+		return err
+	}
+
+	// ReplaceRenderer returns once the tiles of the old renderer are
+	// queued for insert, the purge is run after these inserts.
+	err := self.lmp.ReplaceRenderer(layerName, config)
+	if nil != err {
+		return err
+	}
+	err = self.m.UpdateLayerMetadata(config.Metadata(layerName))
+	if nil != err {
+		return err
+	}
+	if config.sameTiles(current) {
+		return nil
+	}
+	return self.m.PurgeLayer(layerName)
+}
+
+// DeleteTileLayer deletes tile layer.
+// Cached tiles are deleted with the purge=true query parameter.
+func (self *TileServerPostgresMux) DeleteTileLayer(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	lyr := vars["lyr"]
+	purge, _ := strconv.ParseBool(r.URL.Query().Get("purge"))
+
+	err := self.DeleteMapnikLayer(lyr, purge)
+	if ErrLayerNotFound == err {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if nil != err {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+
+	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+
+	SendJsonResponseFromString(`{"status": "ok"}`, w, r)
+}
+
+// UpdateTileLayer updates source of tile layer.
+func (self *TileServerPostgresMux) UpdateTileLayer(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	lyr := vars["lyr"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if nil != err {
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	api_request := new(ApiRequest)
+	err = json.Unmarshal(body, &api_request)
+	if nil != err {
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config, _ := self.lmp.LayerConfig(lyr)
+	config.Source = api_request.Data.TileLayerSource
+	err = self.UpdateMapnikLayer(lyr, config)
+	if ErrLayerNotFound == err {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	if nil != err {
+		Ligneous.Error(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	Ligneous.Info(api_request.redacted())
+	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+
+	SendJsonResponseFromString(`{"status": "ok"}`, w, r)
+}
+
 // GetTileLayer gets metadata for tilelayer.
 func (self *TileServerPostgresMux) GetTileLayer(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -93,15 +298,63 @@ func (self *TileServerPostgresMux) GetTileLayer(w http.ResponseWriter, r *http.R
 		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 		return
 	}
-	if _, ok := self.lmp.layerChans[lyr]; !ok {
+	if !self.lmp.HasLayer(lyr) {
 		http.Error(w, "layer not found", http.StatusNotFound)
 		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 		return
 	}
 
+	// layers stored by older versions may still have a password
+	metadata.Source = RedactPassword(metadata.Source, "")
 	SendJsonResponseFromInterface(w, r, metadata)
 }
 
+// TileJSON returns TileJSON for tilelayer.
+func (self *TileServerPostgresMux) TileJSON(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	lyr := vars["lyr"]
+	if !self.lmp.HasLayer(lyr) {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	metadata, err := self.m.MetaDataHandler(lyr)
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	config, _ := self.lmp.LayerConfig(lyr)
+	vectorLayers, _ := self.lmp.VectorLayers(lyr)
+	TileJSONHandler(start, baseURL(self.PublicURL, r), metadata, self.TmsSchema, config, vectorLayers, w, r)
+}
+
+// TileLayerStats returns cache statistics for tilelayer.
+func (self *TileServerPostgresMux) TileLayerStats(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	lyr := vars["lyr"]
+	if !self.lmp.HasLayer(lyr) {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		Ligneous.Error(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	stats, err := self.m.GetLayerStats(lyr)
+	if nil != err {
+		Ligneous.Error(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		Ligneous.Critical(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	response := make(map[string]interface{})
+	response["status"] = "ok"
+	response["data"] = stats
+	status := SendJsonResponseFromInterface(w, r, response)
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
+
 // NewTileLayer creates new tile layer.
 func (self *TileServerPostgresMux) NewTileLayer(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -122,74 +375,95 @@ func (self *TileServerPostgresMux) NewTileLayer(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = self.AddMapnikLayer(api_request.Data.TileLayerName, api_request.Data.TileLayerSource)
+	err = self.AddMapnikLayer(api_request.Data.TileLayerName, NewLayerConfig(api_request.Data.TileLayerSource))
 	if nil != err {
 		Ligneous.Error(fmt.Sprintf("%v %v %v [409]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	Ligneous.Info(fmt.Sprintf("%v", api_request))
+	Ligneous.Info(api_request.redacted())
 	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 
 	SendJsonResponseFromString(`{"status": "ok"}`, w, r)
 }
 
-// ServeTileRequest serves tile request.
+// ServeTileRequest serves tile request in the default schema of the server.
 func (self *TileServerPostgresMux) ServeTileRequest(w http.ResponseWriter, r *http.Request) {
+	serveTile(self.m, self.lmp, self.TmsSchema, w, r)
+}
 
-	start := time.Now()
+// ServeTMSTileRequest serves tile request with TMS row numbering.
+func (self *TileServerPostgresMux) ServeTMSTileRequest(w http.ResponseWriter, r *http.Request) {
+	serveTile(self.m, self.lmp, true, w, r)
+}
 
-	vars := mux.Vars(r)
-	lyr := vars["lyr"]
-	z, _ := strconv.ParseUint(vars["z"], 10, 64)
-	x, _ := strconv.ParseUint(vars["x"], 10, 64)
-	y, _ := strconv.ParseUint(vars["y"], 10, 64)
+// ServeXYZTileRequest serves tile request with XYZ row numbering.
+func (self *TileServerPostgresMux) ServeXYZTileRequest(w http.ResponseWriter, r *http.Request) {
+	serveTile(self.m, self.lmp, false, w, r)
+}
 
-	tc := TileCoord{x, y, z, self.TmsSchema, lyr}
+// QueryLayer returns features of a tile layer as GeoJSON.
+func (self *TileServerPostgresMux) QueryLayer(w http.ResponseWriter, r *http.Request) {
+	QueryLayerHandler(self.lmp, w, r)
+}
 
-	ch := make(chan TileFetchResult)
+// StaticMap returns image of a tile layer composited from its tiles
+// with overlays, limited to the maximum WMS image size.
+func (self *TileServerPostgresMux) StaticMap(w http.ResponseWriter, r *http.Request) {
+	StaticMapHandler(self.m, self.lmp, self.WMSMaxSize, self.MarkerIcons, w, r)
+}
 
-	tr := TileFetchRequest{tc, ch}
-	self.m.RequestQueue() <- tr
+// Print returns pdf, svg or ps print of a bounding box of a mapnik layer.
+func (self *TileServerPostgresMux) Print(w http.ResponseWriter, r *http.Request) {
+	PrintHandler(self.lmp, w, r)
+}
 
-	result := <-ch
-	needsInsert := false
+// ServeGridRequest serves UTFGrid of a tile in the default tile scheme.
+func (self *TileServerPostgresMux) ServeGridRequest(w http.ResponseWriter, r *http.Request) {
+	serveGrid(self.m, self.lmp, self.TmsSchema, w, r)
+}
 
-	if result.BlobPNG == nil {
-		// Tile was not provided by DB, so submit the tile request to the renderer
-		self.lmp.SubmitRequest(tr)
-		result = <-ch
-		if result.BlobPNG == nil {
-			// The tile could not be rendered, now we need to bail out.
-			http.NotFound(w, r)
-			return
-		}
-		needsInsert = true
-	}
+// ServeTMSGridRequest serves UTFGrid of a tile with TMS row numbering.
+func (self *TileServerPostgresMux) ServeTMSGridRequest(w http.ResponseWriter, r *http.Request) {
+	serveGrid(self.m, self.lmp, true, w, r)
+}
 
-	w.Header().Set("Content-Type", "image/png")
-	w.WriteHeader(http.StatusOK)
+// ServeXYZGridRequest serves UTFGrid of a tile with rows counted from the top.
+func (self *TileServerPostgresMux) ServeXYZGridRequest(w http.ResponseWriter, r *http.Request) {
+	serveGrid(self.m, self.lmp, false, w, r)
+}
 
-	_, err := w.Write(result.BlobPNG)
-	if err != nil {
-		Ligneous.Error(err)
-	}
-	if needsInsert {
-		self.m.InsertQueue() <- result // insert newly rendered tile into cache db
-	}
+// WMS serves WMS GetCapabilities, GetMap and GetFeatureInfo requests.
+func (self *TileServerPostgresMux) WMS(w http.ResponseWriter, r *http.Request) {
+	serveWMS(self.lmp, baseURL(self.PublicURL, r), self.WMSMaxSize, w, r)
+}
 
-	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+// WMTS serves WMTS KVP requests.
+func (self *TileServerPostgresMux) WMTS(w http.ResponseWriter, r *http.Request) {
+	serveWMTS(self.m, self.lmp, baseURL(self.PublicURL, r), w, r)
+}
+
+// WMTSCapabilities shows WMTS capabilities document.
+func (self *TileServerPostgresMux) WMTSCapabilities(w http.ResponseWriter, r *http.Request) {
+	serveWMTSCapabilities(self.lmp, baseURL(self.PublicURL, r), w, r)
+}
+
+// WMTSTile serves RESTful WMTS tile requests.
+func (self *TileServerPostgresMux) WMTSTile(w http.ResponseWriter, r *http.Request) {
+	serveWMTSRestTile(self.m, self.lmp, w, r)
+}
+
+// TMSRootHandler shows TMS root document.
+func (self *TileServerPostgresMux) TMSRootHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	TMSRootHandler(start, baseURL(self.PublicURL, r), w, r)
 }
 
 // TMSTileMaps lists available TileMaps
 func (self *TileServerPostgresMux) TMSTileMaps(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	var layers []string
-	for k := range self.lmp.layerChans {
-		layers = append(layers, k)
-	}
-	TMSTileMaps(start, layers, w, r)
+	TMSTileMaps(start, baseURL(self.PublicURL, r), self.lmp.Layers(), w, r)
 }
 
 // TMSTileMap shows list of TileSets for layer
@@ -197,17 +471,12 @@ func (self *TileServerPostgresMux) TMSTileMap(w http.ResponseWriter, r *http.Req
 	start := time.Now()
 	vars := mux.Vars(r)
 	lyr := vars["lyr"]
-	metadata, err := self.m.MetaDataHandler(lyr)
-	if nil != err {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		Ligneous.Info(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
-		return
-	}
-	if _, ok := self.lmp.layerChans[lyr]; !ok {
+	config, ok := self.lmp.LayerConfig(lyr)
+	if !ok {
 		http.Error(w, "layer not found", http.StatusNotFound)
 		Ligneous.Info(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 	} else {
-		TMSTileMap(start, lyr, metadata["source"], w, r)
+		TMSTileMap(start, baseURL(self.PublicURL, r), lyr, config, w, r)
 	}
 }
 
@@ -219,14 +488,11 @@ func (self *TileServerPostgresMux) ServerProfileHandler(w http.ResponseWriter, r
 // TileLayersHandler returns list of tiles.
 func (self *TileServerPostgresMux) TileLayersHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	var keys []string
-	for k := range self.lmp.layerChans {
-		keys = append(keys, k)
-	}
+	keys := self.lmp.Layers()
 	var response map[string]interface{}
 	response = make(map[string]interface{})
 	response["status"] = "ok"
 	response["data"] = keys
 	status := SendJsonResponseFromInterface(w, r, response)
-	Ligneous.Info(fmt.Sprintf("%v %v %v [200]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
 }
@@ -1,11 +1,98 @@
 package maptiles
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/http"
 	"time"
 )
 
+// TMS profile of the served Web Mercator tiles.
+const (
+	tmsSRS     = "EPSG:3857"
+	tmsProfile = "global-mercator"
+)
+
+// tmsServices TMS root document.
+type tmsServices struct {
+	XMLName         xml.Name           `xml:"Services"`
+	TileMapServices []tmsServiceHeader `xml:"TileMapService"`
+}
+
+// tmsServiceHeader TileMapService reference of the root document.
+type tmsServiceHeader struct {
+	Title   string `xml:"title,attr"`
+	Version string `xml:"version,attr"`
+	Href    string `xml:"href,attr"`
+}
+
+// tmsTileMapService TileMapService document listing TileMaps.
+type tmsTileMapService struct {
+	XMLName  xml.Name           `xml:"TileMapService"`
+	Version  string             `xml:"version,attr"`
+	Services string             `xml:"services,attr"`
+	Title    string             `xml:"Title"`
+	Abstract string             `xml:"Abstract"`
+	TileMaps []tmsTileMapHeader `xml:"TileMaps>TileMap"`
+}
+
+// tmsTileMapHeader TileMap reference of the TileMapService document.
+type tmsTileMapHeader struct {
+	Title   string `xml:"title,attr"`
+	SRS     string `xml:"srs,attr"`
+	Profile string `xml:"profile,attr"`
+	Href    string `xml:"href,attr"`
+}
+
+// tmsTileMap TileMap document of a layer.
+type tmsTileMap struct {
+	XMLName        xml.Name       `xml:"TileMap"`
+	Version        string         `xml:"version,attr"`
+	TileMapService string         `xml:"tilemapservice,attr"`
+	Title          string         `xml:"Title"`
+	Abstract       string         `xml:"Abstract"`
+	SRS            string         `xml:"SRS"`
+	BoundingBox    tmsBoundingBox `xml:"BoundingBox"`
+	Origin         tmsOrigin      `xml:"Origin"`
+	TileFormat     tmsTileFormat  `xml:"TileFormat"`
+	TileSets       tmsTileSets    `xml:"TileSets"`
+}
+
+// tmsBoundingBox bounds in SRS units.
+type tmsBoundingBox struct {
+	MinX float64 `xml:"minx,attr"`
+	MinY float64 `xml:"miny,attr"`
+	MaxX float64 `xml:"maxx,attr"`
+	MaxY float64 `xml:"maxy,attr"`
+}
+
+// tmsOrigin origin of tile rows and columns in SRS units.
+type tmsOrigin struct {
+	X float64 `xml:"x,attr"`
+	Y float64 `xml:"y,attr"`
+}
+
+// tmsTileFormat size and format of tiles.
+type tmsTileFormat struct {
+	Width     int    `xml:"width,attr"`
+	Height    int    `xml:"height,attr"`
+	MimeType  string `xml:"mime-type,attr"`
+	Extension string `xml:"extension,attr"`
+}
+
+// tmsTileSets zoom levels of a TileMap.
+type tmsTileSets struct {
+	Profile  string       `xml:"profile,attr"`
+	TileSets []tmsTileSet `xml:"TileSet"`
+}
+
+// tmsTileSet zoom level of a TileMap.
+type tmsTileSet struct {
+	Href          string  `xml:"href,attr"`
+	UnitsPerPixel float64 `xml:"units-per-pixel,attr"`
+	Order         int     `xml:"order,attr"`
+}
+
 // TMSErrorTile returns error response
 func TMSErrorTile(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -13,57 +100,66 @@ func TMSErrorTile(w http.ResponseWriter, r *http.Request) {
 	Ligneous.Info(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
 }
 
-// TMSRootHandler root handler for tms server.
-func TMSRootHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var tree = `<?xml version="1.0" encoding="utf-8" ?>
-				 <Services>
-				 	<TileMapService title="` + SERVER_NAME + ` Tile Map Service" version="1.0" href="http:127.0.0.1/tms/1.0"/>
-				 </Services>`
-	status := SendXMLResponseFromString(tree, w, r)
+// TMSRootHandler returns TMS root document.
+func TMSRootHandler(start time.Time, base string, w http.ResponseWriter, r *http.Request) {
+	services := tmsServices{
+		TileMapServices: []tmsServiceHeader{{
+			Title:   SERVER_NAME + " Tile Map Service",
+			Version: "1.0.0",
+			Href:    base + "/tms/1.0",
+		}},
+	}
+	status := SendXMLResponseFromInterface(w, r, services)
 	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
 }
 
 // TMSTileMaps returns list of available TileMaps.
-func TMSTileMaps(start time.Time, lyrs []string, w http.ResponseWriter, r *http.Request) {
-	var TileMaps = ``
+func TMSTileMaps(start time.Time, base string, lyrs []string, w http.ResponseWriter, r *http.Request) {
+	service := tmsTileMapService{
+		Version:  "1.0.0",
+		Services: base + "/",
+		Title:    SERVER_NAME + " Tile Map Service",
+		TileMaps: []tmsTileMapHeader{},
+	}
 	for _, lyr := range lyrs {
-		TileMaps += `<TileMap title="` + lyr + `" srs="EPSG:4326" href="http:127.0.0.1:8080` + r.URL.Path + `/` + lyr + `"></TileMap>`
+		service.TileMaps = append(service.TileMaps, tmsTileMapHeader{
+			Title:   lyr,
+			SRS:     tmsSRS,
+			Profile: tmsProfile,
+			Href:    base + "/tms/1.0/" + lyr,
+		})
 	}
-	var tree = `<?xml version="1.0" encoding="utf-8" ?>
-				 <TileMapService version="1.0" services="http:127.0.0.1:8080` + r.URL.Path + `">
-				 	<Abstract></Abstract>
-					<TileMaps>
-						` + TileMaps + `
-					</TileMaps>
-				 </TileMapService>`
-	status := SendXMLResponseFromString(tree, w, r)
+	status := SendXMLResponseFromInterface(w, r, service)
 	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
 }
 
 // TMSTileMap returns list of TileSets for layer.
-func TMSTileMap(start time.Time, lyr string, source string, w http.ResponseWriter, r *http.Request) {
-	var TileSets = ``
-	for i := 0; i < 21; i++ {
-		TileSets += `<TileSet
-						href="` + fmt.Sprintf("http:127.0.0.1:8080%v/%v", r.URL.Path, i) + `"
-						units-per-pixel="` + fmt.Sprintf("%v", unitsPerPixel(i)) + `"
-						order="` + fmt.Sprintf("%v", i) + `">
-					</TileSet>`
+func TMSTileMap(start time.Time, base string, lyr string, config LayerConfig, w http.ResponseWriter, r *http.Request) {
+	min := fromLLtoMercator([2]float64{config.Bounds[0], config.Bounds[1]})
+	max := fromLLtoMercator([2]float64{config.Bounds[2], config.Bounds[3]})
+	tileMap := tmsTileMap{
+		Version:        "1.0.0",
+		TileMapService: base + "/tms/1.0",
+		Title:          lyr,
+		Abstract:       config.Description,
+		SRS:            tmsSRS,
+		BoundingBox:    tmsBoundingBox{min[0], min[1], max[0], max[1]},
+		Origin:         tmsOrigin{-mercatorExtent, -mercatorExtent},
+		TileFormat: tmsTileFormat{
+			Width:     config.TileSize,
+			Height:    config.TileSize,
+			MimeType:  config.MimeType(),
+			Extension: config.Format,
+		},
+		TileSets: tmsTileSets{Profile: tmsProfile},
+	}
+	for i := config.MinZoom; i <= config.MaxZoom; i++ {
+		tileMap.TileSets.TileSets = append(tileMap.TileSets.TileSets, tmsTileSet{
+			Href:          fmt.Sprintf("%v/tms/1.0/%v/%v", base, lyr, i),
+			UnitsPerPixel: mercatorResolution(i, config.TileSize),
+			Order:         i,
+		})
 	}
-	var tree = `<?xml version="1.0" encoding="utf-8" ?>
-				 <TileMap version="1.0" services="http:127.0.0.1:8080` + r.URL.Path + `">
-				 	<Title>` + lyr + `</Title>
-                    <Source>` + source + `</Source>
-					<Abstract></Abstract>
-					<SRS>EPSG:4326</SRS>
-					<BoundingBox minx="-180" miny="-90" maxx="180" max="90"></BoundingBox>
-					<Origin x="-180" y="-90"></Origin>
-					<TileFormat width="256" height="256" mime-type="image/png" extension="png"></TileFormat>
-					<TileSets profile="global-geodetic">
-						` + TileSets + `
-					</TileSets>
-				 </TileMap>`
-	status := SendXMLResponseFromString(tree, w, r)
+	status := SendXMLResponseFromInterface(w, r, tileMap)
 	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
 }
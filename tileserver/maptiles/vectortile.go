@@ -0,0 +1,673 @@
+package maptiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+import "mapnik"
+
+// Mapbox Vector Tile 2.1 settings.
+// https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+const (
+	mvtVersion    = 2
+	mvtExtent     = 4096
+	mvtMimeType   = "application/vnd.mapbox-vector-tile"
+	mvtPoint      = 1
+	mvtLineString = 2
+	mvtPolygon    = 3
+	mvtMoveTo     = 1
+	mvtLineTo     = 2
+	mvtClosePath  = 7
+)
+
+// Protocol buffers wire types.
+const (
+	pbfVarint  = 0
+	pbfFixed64 = 1
+	pbfBytes   = 2
+)
+
+// geoJSONFeature feature returned by mapnik feature queries.
+type geoJSONFeature struct {
+	ID         interface{}            `json:"id"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// geoJSONGeometry geometry of a feature, coordinates are decoded
+// once the type is known.
+type geoJSONGeometry struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []geoJSONGeometry `json:"geometries"`
+}
+
+// tilePoint point in tile coordinates.
+type tilePoint [2]float64
+
+// tileGeometry feature geometry in tile coordinates. Points have a single
+// part, lines a part per line string and polygons a list of rings per
+// polygon, the first ring being the exterior ring.
+type tileGeometry struct {
+	Type     int
+	Points   []tilePoint
+	Lines    [][]tilePoint
+	Polygons [][][]tilePoint
+}
+
+// tileTransform projects WGS84 coordinates to tile coordinates.
+type tileTransform struct {
+	minx, maxy, scale float64
+}
+
+// newTileTransform creates transform to the coordinates of tile x, y at zoom.
+func newTileTransform(zoom, x, y uint64) tileTransform {
+	size := 2 * mercatorExtent / math.Pow(2, float64(zoom))
+	return tileTransform{
+		minx:  -mercatorExtent + float64(x)*size,
+		maxy:  mercatorExtent - float64(y)*size,
+		scale: mvtExtent / size,
+	}
+}
+
+// point projects lon, lat to tile coordinates, y pointing down.
+func (self tileTransform) point(ll []float64) tilePoint {
+	m := fromLLtoMercator([2]float64{ll[0], ll[1]})
+	return tilePoint{(m[0] - self.minx) * self.scale, (self.maxy - m[1]) * self.scale}
+}
+
+// line projects a list of coordinates.
+func (self tileTransform) line(coords [][]float64) []tilePoint {
+	line := make([]tilePoint, 0, len(coords))
+	for _, c := range coords {
+		if 2 <= len(c) {
+			line = append(line, self.point(c))
+		}
+	}
+	return line
+}
+
+// addGeometry decodes GeoJSON geometry into tile coordinates.
+func (self tileTransform) addGeometry(g *tileGeometry, geometry geoJSONGeometry) error {
+	switch geometry.Type {
+	case "Point":
+		var c []float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		if 2 <= len(c) {
+			g.Type = mvtPoint
+			g.Points = append(g.Points, self.point(c))
+		}
+	case "MultiPoint":
+		var c [][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		g.Type = mvtPoint
+		g.Points = append(g.Points, self.line(c)...)
+	case "LineString":
+		var c [][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		g.Type = mvtLineString
+		g.Lines = append(g.Lines, self.line(c))
+	case "MultiLineString":
+		var c [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		g.Type = mvtLineString
+		for _, part := range c {
+			g.Lines = append(g.Lines, self.line(part))
+		}
+	case "Polygon":
+		var c [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		g.Type = mvtPolygon
+		g.Polygons = append(g.Polygons, self.polygon(c))
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &c); nil != err {
+			return err
+		}
+		g.Type = mvtPolygon
+		for _, polygon := range c {
+			g.Polygons = append(g.Polygons, self.polygon(polygon))
+		}
+	case "GeometryCollection":
+		// vector tile features have a single geometry type,
+		// the first type of the collection is kept
+		for _, part := range geometry.Geometries {
+			var p tileGeometry
+			if err := self.addGeometry(&p, part); nil != err {
+				return err
+			}
+			if 0 == g.Type {
+				g.Type = p.Type
+			}
+			if p.Type == g.Type {
+				g.Points = append(g.Points, p.Points...)
+				g.Lines = append(g.Lines, p.Lines...)
+				g.Polygons = append(g.Polygons, p.Polygons...)
+			}
+		}
+	}
+	return nil
+}
+
+// polygon projects the rings of a polygon.
+func (self tileTransform) polygon(rings [][][]float64) [][]tilePoint {
+	polygon := make([][]tilePoint, 0, len(rings))
+	for _, ring := range rings {
+		polygon = append(polygon, self.line(ring))
+	}
+	return polygon
+}
+
+// clipBox tile area with buffer, in tile coordinates.
+type clipBox struct {
+	min, max float64
+}
+
+// contains checks if point is inside the clip box.
+func (self clipBox) contains(p tilePoint) bool {
+	return p[0] >= self.min && p[0] <= self.max && p[1] >= self.min && p[1] <= self.max
+}
+
+// clipSegment clips line segment a, b with the Liang-Barsky algorithm.
+func (self clipBox) clipSegment(a, b tilePoint) (tilePoint, tilePoint, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	for _, edge := range [4][2]float64{
+		{-dx, a[0] - self.min},
+		{dx, self.max - a[0]},
+		{-dy, a[1] - self.min},
+		{dy, self.max - a[1]},
+	} {
+		p, q := edge[0], edge[1]
+		if 0 == p {
+			if q < 0 {
+				return a, b, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return a, b, false
+			}
+			t0 = math.Max(t0, r)
+		} else {
+			if r < t0 {
+				return a, b, false
+			}
+			t1 = math.Min(t1, r)
+		}
+	}
+	return tilePoint{a[0] + t0*dx, a[1] + t0*dy}, tilePoint{a[0] + t1*dx, a[1] + t1*dy}, true
+}
+
+// clipLine clips line, parts leaving and entering the box are split.
+func (self clipBox) clipLine(line []tilePoint) [][]tilePoint {
+	var parts [][]tilePoint
+	var part []tilePoint
+	for i := 1; i < len(line); i++ {
+		a, b, ok := self.clipSegment(line[i-1], line[i])
+		if !ok {
+			if 0 != len(part) {
+				parts = append(parts, part)
+				part = nil
+			}
+			continue
+		}
+		if 0 == len(part) {
+			part = append(part, a)
+		}
+		part = append(part, b)
+		if b != line[i] {
+			// segment leaves the box
+			parts = append(parts, part)
+			part = nil
+		}
+	}
+	if 0 != len(part) {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// clipRing clips polygon ring with the Sutherland-Hodgman algorithm.
+func (self clipBox) clipRing(ring []tilePoint) []tilePoint {
+	inside := []func(p tilePoint) bool{
+		func(p tilePoint) bool { return p[0] >= self.min },
+		func(p tilePoint) bool { return p[0] <= self.max },
+		func(p tilePoint) bool { return p[1] >= self.min },
+		func(p tilePoint) bool { return p[1] <= self.max },
+	}
+	intersect := []func(a, b tilePoint) tilePoint{
+		func(a, b tilePoint) tilePoint { return intersectX(a, b, self.min) },
+		func(a, b tilePoint) tilePoint { return intersectX(a, b, self.max) },
+		func(a, b tilePoint) tilePoint { return intersectY(a, b, self.min) },
+		func(a, b tilePoint) tilePoint { return intersectY(a, b, self.max) },
+	}
+	for i := range inside {
+		if 0 == len(ring) {
+			break
+		}
+		var clipped []tilePoint
+		prev := ring[len(ring)-1]
+		for _, p := range ring {
+			if inside[i](p) {
+				if !inside[i](prev) {
+					clipped = append(clipped, intersect[i](prev, p))
+				}
+				clipped = append(clipped, p)
+			} else if inside[i](prev) {
+				clipped = append(clipped, intersect[i](prev, p))
+			}
+			prev = p
+		}
+		ring = clipped
+	}
+	return ring
+}
+
+// intersectX intersects segment a, b with vertical line at x.
+func intersectX(a, b tilePoint, x float64) tilePoint {
+	return tilePoint{x, a[1] + (b[1]-a[1])*(x-a[0])/(b[0]-a[0])}
+}
+
+// intersectY intersects segment a, b with horizontal line at y.
+func intersectY(a, b tilePoint, y float64) tilePoint {
+	return tilePoint{a[0] + (b[0]-a[0])*(y-a[1])/(b[1]-a[1]), y}
+}
+
+// integerLine rounds points to integer tile coordinates
+// and removes repeated points.
+func integerLine(line []tilePoint) [][2]int64 {
+	points := make([][2]int64, 0, len(line))
+	for _, p := range line {
+		q := [2]int64{int64(math.Floor(p[0] + 0.5)), int64(math.Floor(p[1] + 0.5))}
+		if 0 == len(points) || points[len(points)-1] != q {
+			points = append(points, q)
+		}
+	}
+	return points
+}
+
+// integerRing rounds ring points, the closing point is removed.
+func integerRing(ring []tilePoint) [][2]int64 {
+	points := integerLine(ring)
+	if 1 < len(points) && points[0] == points[len(points)-1] {
+		points = points[:len(points)-1]
+	}
+	return points
+}
+
+// ringArea returns signed area of ring with the surveyor's formula,
+// positive for clockwise rings in tile coordinates.
+func ringArea(ring [][2]int64) int64 {
+	var area int64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return area
+}
+
+// reverseRing reverses the winding order of ring.
+func reverseRing(ring [][2]int64) {
+	for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+		ring[i], ring[j] = ring[j], ring[i]
+	}
+}
+
+// geometryEncoder encodes geometry commands with a cursor
+// shared by all parts of a feature.
+type geometryEncoder struct {
+	x, y     int64
+	commands []uint32
+}
+
+// command appends command with count.
+func (self *geometryEncoder) command(id uint32, count int) {
+	self.commands = append(self.commands, id&0x7|uint32(count)<<3)
+}
+
+// moves appends parameters of points relative to the cursor.
+func (self *geometryEncoder) moves(points [][2]int64) {
+	for _, p := range points {
+		self.commands = append(self.commands, uint32(zigzag(p[0]-self.x)), uint32(zigzag(p[1]-self.y)))
+		self.x, self.y = p[0], p[1]
+	}
+}
+
+// encodeGeometry clips geometry to box and encodes it as vector tile
+// commands, returns nil if nothing of the geometry is left.
+func encodeGeometry(g tileGeometry, box clipBox) []uint32 {
+	e := geometryEncoder{}
+	switch g.Type {
+	case mvtPoint:
+		var points []tilePoint
+		for _, p := range g.Points {
+			if box.contains(p) {
+				points = append(points, p)
+			}
+		}
+		if 0 != len(points) {
+			e.command(mvtMoveTo, len(points))
+			e.moves(integerLine(points))
+		}
+	case mvtLineString:
+		for _, line := range g.Lines {
+			for _, part := range box.clipLine(line) {
+				points := integerLine(part)
+				if 2 > len(points) {
+					continue
+				}
+				e.command(mvtMoveTo, 1)
+				e.moves(points[:1])
+				e.command(mvtLineTo, len(points)-1)
+				e.moves(points[1:])
+			}
+		}
+	case mvtPolygon:
+		for _, polygon := range g.Polygons {
+			for i, ring := range polygon {
+				points := integerRing(box.clipRing(ring))
+				area := ringArea(points)
+				if 3 > len(points) || 0 == area {
+					if 0 == i {
+						// holes of a missing exterior ring are dropped
+						break
+					}
+					continue
+				}
+				// exterior rings have positive, interior rings negative area
+				if (0 == i) != (area > 0) {
+					reverseRing(points)
+				}
+				e.command(mvtMoveTo, 1)
+				e.moves(points[:1])
+				e.command(mvtLineTo, len(points)-1)
+				e.moves(points[1:])
+				e.command(mvtClosePath, 1)
+			}
+		}
+	}
+	return e.commands
+}
+
+// zigzag encodes signed integers for protocol buffers.
+func zigzag(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+// appendVarint appends protocol buffers varint.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendTag appends field number and wire type.
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+// appendBytes appends length delimited field.
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, pbfBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendPacked appends packed repeated uint32 field.
+func appendPacked(b []byte, field int, values []uint32) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = appendVarint(packed, uint64(v))
+	}
+	return appendBytes(b, field, packed)
+}
+
+// mvtValue attribute value of a vector tile layer.
+type mvtValue struct {
+	kind int
+	s    string
+	d    float64
+	u    uint64
+	i    int64
+	b    bool
+}
+
+// newMVTValue converts a GeoJSON property, objects and arrays are kept
+// as json strings. Returns false for null values.
+func newMVTValue(value interface{}) (mvtValue, bool) {
+	switch v := value.(type) {
+	case nil:
+		return mvtValue{}, false
+	case string:
+		return mvtValue{kind: 1, s: v}, true
+	case bool:
+		return mvtValue{kind: 7, b: v}, true
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			if v >= 0 {
+				return mvtValue{kind: 5, u: uint64(v)}, true
+			}
+			return mvtValue{kind: 6, i: int64(v)}, true
+		}
+		return mvtValue{kind: 3, d: v}, true
+	default:
+		b, err := json.Marshal(v)
+		if nil != err {
+			return mvtValue{}, false
+		}
+		return mvtValue{kind: 1, s: string(b)}, true
+	}
+}
+
+// encode encodes value message.
+func (self mvtValue) encode() []byte {
+	var b []byte
+	switch self.kind {
+	case 1:
+		b = appendBytes(b, 1, []byte(self.s))
+	case 3:
+		b = appendTag(b, 3, pbfFixed64)
+		bits := math.Float64bits(self.d)
+		for i := uint(0); i < 8; i++ {
+			b = append(b, byte(bits>>(8*i)))
+		}
+	case 5:
+		b = appendTag(b, 5, pbfVarint)
+		b = appendVarint(b, self.u)
+	case 6:
+		b = appendTag(b, 6, pbfVarint)
+		b = appendVarint(b, zigzag(self.i))
+	case 7:
+		b = appendTag(b, 7, pbfVarint)
+		if self.b {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+// mvtLayer vector tile layer with deduplicated keys and values.
+type mvtLayer struct {
+	name     string
+	keys     []string
+	keyIds   map[string]uint32
+	values   []mvtValue
+	valueIds map[mvtValue]uint32
+	features [][]byte
+}
+
+// newMVTLayer creates empty vector tile layer.
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{
+		name:     name,
+		keyIds:   make(map[string]uint32),
+		valueIds: make(map[mvtValue]uint32),
+	}
+}
+
+// addFeature clips and adds feature to layer.
+func (self *mvtLayer) addFeature(feature geoJSONFeature, transform tileTransform, box clipBox) error {
+	if nil == feature.Geometry {
+		return nil
+	}
+	var g tileGeometry
+	if err := transform.addGeometry(&g, *feature.Geometry); nil != err {
+		return err
+	}
+	commands := encodeGeometry(g, box)
+	if 0 == len(commands) {
+		return nil
+	}
+
+	// properties are sorted for reproducible tiles
+	var names []string
+	for name := range feature.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var tags []uint32
+	for _, name := range names {
+		value, ok := newMVTValue(feature.Properties[name])
+		if !ok {
+			continue
+		}
+		keyId, ok := self.keyIds[name]
+		if !ok {
+			keyId = uint32(len(self.keys))
+			self.keyIds[name] = keyId
+			self.keys = append(self.keys, name)
+		}
+		valueId, ok := self.valueIds[value]
+		if !ok {
+			valueId = uint32(len(self.values))
+			self.valueIds[value] = valueId
+			self.values = append(self.values, value)
+		}
+		tags = append(tags, keyId, valueId)
+	}
+
+	var b []byte
+	if id, ok := feature.ID.(float64); ok && id >= 0 && id == math.Trunc(id) {
+		b = appendTag(b, 1, pbfVarint)
+		b = appendVarint(b, uint64(id))
+	}
+	if 0 != len(tags) {
+		b = appendPacked(b, 2, tags)
+	}
+	b = appendTag(b, 3, pbfVarint)
+	b = appendVarint(b, uint64(g.Type))
+	b = appendPacked(b, 4, commands)
+	self.features = append(self.features, b)
+	return nil
+}
+
+// encode encodes layer message.
+func (self *mvtLayer) encode() []byte {
+	var b []byte
+	b = appendTag(b, 15, pbfVarint)
+	b = appendVarint(b, mvtVersion)
+	b = appendBytes(b, 1, []byte(self.name))
+	for _, feature := range self.features {
+		b = appendBytes(b, 2, feature)
+	}
+	for _, key := range self.keys {
+		b = appendBytes(b, 3, []byte(key))
+	}
+	for _, value := range self.values {
+		b = appendBytes(b, 4, value.encode())
+	}
+	b = appendTag(b, 5, pbfVarint)
+	return appendVarint(b, mvtExtent)
+}
+
+// encodeVectorTile encodes the features of layers within tile zoom, x, y
+// and buffer, features are returned by query as GeoJSON in WGS84.
+// Layers without features are left out.
+func encodeVectorTile(zoom, x, y uint64, buffer float64, layers []string, query func(layer string) ([]json.RawMessage, error)) ([]byte, error) {
+	transform := newTileTransform(zoom, x, y)
+	box := clipBox{min: -buffer, max: mvtExtent + buffer}
+	var tile []byte
+	for _, name := range layers {
+		features, err := query(name)
+		if nil != err {
+			return nil, err
+		}
+		layer := newMVTLayer(name)
+		for _, raw := range features {
+			var feature geoJSONFeature
+			if err := json.Unmarshal(raw, &feature); nil != err {
+				return nil, err
+			}
+			if err := layer.addFeature(feature, transform, box); nil != err {
+				return nil, err
+			}
+		}
+		if 0 != len(layer.features) {
+			tile = appendBytes(tile, 3, layer.encode())
+		}
+	}
+	return tile, nil
+}
+
+// gzipBytes compresses vector tiles, which are stored and served gzipped.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); nil != err {
+		return nil, err
+	}
+	if err := w.Close(); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses vector tiles for clients not accepting gzip.
+func gunzipBytes(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// isGzipped checks for the gzip magic number.
+func isGzipped(data []byte) bool {
+	return 2 <= len(data) && 0x1f == data[0] && 0x8b == data[1]
+}
+
+// vectorLayerNames returns names of the layers of a vector tile layer.
+func vectorLayerNames(config LayerConfig) ([]string, error) {
+	mapSlots <- struct{}{}
+	defer func() { <-mapSlots }()
+
+	m := mapnik.NewMap(uint32(config.TileSize), uint32(config.TileSize))
+	defer m.Free()
+	if err := loadLayerMap(m, config); nil != err {
+		return nil, err
+	}
+	return m.LayerNames(), nil
+}
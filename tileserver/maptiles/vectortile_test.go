@@ -0,0 +1,407 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestZigzag(t *testing.T) {
+	for _, test := range []struct {
+		n    int64
+		want uint64
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{-2, 3},
+		{2, 4},
+		{math.MaxInt32, math.MaxUint32 - 1},
+		{math.MinInt32, math.MaxUint32},
+		{math.MaxInt64, math.MaxUint64 - 1},
+		{math.MinInt64, math.MaxUint64},
+	} {
+		if got := zigzag(test.n); test.want != got {
+			t.Errorf("zigzag(%v) = %v, want %v", test.n, got, test.want)
+		}
+		if got := protowire.DecodeZigZag(zigzag(test.n)); test.n != got {
+			t.Errorf("DecodeZigZag(zigzag(%v)) = %v", test.n, got)
+		}
+	}
+}
+
+func TestAppendVarint(t *testing.T) {
+	for _, test := range []struct {
+		v    uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{math.MaxUint64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	} {
+		got := appendVarint(nil, test.v)
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("appendVarint(%v) = %x, want %x", test.v, got, test.want)
+		}
+		if v, n := protowire.ConsumeVarint(got); test.v != v || len(got) != n {
+			t.Errorf("ConsumeVarint(%x) = %v, %v", got, v, n)
+		}
+	}
+}
+
+func TestEncodeGeometryCommands(t *testing.T) {
+	box := clipBox{min: -64, max: mvtExtent + 64}
+	// examples of the vector tile spec 2.1, section 4.3.5
+	for _, test := range []struct {
+		name string
+		g    tileGeometry
+		want []uint32
+	}{
+		{
+			"point",
+			tileGeometry{Type: mvtPoint, Points: []tilePoint{{25, 17}}},
+			[]uint32{9, 50, 34},
+		},
+		{
+			"multipoint",
+			tileGeometry{Type: mvtPoint, Points: []tilePoint{{5, 7}, {3, 2}}},
+			[]uint32{17, 10, 14, 3, 9},
+		},
+		{
+			"linestring",
+			tileGeometry{Type: mvtLineString, Lines: [][]tilePoint{{{2, 2}, {2, 10}, {10, 10}}}},
+			[]uint32{9, 4, 4, 18, 0, 16, 16, 0},
+		},
+		{
+			"multilinestring",
+			tileGeometry{Type: mvtLineString, Lines: [][]tilePoint{{{2, 2}, {2, 10}, {10, 10}}, {{1, 1}, {3, 5}}}},
+			[]uint32{9, 4, 4, 18, 0, 16, 16, 0, 9, 17, 17, 10, 4, 8},
+		},
+		{
+			"polygon",
+			tileGeometry{Type: mvtPolygon, Polygons: [][][]tilePoint{{{{3, 6}, {8, 12}, {20, 34}, {3, 6}}}}},
+			[]uint32{9, 6, 12, 18, 10, 12, 24, 44, 15},
+		},
+		{
+			"outside",
+			tileGeometry{Type: mvtPoint, Points: []tilePoint{{-100, 17}}},
+			nil,
+		},
+		{
+			"repeated points",
+			tileGeometry{Type: mvtLineString, Lines: [][]tilePoint{{{2, 2}, {2.2, 1.9}}}},
+			nil,
+		},
+	} {
+		if got := encodeGeometry(test.g, box); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%v: encodeGeometry = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGeometryEncoderCommand(t *testing.T) {
+	for _, test := range []struct {
+		id    uint32
+		count int
+		want  uint32
+	}{
+		{mvtMoveTo, 1, 9},
+		{mvtMoveTo, 120, 961},
+		{mvtLineTo, 1, 10},
+		{mvtLineTo, 3, 26},
+		{mvtClosePath, 1, 15},
+	} {
+		e := geometryEncoder{}
+		e.command(test.id, test.count)
+		if got := e.commands[0]; test.want != got {
+			t.Errorf("command(%v, %v) = %v, want %v", test.id, test.count, got, test.want)
+		}
+		if id, count := splitCommand(e.commands[0]); test.id != id || test.count != count {
+			t.Errorf("command %v decodes to %v, %v", e.commands[0], id, count)
+		}
+	}
+}
+
+// splitCommand splits command integer into id and count.
+func splitCommand(command uint32) (uint32, int) {
+	return command & 0x7, int(command >> 3)
+}
+
+// decodeRings decodes polygon commands into rings.
+func decodeRings(t *testing.T, commands []uint32) [][][2]int64 {
+	var rings [][][2]int64
+	var ring [][2]int64
+	var x, y int64
+	for i := 0; i < len(commands); {
+		id, count := splitCommand(commands[i])
+		i++
+		switch id {
+		case mvtMoveTo, mvtLineTo:
+			if mvtMoveTo == id {
+				ring = nil
+			}
+			for ; 0 < count; count-- {
+				x += protowire.DecodeZigZag(uint64(commands[i]))
+				y += protowire.DecodeZigZag(uint64(commands[i+1]))
+				ring = append(ring, [2]int64{x, y})
+				i += 2
+			}
+		case mvtClosePath:
+			rings = append(rings, ring)
+		default:
+			t.Fatalf("Unknown command %v", id)
+		}
+	}
+	return rings
+}
+
+func TestEncodeGeometryWinding(t *testing.T) {
+	box := clipBox{min: -64, max: mvtExtent + 64}
+	clockwise := []tilePoint{{0, 0}, {100, 0}, {100, 100}, {0, 100}, {0, 0}}
+	counterClockwise := []tilePoint{{0, 0}, {0, 100}, {100, 100}, {100, 0}, {0, 0}}
+	holeClockwise := []tilePoint{{25, 25}, {75, 25}, {75, 75}, {25, 75}, {25, 25}}
+	holeCounterClockwise := []tilePoint{{25, 25}, {25, 75}, {75, 75}, {75, 25}, {25, 25}}
+	for _, test := range []struct {
+		name    string
+		polygon [][]tilePoint
+	}{
+		{"clockwise outer", [][]tilePoint{clockwise}},
+		{"counter-clockwise outer", [][]tilePoint{counterClockwise}},
+		{"clockwise outer, counter-clockwise inner", [][]tilePoint{clockwise, holeCounterClockwise}},
+		{"counter-clockwise outer, clockwise inner", [][]tilePoint{counterClockwise, holeClockwise}},
+		{"clockwise outer and inner", [][]tilePoint{clockwise, holeClockwise}},
+	} {
+		g := tileGeometry{Type: mvtPolygon, Polygons: [][][]tilePoint{test.polygon}}
+		rings := decodeRings(t, encodeGeometry(g, box))
+		if len(test.polygon) != len(rings) {
+			t.Errorf("%v: %v rings, want %v", test.name, len(rings), len(test.polygon))
+			continue
+		}
+		// exterior rings are clockwise, interior rings counter-clockwise
+		// in tile coordinates with y pointing down
+		if area := ringArea(rings[0]); area <= 0 {
+			t.Errorf("%v: outer ring area %v", test.name, area)
+		}
+		for _, ring := range rings[1:] {
+			if area := ringArea(ring); area >= 0 {
+				t.Errorf("%v: inner ring area %v", test.name, area)
+			}
+		}
+	}
+
+	// holes of a degenerate exterior ring are dropped
+	g := tileGeometry{Type: mvtPolygon, Polygons: [][][]tilePoint{{{{0, 0}, {100, 0}, {0, 0}}, holeClockwise}}}
+	if commands := encodeGeometry(g, box); 0 != len(commands) {
+		t.Errorf("Degenerate polygon encoded as %v", commands)
+	}
+}
+
+// sameRing checks if ring b equals ring a up to its start point.
+func sameRing(a, b []tilePoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if 0 == len(a) {
+		return true
+	}
+	for offset := range b {
+		same := true
+		for i := range a {
+			same = same && a[i] == b[(i+offset)%len(b)]
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClipRing(t *testing.T) {
+	box := clipBox{min: 0, max: 10}
+	for _, test := range []struct {
+		name string
+		ring []tilePoint
+		want []tilePoint
+	}{
+		{"inside", []tilePoint{{2, 2}, {8, 2}, {8, 8}, {2, 8}}, []tilePoint{{2, 2}, {8, 2}, {8, 8}, {2, 8}}},
+		{"on edges", []tilePoint{{0, 0}, {10, 0}, {10, 10}, {0, 10}}, []tilePoint{{0, 0}, {10, 0}, {10, 10}, {0, 10}}},
+		{"covering", []tilePoint{{-5, -5}, {15, -5}, {15, 15}, {-5, 15}}, []tilePoint{{0, 0}, {10, 0}, {10, 10}, {0, 10}}},
+		{"crossing right edge", []tilePoint{{5, 5}, {15, 5}, {15, 8}, {5, 8}}, []tilePoint{{5, 5}, {10, 5}, {10, 8}, {5, 8}}},
+		{"crossing corner", []tilePoint{{5, 5}, {15, 5}, {15, 15}, {5, 15}}, []tilePoint{{5, 5}, {10, 5}, {10, 10}, {5, 10}}},
+		{"outside", []tilePoint{{12, 12}, {18, 12}, {18, 18}, {12, 18}}, nil},
+		{"around corner outside", []tilePoint{{-5, 5}, {-1, 5}, {-1, -1}, {5, -1}, {5, -5}, {-5, -5}}, nil},
+	} {
+		if got := box.clipRing(test.ring); !sameRing(test.want, got) {
+			t.Errorf("%v: clipRing = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	box := clipBox{min: 0, max: 10}
+	for _, test := range []struct {
+		name string
+		line []tilePoint
+		want [][]tilePoint
+	}{
+		{"inside", []tilePoint{{1, 1}, {5, 5}, {9, 1}}, [][]tilePoint{{{1, 1}, {5, 5}, {9, 1}}}},
+		{"along edge", []tilePoint{{10, 0}, {10, 10}}, [][]tilePoint{{{10, 0}, {10, 10}}}},
+		{"leaving", []tilePoint{{5, 5}, {15, 5}}, [][]tilePoint{{{5, 5}, {10, 5}}}},
+		{"entering", []tilePoint{{-5, 5}, {5, 5}}, [][]tilePoint{{{0, 5}, {5, 5}}}},
+		{"crossing", []tilePoint{{-5, 5}, {15, 5}}, [][]tilePoint{{{0, 5}, {10, 5}}}},
+		{"leaving and entering", []tilePoint{{5, 2}, {15, 2}, {15, 8}, {5, 8}}, [][]tilePoint{{{5, 2}, {10, 2}}, {{10, 8}, {5, 8}}}},
+		{"outside", []tilePoint{{-5, -5}, {-5, 15}}, nil},
+	} {
+		if got := box.clipLine(test.line); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%v: clipLine = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// pbfFields decodes protocol buffers message into fields, packed
+// and length delimited fields are returned as bytes.
+func pbfFields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	fields := make(map[protowire.Number][]interface{})
+	for 0 != len(b) {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value interface{}
+		switch typ {
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("Unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		fields[num] = append(fields[num], value)
+		b = b[n:]
+	}
+	return fields
+}
+
+// pbfPacked decodes packed varints.
+func pbfPacked(t *testing.T, b []byte) []uint32 {
+	var values []uint32
+	for 0 != len(b) {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		values = append(values, uint32(v))
+		b = b[n:]
+	}
+	return values
+}
+
+func TestEncodeVectorTileDecode(t *testing.T) {
+	features := map[string][]json.RawMessage{
+		"places": {
+			json.RawMessage(`{"id": 7, "geometry": {"type": "Point", "coordinates": [0, 0]}, "properties": {"name": "null island", "rank": 3, "area": 1.5, "depth": -2, "visible": true, "missing": null}}`),
+			json.RawMessage(`{"id": 8, "geometry": {"type": "Point", "coordinates": [0, 0]}, "properties": {"name": "null island"}}`),
+		},
+		"areas": {
+			json.RawMessage(`{"geometry": {"type": "Polygon", "coordinates": [[[0, 0], [0, 10], [10, 10], [10, 0], [0, 0]]]}, "properties": {}}`),
+		},
+		"empty": {},
+	}
+	tile, err := encodeVectorTile(0, 0, 0, 64, []string{"places", "areas", "empty"}, func(layer string) ([]json.RawMessage, error) {
+		return features[layer], nil
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	layers := pbfFields(t, tile)[3]
+	if 2 != len(layers) {
+		t.Fatalf("%v layers, want 2", len(layers))
+	}
+
+	places := pbfFields(t, layers[0].([]byte))
+	if "places" != string(places[1][0].([]byte)) {
+		t.Errorf("Layer name %q", places[1][0])
+	}
+	if uint64(mvtVersion) != places[15][0].(uint64) || uint64(mvtExtent) != places[5][0].(uint64) {
+		t.Errorf("Layer version %v, extent %v", places[15][0], places[5][0])
+	}
+	var keys []string
+	for _, key := range places[3] {
+		keys = append(keys, string(key.([]byte)))
+	}
+	if want := []string{"area", "depth", "name", "rank", "visible"}; !reflect.DeepEqual(want, keys) {
+		t.Errorf("Keys %v, want %v", keys, want)
+	}
+	var values []interface{}
+	for _, value := range places[4] {
+		v := pbfFields(t, value.([]byte))
+		switch {
+		case nil != v[1]:
+			values = append(values, string(v[1][0].([]byte)))
+		case nil != v[3]:
+			values = append(values, math.Float64frombits(v[3][0].(uint64)))
+		case nil != v[5]:
+			values = append(values, v[5][0].(uint64))
+		case nil != v[6]:
+			values = append(values, protowire.DecodeZigZag(v[6][0].(uint64)))
+		case nil != v[7]:
+			values = append(values, 0 != v[7][0].(uint64))
+		}
+	}
+	if want := []interface{}{1.5, int64(-2), "null island", uint64(3), true}; !reflect.DeepEqual(want, values) {
+		t.Errorf("Values %v, want %v", values, want)
+	}
+
+	if 2 != len(places[2]) {
+		t.Fatalf("%v features, want 2", len(places[2]))
+	}
+	for i, want := range []struct {
+		id   uint64
+		tags []uint32
+	}{
+		{7, []uint32{0, 0, 1, 1, 2, 2, 3, 3, 4, 4}},
+		{8, []uint32{2, 2}},
+	} {
+		feature := pbfFields(t, places[2][i].([]byte))
+		if want.id != feature[1][0].(uint64) {
+			t.Errorf("Feature id %v, want %v", feature[1][0], want.id)
+		}
+		if tags := pbfPacked(t, feature[2][0].([]byte)); !reflect.DeepEqual(want.tags, tags) {
+			t.Errorf("Feature %v tags %v, want %v", want.id, tags, want.tags)
+		}
+		if uint64(mvtPoint) != feature[3][0].(uint64) {
+			t.Errorf("Feature %v type %v", want.id, feature[3][0])
+		}
+		// lon 0, lat 0 is the center of tile 0/0/0
+		if geometry := pbfPacked(t, feature[4][0].([]byte)); !reflect.DeepEqual([]uint32{9, 4096, 4096}, geometry) {
+			t.Errorf("Feature %v geometry %v", want.id, geometry)
+		}
+	}
+
+	areas := pbfFields(t, layers[1].([]byte))
+	feature := pbfFields(t, areas[2][0].([]byte))
+	if nil != feature[1] || nil != feature[2] {
+		t.Errorf("Polygon without id and properties has id %v, tags %v", feature[1], feature[2])
+	}
+	if uint64(mvtPolygon) != feature[3][0].(uint64) {
+		t.Errorf("Polygon type %v", feature[3][0])
+	}
+	rings := decodeRings(t, pbfPacked(t, feature[4][0].([]byte)))
+	if 1 != len(rings) || 4 != len(rings[0]) || ringArea(rings[0]) <= 0 {
+		t.Errorf("Polygon rings %v", rings)
+	}
+}
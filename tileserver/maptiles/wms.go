@@ -0,0 +1,532 @@
+package maptiles
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "mapnik"
+
+// WMSDefaultMaxSize default maximum width and height of GetMap images.
+const WMSDefaultMaxSize = 4096
+
+// WMS projections of GetMap requests.
+const (
+	wmsMercator = "+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs +over"
+	wmsLongLat  = "+proj=longlat +ellps=WGS84 +datum=WGS84 +no_defs"
+)
+
+// wmsProjections maps supported SRS and CRS codes to proj4 strings.
+var wmsProjections = map[string]string{
+	"EPSG:3857":   wmsMercator,
+	"EPSG:900913": wmsMercator,
+	"EPSG:4326":   wmsLongLat,
+	"CRS:84":      wmsLongLat,
+}
+
+// wmsFormats maps GetMap formats to mapnik image formats.
+var wmsFormats = map[string]string{
+	"image/png":  "png",
+	"image/png8": "png256",
+	"image/jpeg": "jpeg",
+	"image/webp": "webp",
+}
+
+// wmsInfoFormats supported GetFeatureInfo formats.
+var wmsInfoFormats = []string{"application/geo+json", "application/json", "application/vnd.geo+json"}
+
+// mapSlots limits concurrent renderings and feature queries
+// with their own mapnik map.
+var mapSlots = make(chan struct{}, runtime.NumCPU())
+
+// wmsCapabilities WMS 1.1.1 and 1.3.0 capabilities document.
+type wmsCapabilities struct {
+	XMLName    xml.Name
+	Version    string        `xml:"version,attr"`
+	Xmlns      string        `xml:"xmlns,attr,omitempty"`
+	XmlnsXlink string        `xml:"xmlns:xlink,attr"`
+	Service    wmsService    `xml:"Service"`
+	Capability wmsCapability `xml:"Capability"`
+}
+
+// wmsService service description, max size is only part of 1.3.0.
+type wmsService struct {
+	Name           string            `xml:"Name"`
+	Title          string            `xml:"Title"`
+	OnlineResource wmsOnlineResource `xml:"OnlineResource"`
+	MaxWidth       int               `xml:"MaxWidth,omitempty"`
+	MaxHeight      int               `xml:"MaxHeight,omitempty"`
+}
+
+// wmsOnlineResource link of the capabilities document.
+type wmsOnlineResource struct {
+	Type string `xml:"xlink:type,attr"`
+	Href string `xml:"xlink:href,attr"`
+}
+
+// wmsCapability operations and layers.
+type wmsCapability struct {
+	GetCapabilities wmsOperation `xml:"Request>GetCapabilities"`
+	GetMap          wmsOperation `xml:"Request>GetMap"`
+	GetFeatureInfo  wmsOperation `xml:"Request>GetFeatureInfo"`
+	Exceptions      []string     `xml:"Exception>Format"`
+	Layer           wmsLayer     `xml:"Layer"`
+}
+
+// wmsOperation response formats and GET url of an operation.
+type wmsOperation struct {
+	Formats []string          `xml:"Format"`
+	Get     wmsOnlineResource `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+// wmsLayer layer of the capabilities document, the root layer
+// has no name and contains the tile layers.
+type wmsLayer struct {
+	Queryable             int                       `xml:"queryable,attr,omitempty"`
+	Name                  string                    `xml:"Name,omitempty"`
+	Title                 string                    `xml:"Title"`
+	Abstract              string                    `xml:"Abstract,omitempty"`
+	SRS                   []string                  `xml:"SRS,omitempty"`
+	CRS                   []string                  `xml:"CRS,omitempty"`
+	LatLonBoundingBox     *wmsLatLonBoundingBox     `xml:"LatLonBoundingBox,omitempty"`
+	GeographicBoundingBox *wmsGeographicBoundingBox `xml:"EX_GeographicBoundingBox,omitempty"`
+	BoundingBoxes         []wmsBoundingBox          `xml:"BoundingBox"`
+	Layers                []wmsLayer                `xml:"Layer"`
+}
+
+// wmsLatLonBoundingBox WMS 1.1.1 bounds in degrees.
+type wmsLatLonBoundingBox struct {
+	MinX float64 `xml:"minx,attr"`
+	MinY float64 `xml:"miny,attr"`
+	MaxX float64 `xml:"maxx,attr"`
+	MaxY float64 `xml:"maxy,attr"`
+}
+
+// wmsGeographicBoundingBox WMS 1.3.0 bounds in degrees.
+type wmsGeographicBoundingBox struct {
+	West  float64 `xml:"westBoundLongitude"`
+	East  float64 `xml:"eastBoundLongitude"`
+	South float64 `xml:"southBoundLatitude"`
+	North float64 `xml:"northBoundLatitude"`
+}
+
+// wmsBoundingBox bounds in SRS units.
+type wmsBoundingBox struct {
+	SRS  string  `xml:"SRS,attr,omitempty"`
+	CRS  string  `xml:"CRS,attr,omitempty"`
+	MinX float64 `xml:"minx,attr"`
+	MinY float64 `xml:"miny,attr"`
+	MaxX float64 `xml:"maxx,attr"`
+	MaxY float64 `xml:"maxy,attr"`
+}
+
+// wmsExceptionReport WMS service error.
+type wmsExceptionReport struct {
+	XMLName   xml.Name     `xml:"ServiceExceptionReport"`
+	Version   string       `xml:"version,attr"`
+	Xmlns     string       `xml:"xmlns,attr,omitempty"`
+	Exception wmsException `xml:"ServiceException"`
+}
+
+// wmsException error code and message.
+type wmsException struct {
+	Code string `xml:"code,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// WMSMapRequest GetMap request of a mapnik layer.
+// BBox is given in SRS units with x before y.
+type WMSMapRequest struct {
+	SRS         string
+	BBox        [4]float64
+	Width       int
+	Height      int
+	Format      string
+	Transparent bool
+	BgColor     color.NRGBA
+}
+
+// wmsVersion returns the supported WMS version closest to version.
+func wmsVersion(version string) string {
+	if strings.HasPrefix(version, "1.1") {
+		return "1.1.1"
+	}
+	return "1.3.0"
+}
+
+// wmsLayers returns mapnik stylesheet layers, proxy layers
+// can not be rendered for arbitrary bounding boxes.
+func wmsLayers(lmp *LayerMultiplex) map[string]LayerConfig {
+	layers := lmp.LayerConfigs()
+	for name, config := range layers {
+		if !config.IsStylesheet() {
+			delete(layers, name)
+		}
+	}
+	return layers
+}
+
+// newWMSCapabilities creates capabilities document of mapnik layers.
+func newWMSCapabilities(base string, version string, maxSize int, layers map[string]LayerConfig) wmsCapabilities {
+	online := wmsOnlineResource{Type: "simple", Href: base + "/wms?"}
+	capabilities := wmsCapabilities{
+		Version:    version,
+		XmlnsXlink: xlinkNamespace,
+		Service: wmsService{
+			Name:           "WMS",
+			Title:          SERVER_NAME + " Web Map Service",
+			OnlineResource: online,
+		},
+		Capability: wmsCapability{
+			GetCapabilities: wmsOperation{Get: online},
+			GetMap:          wmsOperation{Get: online},
+			GetFeatureInfo:  wmsOperation{Formats: wmsInfoFormats, Get: online},
+			Layer:           wmsLayer{Title: SERVER_NAME},
+		},
+	}
+
+	var codes []string
+	for code := range wmsProjections {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	if "1.1.1" == version {
+		capabilities.XMLName = xml.Name{Local: "WMT_MS_Capabilities"}
+		capabilities.Service.Name = "OGC:WMS"
+		capabilities.Capability.GetCapabilities.Formats = []string{"application/vnd.ogc.wms_xml"}
+		capabilities.Capability.Exceptions = []string{"application/vnd.ogc.se_xml"}
+		capabilities.Capability.Layer.SRS = codes
+	} else {
+		capabilities.XMLName = xml.Name{Local: "WMS_Capabilities"}
+		capabilities.Xmlns = "http://www.opengis.net/wms"
+		capabilities.Service.MaxWidth = maxSize
+		capabilities.Service.MaxHeight = maxSize
+		capabilities.Capability.GetCapabilities.Formats = []string{"text/xml"}
+		capabilities.Capability.Exceptions = []string{"XML"}
+		capabilities.Capability.Layer.CRS = codes
+	}
+
+	for format := range wmsFormats {
+		capabilities.Capability.GetMap.Formats = append(capabilities.Capability.GetMap.Formats, format)
+	}
+	sort.Strings(capabilities.Capability.GetMap.Formats)
+
+	var names []string
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config := layers[name]
+		min := fromLLtoMercator([2]float64{config.Bounds[0], config.Bounds[1]})
+		max := fromLLtoMercator([2]float64{config.Bounds[2], config.Bounds[3]})
+		layer := wmsLayer{
+			Queryable: 1,
+			Name:      name,
+			Title:     name,
+			Abstract:  config.Description,
+		}
+		if "1.1.1" == version {
+			layer.LatLonBoundingBox = &wmsLatLonBoundingBox{config.Bounds[0], config.Bounds[1], config.Bounds[2], config.Bounds[3]}
+			layer.BoundingBoxes = []wmsBoundingBox{{SRS: "EPSG:3857", MinX: min[0], MinY: min[1], MaxX: max[0], MaxY: max[1]}}
+		} else {
+			layer.GeographicBoundingBox = &wmsGeographicBoundingBox{config.Bounds[0], config.Bounds[2], config.Bounds[1], config.Bounds[3]}
+			layer.BoundingBoxes = []wmsBoundingBox{{CRS: "EPSG:3857", MinX: min[0], MinY: min[1], MaxX: max[0], MaxY: max[1]}}
+		}
+		capabilities.Capability.Layer.Layers = append(capabilities.Capability.Layer.Layers, layer)
+	}
+	return capabilities
+}
+
+// sendWMSException sends WMS exception report of the requested version.
+func sendWMSException(w http.ResponseWriter, version string, status int, code string, text string) {
+	report := wmsExceptionReport{
+		Version:   version,
+		Exception: wmsException{Code: code, Text: text},
+	}
+	contentType := "application/vnd.ogc.se_xml"
+	if "1.3.0" == version {
+		report.Xmlns = "http://www.opengis.net/ogc"
+		contentType = "text/xml"
+	}
+	x, err := xml.MarshalIndent(report, "", "  ")
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header + string(x)))
+}
+
+// parseWMSColor parses a BGCOLOR value, e.g. 0xFFFFFF.
+func parseWMSColor(value string) (color.NRGBA, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	if 6 != len(value) {
+		return color.NRGBA{}, errors.New("Invalid color")
+	}
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if nil != err {
+		return color.NRGBA{}, errors.New("Invalid color")
+	}
+	return color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
+
+// parseWMSExtent parses projection, bounding box and size of GetMap and
+// GetFeatureInfo requests, returns the WMS exception code and message
+// of invalid requests.
+func parseWMSExtent(params map[string]string, version string, maxSize int) (WMSMapRequest, string, error) {
+	req := WMSMapRequest{BgColor: color.NRGBA{255, 255, 255, 255}}
+
+	srsParam := "SRS"
+	srsCode := "InvalidSRS"
+	if "1.3.0" == version {
+		srsParam = "CRS"
+		srsCode = "InvalidCRS"
+	}
+	srs := strings.ToUpper(params[srsParam])
+	proj, ok := wmsProjections[srs]
+	if !ok {
+		return req, srsCode, fmt.Errorf("Unsupported %v: %v", srsParam, params[srsParam])
+	}
+	req.SRS = proj
+
+	bbox := strings.Split(params["BBOX"], ",")
+	if 4 != len(bbox) {
+		return req, "", fmt.Errorf("Invalid BBOX: %v", params["BBOX"])
+	}
+	for i := range bbox {
+		value, err := strconv.ParseFloat(strings.TrimSpace(bbox[i]), 64)
+		if nil != err {
+			return req, "", fmt.Errorf("Invalid BBOX: %v", params["BBOX"])
+		}
+		req.BBox[i] = value
+	}
+	if "1.3.0" == version && "EPSG:4326" == srs {
+		// WMS 1.3.0 uses latitude, longitude axis order for EPSG:4326
+		req.BBox = [4]float64{req.BBox[1], req.BBox[0], req.BBox[3], req.BBox[2]}
+	}
+	if req.BBox[0] >= req.BBox[2] || req.BBox[1] >= req.BBox[3] {
+		return req, "", fmt.Errorf("Invalid BBOX: %v", params["BBOX"])
+	}
+
+	var err error
+	req.Width, err = strconv.Atoi(params["WIDTH"])
+	if nil != err || req.Width < 1 || req.Width > maxSize {
+		return req, "", fmt.Errorf("WIDTH must be between 1 and %v", maxSize)
+	}
+	req.Height, err = strconv.Atoi(params["HEIGHT"])
+	if nil != err || req.Height < 1 || req.Height > maxSize {
+		return req, "", fmt.Errorf("HEIGHT must be between 1 and %v", maxSize)
+	}
+	return req, "", nil
+}
+
+// parseWMSMapRequest parses GetMap parameters, returns the WMS
+// exception code and message of invalid requests.
+func parseWMSMapRequest(params map[string]string, version string, maxSize int) (WMSMapRequest, string, error) {
+	req, code, err := parseWMSExtent(params, version, maxSize)
+	if nil != err {
+		return req, code, err
+	}
+
+	req.Format = params["FORMAT"]
+	if _, ok := wmsFormats[req.Format]; !ok {
+		return req, "InvalidFormat", fmt.Errorf("Unsupported FORMAT: %v", req.Format)
+	}
+
+	req.Transparent = strings.EqualFold("TRUE", params["TRANSPARENT"])
+	if bgcolor := params["BGCOLOR"]; "" != bgcolor {
+		req.BgColor, err = parseWMSColor(bgcolor)
+		if nil != err {
+			return req, "", fmt.Errorf("Invalid BGCOLOR: %v", bgcolor)
+		}
+	}
+	return req, "", nil
+}
+
+// RenderWMSMap renders a map image of a mapnik layer.
+// Renderings take a mapnik map of the layer from maps, concurrent
+// renderings are limited to the number of CPUs. The image shows
+// exactly the bounding box, stretched if the aspect ratios differ.
+func RenderWMSMap(maps *MapPool, req WMSMapRequest) ([]byte, error) {
+	mapSlots <- struct{}{}
+	defer func() { <-mapSlots }()
+
+	m, err := maps.Get(req.Width, req.Height)
+	if nil != err {
+		return nil, err
+	}
+	defer maps.Put(m)
+
+	background := req.BgColor
+	if req.Transparent {
+		background.A = 0
+	}
+	m.SetBackgroundColor(background)
+	m.SetSRS(req.SRS)
+	m.SetBufferSize(maps.Config().BufferSize)
+	m.SetAspectFixMode(mapnik.Respect)
+	m.ZoomToMinMax(req.BBox[0], req.BBox[1], req.BBox[2], req.BBox[3])
+	return m.RenderToMemory(wmsFormats[req.Format])
+}
+
+// serveWMSMap serves GetMap request.
+func serveWMSMap(lmp *LayerMultiplex, params map[string]string, version string, maxSize int, w http.ResponseWriter, r *http.Request) int {
+	lyrs := params["LAYERS"]
+	if "" == lyrs {
+		sendWMSException(w, version, http.StatusBadRequest, "LayerNotDefined", "Missing LAYERS")
+		return http.StatusBadRequest
+	}
+	if strings.Contains(lyrs, ",") {
+		sendWMSException(w, version, http.StatusBadRequest, "", "Only one layer per request is supported")
+		return http.StatusBadRequest
+	}
+	maps, ok := lmp.MapPool(lyrs)
+	if !ok {
+		sendWMSException(w, version, http.StatusBadRequest, "LayerNotDefined", "Unknown layer: "+lyrs)
+		return http.StatusBadRequest
+	}
+	if style := params["STYLES"]; "" != style && "default" != style {
+		sendWMSException(w, version, http.StatusBadRequest, "StyleNotDefined", "Unknown style: "+style)
+		return http.StatusBadRequest
+	}
+
+	req, code, err := parseWMSMapRequest(params, version, maxSize)
+	if nil != err {
+		sendWMSException(w, version, http.StatusBadRequest, code, err.Error())
+		return http.StatusBadRequest
+	}
+
+	blob, err := RenderWMSMap(maps, req)
+	if nil != err {
+		Ligneous.Error("Error while rendering WMS map ", lyrs, ": ", err)
+		sendWMSException(w, version, http.StatusInternalServerError, "", "Unable to render map")
+		return http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", req.Format)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(blob); nil != err {
+		Ligneous.Error(err)
+	}
+	return http.StatusOK
+}
+
+// serveWMSFeatureInfo serves GetFeatureInfo request as GeoJSON.
+func serveWMSFeatureInfo(lmp *LayerMultiplex, params map[string]string, version string, maxSize int, w http.ResponseWriter, r *http.Request) int {
+	lyr := params["QUERY_LAYERS"]
+	if "" == lyr {
+		sendWMSException(w, version, http.StatusBadRequest, "LayerNotDefined", "Missing QUERY_LAYERS")
+		return http.StatusBadRequest
+	}
+	if strings.Contains(lyr, ",") {
+		sendWMSException(w, version, http.StatusBadRequest, "", "Only one query layer per request is supported")
+		return http.StatusBadRequest
+	}
+	maps, ok := lmp.MapPool(lyr)
+	if !ok {
+		sendWMSException(w, version, http.StatusBadRequest, "LayerNotQueryable", "Unknown layer: "+lyr)
+		return http.StatusBadRequest
+	}
+
+	format := params["INFO_FORMAT"]
+	if "" == format {
+		format = wmsInfoFormats[0]
+	}
+	supported := false
+	for _, f := range wmsInfoFormats {
+		supported = supported || f == format
+	}
+	if !supported {
+		sendWMSException(w, version, http.StatusBadRequest, "InvalidFormat", "Unsupported INFO_FORMAT: "+format)
+		return http.StatusBadRequest
+	}
+
+	req, code, err := parseWMSExtent(params, version, maxSize)
+	if nil != err {
+		sendWMSException(w, version, http.StatusBadRequest, code, err.Error())
+		return http.StatusBadRequest
+	}
+
+	xParam, yParam := "X", "Y"
+	if "1.3.0" == version {
+		xParam, yParam = "I", "J"
+	}
+	x, errX := strconv.Atoi(params[xParam])
+	y, errY := strconv.Atoi(params[yParam])
+	if nil != errX || nil != errY || x < 0 || x >= req.Width || y < 0 || y >= req.Height {
+		sendWMSException(w, version, http.StatusBadRequest, "InvalidPoint", fmt.Sprintf("Invalid %v, %v: %v, %v", xParam, yParam, params[xParam], params[yParam]))
+		return http.StatusBadRequest
+	}
+
+	limit := 1
+	if count := params["FEATURE_COUNT"]; "" != count {
+		limit, err = strconv.Atoi(count)
+		if nil != err || limit < 1 {
+			sendWMSException(w, version, http.StatusBadRequest, "", "Invalid FEATURE_COUNT: "+count)
+			return http.StatusBadRequest
+		}
+	}
+
+	features, err := QueryFeatures(maps, FeatureQuery{
+		SRS:    req.SRS,
+		BBox:   req.BBox,
+		Width:  req.Width,
+		Height: req.Height,
+		X:      float64(x),
+		Y:      float64(y),
+		Limit:  limit,
+	})
+	if nil != err {
+		Ligneous.Error("Error while querying WMS layer ", lyr, ": ", err)
+		sendWMSException(w, version, http.StatusInternalServerError, "", "Unable to query features")
+		return http.StatusInternalServerError
+	}
+	return SendJsonResponseFromInterface(w, r, features)
+}
+
+// serveWMS serves WMS 1.1.1 and 1.3.0 requests of mapnik layers,
+// images are limited to maxSize pixels in width and height.
+func serveWMS(lmp *LayerMultiplex, base string, maxSize int, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	params := ogcParams(r)
+	version := params["VERSION"]
+	if "" == version {
+		version = params["WMTVER"]
+	}
+	version = wmsVersion(version)
+	if 1 > maxSize {
+		maxSize = WMSDefaultMaxSize
+	}
+
+	status := http.StatusBadRequest
+	if service := params["SERVICE"]; "" != service && !strings.EqualFold("WMS", service) {
+		sendWMSException(w, version, status, "", "Unsupported service: "+service)
+	} else {
+		switch strings.ToLower(params["REQUEST"]) {
+		case "getcapabilities", "capabilities":
+			status = SendXMLResponseFromInterface(w, r, newWMSCapabilities(base, version, maxSize, wmsLayers(lmp)))
+		case "getmap", "map":
+			status = serveWMSMap(lmp, params, version, maxSize, w, r)
+		case "getfeatureinfo", "feature_info":
+			status = serveWMSFeatureInfo(lmp, params, version, maxSize, w, r)
+		case "":
+			sendWMSException(w, version, status, "", "Missing REQUEST")
+		default:
+			sendWMSException(w, version, status, "OperationNotSupported", "Unsupported request: "+params["REQUEST"])
+		}
+	}
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
@@ -0,0 +1,438 @@
+package maptiles
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WMTS namespaces and tile matrix sets.
+const (
+	wmtsNamespace       = "http://www.opengis.net/wmts/1.0"
+	owsNamespace        = "http://www.opengis.net/ows/1.1"
+	xlinkNamespace      = "http://www.w3.org/1999/xlink"
+	wmtsMatrixSet       = "GoogleMapsCompatible"
+	wmtsWellKnownScales = "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible"
+	wmtsCRS             = "urn:ogc:def:crs:EPSG::3857"
+	wmtsPixelSize       = 0.00028
+)
+
+// wmtsCapabilities WMTS GetCapabilities document.
+type wmtsCapabilities struct {
+	XMLName               xml.Name                  `xml:"Capabilities"`
+	Xmlns                 string                    `xml:"xmlns,attr"`
+	XmlnsOws              string                    `xml:"xmlns:ows,attr"`
+	XmlnsXlink            string                    `xml:"xmlns:xlink,attr"`
+	Version               string                    `xml:"version,attr"`
+	ServiceIdentification wmtsServiceIdentification `xml:"ows:ServiceIdentification"`
+	Operations            []owsOperation            `xml:"ows:OperationsMetadata>ows:Operation"`
+	Layers                []wmtsLayer               `xml:"Contents>Layer"`
+	TileMatrixSets        []wmtsTileMatrixSet       `xml:"Contents>TileMatrixSet"`
+	ServiceMetadataURL    xlinkHref                 `xml:"ServiceMetadataURL"`
+}
+
+// wmtsServiceIdentification service description.
+type wmtsServiceIdentification struct {
+	Title              string `xml:"ows:Title"`
+	ServiceType        string `xml:"ows:ServiceType"`
+	ServiceTypeVersion string `xml:"ows:ServiceTypeVersion"`
+}
+
+// owsOperation supported operation with its GET url.
+type owsOperation struct {
+	Name string `xml:"name,attr"`
+	Get  owsGet `xml:"ows:DCP>ows:HTTP>ows:Get"`
+}
+
+// owsGet GET url and request encoding of an operation.
+type owsGet struct {
+	Href     string        `xml:"xlink:href,attr"`
+	Encoding owsConstraint `xml:"ows:Constraint"`
+}
+
+// owsConstraint allowed values of a request parameter.
+type owsConstraint struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"ows:AllowedValues>ows:Value"`
+}
+
+// xlinkHref element with a link.
+type xlinkHref struct {
+	Href string `xml:"xlink:href,attr"`
+}
+
+// wmtsLayer tile layer of the capabilities document.
+type wmtsLayer struct {
+	Title             string                `xml:"ows:Title"`
+	Abstract          string                `xml:"ows:Abstract,omitempty"`
+	BoundingBox       owsBoundingBox        `xml:"ows:WGS84BoundingBox"`
+	Identifier        string                `xml:"ows:Identifier"`
+	Style             wmtsStyle             `xml:"Style"`
+	Format            string                `xml:"Format"`
+	TileMatrixSetLink wmtsTileMatrixSetLink `xml:"TileMatrixSetLink"`
+	ResourceURL       wmtsResourceURL       `xml:"ResourceURL"`
+}
+
+// owsBoundingBox lower left and upper right corner.
+type owsBoundingBox struct {
+	LowerCorner string `xml:"ows:LowerCorner"`
+	UpperCorner string `xml:"ows:UpperCorner"`
+}
+
+// wmtsStyle layer style, layers have a single default style.
+type wmtsStyle struct {
+	IsDefault  bool   `xml:"isDefault,attr"`
+	Identifier string `xml:"ows:Identifier"`
+}
+
+// wmtsTileMatrixSetLink tile matrix set and zoom levels of a layer.
+type wmtsTileMatrixSetLink struct {
+	TileMatrixSet string                 `xml:"TileMatrixSet"`
+	Limits        []wmtsTileMatrixLimits `xml:"TileMatrixSetLimits>TileMatrixLimits"`
+}
+
+// wmtsTileMatrixLimits tiles of a layer at a zoom level.
+type wmtsTileMatrixLimits struct {
+	TileMatrix string `xml:"TileMatrix"`
+	MinTileRow uint64 `xml:"MinTileRow"`
+	MaxTileRow uint64 `xml:"MaxTileRow"`
+	MinTileCol uint64 `xml:"MinTileCol"`
+	MaxTileCol uint64 `xml:"MaxTileCol"`
+}
+
+// wmtsResourceURL RESTful tile url template.
+type wmtsResourceURL struct {
+	Format       string `xml:"format,attr"`
+	ResourceType string `xml:"resourceType,attr"`
+	Template     string `xml:"template,attr"`
+}
+
+// wmtsTileMatrixSet Web Mercator zoom levels.
+type wmtsTileMatrixSet struct {
+	Identifier        string           `xml:"ows:Identifier"`
+	SupportedCRS      string           `xml:"ows:SupportedCRS"`
+	WellKnownScaleSet string           `xml:"WellKnownScaleSet,omitempty"`
+	TileMatrices      []wmtsTileMatrix `xml:"TileMatrix"`
+}
+
+// wmtsTileMatrix zoom level.
+type wmtsTileMatrix struct {
+	Identifier       string `xml:"ows:Identifier"`
+	ScaleDenominator string `xml:"ScaleDenominator"`
+	TopLeftCorner    string `xml:"TopLeftCorner"`
+	TileWidth        int    `xml:"TileWidth"`
+	TileHeight       int    `xml:"TileHeight"`
+	MatrixWidth      uint64 `xml:"MatrixWidth"`
+	MatrixHeight     uint64 `xml:"MatrixHeight"`
+}
+
+// owsExceptionReport OGC service error.
+type owsExceptionReport struct {
+	XMLName   xml.Name     `xml:"ows:ExceptionReport"`
+	XmlnsOws  string       `xml:"xmlns:ows,attr"`
+	Version   string       `xml:"version,attr"`
+	Exception owsException `xml:"ows:Exception"`
+}
+
+// owsException error code and message.
+type owsException struct {
+	Code    string `xml:"exceptionCode,attr"`
+	Locator string `xml:"locator,attr,omitempty"`
+	Text    string `xml:"ows:ExceptionText"`
+}
+
+// formatFloat formats float without exponent.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// ogcParams returns query parameters with upper case names,
+// OGC parameter names are case insensitive.
+func ogcParams(r *http.Request) map[string]string {
+	params := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if 0 != len(values) {
+			params[strings.ToUpper(key)] = values[0]
+		}
+	}
+	return params
+}
+
+// wmtsTileMatrixSetName returns tile matrix set of tile size.
+func wmtsTileMatrixSetName(tileSize int) string {
+	if 256 == tileSize {
+		return wmtsMatrixSet
+	}
+	return fmt.Sprintf("%v%v", wmtsMatrixSet, tileSize)
+}
+
+// newWMTSTileMatrixSet creates Web Mercator tile matrix set
+// with zoom levels 0 to maxZoom.
+func newWMTSTileMatrixSet(tileSize int, maxZoom int) wmtsTileMatrixSet {
+	set := wmtsTileMatrixSet{
+		Identifier:   wmtsTileMatrixSetName(tileSize),
+		SupportedCRS: wmtsCRS,
+	}
+	if 256 == tileSize {
+		set.WellKnownScaleSet = wmtsWellKnownScales
+	}
+	for z := 0; z <= maxZoom; z++ {
+		set.TileMatrices = append(set.TileMatrices, wmtsTileMatrix{
+			Identifier:       strconv.Itoa(z),
+			ScaleDenominator: formatFloat(mercatorResolution(z, tileSize) / wmtsPixelSize),
+			TopLeftCorner:    formatFloat(-mercatorExtent) + " " + formatFloat(mercatorExtent),
+			TileWidth:        tileSize,
+			TileHeight:       tileSize,
+			MatrixWidth:      1 << uint(z),
+			MatrixHeight:     1 << uint(z),
+		})
+	}
+	return set
+}
+
+// newWMTSLayer creates capabilities of a tile layer.
+func newWMTSLayer(base string, name string, config LayerConfig) wmtsLayer {
+	layer := wmtsLayer{
+		Title:    name,
+		Abstract: config.Description,
+		BoundingBox: owsBoundingBox{
+			LowerCorner: formatFloat(config.Bounds[0]) + " " + formatFloat(config.Bounds[1]),
+			UpperCorner: formatFloat(config.Bounds[2]) + " " + formatFloat(config.Bounds[3]),
+		},
+		Identifier: name,
+		Style:      wmtsStyle{IsDefault: true, Identifier: "default"},
+		Format:     config.MimeType(),
+		TileMatrixSetLink: wmtsTileMatrixSetLink{
+			TileMatrixSet: wmtsTileMatrixSetName(config.TileSize),
+		},
+		ResourceURL: wmtsResourceURL{
+			Format:       config.MimeType(),
+			ResourceType: "tile",
+			Template:     fmt.Sprintf("%v/wmts/1.0.0/%v/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.%v", base, name, config.Format),
+		},
+	}
+	for z := config.MinZoom; z <= config.MaxZoom; z++ {
+		x0, y0, x1, y1, ok := TileRange(config.Bounds, uint64(z))
+		if !ok {
+			continue
+		}
+		layer.TileMatrixSetLink.Limits = append(layer.TileMatrixSetLink.Limits, wmtsTileMatrixLimits{
+			TileMatrix: strconv.Itoa(z),
+			MinTileRow: y0,
+			MaxTileRow: y1,
+			MinTileCol: x0,
+			MaxTileCol: x1,
+		})
+	}
+	return layer
+}
+
+// newWMTSCapabilities creates capabilities document of tile layers.
+func newWMTSCapabilities(base string, layers map[string]LayerConfig) wmtsCapabilities {
+	kvp := owsConstraint{Name: "GetEncoding", Values: []string{"KVP"}}
+	capabilities := wmtsCapabilities{
+		Xmlns:      wmtsNamespace,
+		XmlnsOws:   owsNamespace,
+		XmlnsXlink: xlinkNamespace,
+		Version:    "1.0.0",
+		ServiceIdentification: wmtsServiceIdentification{
+			Title:              SERVER_NAME + " Web Map Tile Service",
+			ServiceType:        "OGC WMTS",
+			ServiceTypeVersion: "1.0.0",
+		},
+		Operations: []owsOperation{
+			{Name: "GetCapabilities", Get: owsGet{Href: base + "/wmts?", Encoding: kvp}},
+			{Name: "GetTile", Get: owsGet{Href: base + "/wmts?", Encoding: kvp}},
+		},
+		ServiceMetadataURL: xlinkHref{base + "/wmts/1.0.0/WMTSCapabilities.xml"},
+	}
+
+	var names []string
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// max zoom level of each tile matrix set
+	maxZooms := make(map[int]int)
+	for _, name := range names {
+		config := layers[name]
+		capabilities.Layers = append(capabilities.Layers, newWMTSLayer(base, name, config))
+		if maxZoom, ok := maxZooms[config.TileSize]; !ok || config.MaxZoom > maxZoom {
+			maxZooms[config.TileSize] = config.MaxZoom
+		}
+	}
+
+	var sizes []int
+	for size := range maxZooms {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	for _, size := range sizes {
+		capabilities.TileMatrixSets = append(capabilities.TileMatrixSets, newWMTSTileMatrixSet(size, maxZooms[size]))
+	}
+	return capabilities
+}
+
+// sendOWSException sends OGC exception report.
+func sendOWSException(w http.ResponseWriter, r *http.Request, status int, code string, locator string, text string) {
+	report := owsExceptionReport{
+		XmlnsOws:  owsNamespace,
+		Version:   "1.1.0",
+		Exception: owsException{Code: code, Locator: locator, Text: text},
+	}
+	x, err := xml.MarshalIndent(report, "", "  ")
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header + string(x)))
+}
+
+// WMTSCapabilities returns WMTS capabilities document of tile layers.
+func WMTSCapabilities(start time.Time, base string, layers map[string]LayerConfig, w http.ResponseWriter, r *http.Request) {
+	status := SendXMLResponseFromInterface(w, r, newWMTSCapabilities(base, layers))
+	Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+}
+
+// serveWMTSTile serves WMTS GetTile request through the tile cache.
+// format is the requested mime type, empty for any.
+func serveWMTSTile(start time.Time, db TileDb, lmp *LayerMultiplex, lyr, style, set, matrix, row, col, format string, w http.ResponseWriter, r *http.Request) {
+	status := http.StatusBadRequest
+	defer func() {
+		Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+	}()
+
+	if "" == lyr {
+		sendOWSException(w, r, status, "MissingParameterValue", "layer", "Missing layer")
+		return
+	}
+	config, ok := lmp.LayerConfig(lyr)
+	if !ok {
+		sendOWSException(w, r, status, "InvalidParameterValue", "layer", "Unknown layer: "+lyr)
+		return
+	}
+	if "" != style && "default" != style {
+		sendOWSException(w, r, status, "InvalidParameterValue", "style", "Unknown style: "+style)
+		return
+	}
+	if set != wmtsTileMatrixSetName(config.TileSize) {
+		sendOWSException(w, r, status, "InvalidParameterValue", "tilematrixset", "Unknown tile matrix set: "+set)
+		return
+	}
+	if "" != format && format != config.MimeType() {
+		sendOWSException(w, r, status, "InvalidParameterValue", "format", "Unsupported format: "+format)
+		return
+	}
+	z, err := strconv.ParseUint(matrix, 10, 64)
+	if nil != err {
+		sendOWSException(w, r, status, "InvalidParameterValue", "tilematrix", "Invalid tile matrix: "+matrix)
+		return
+	}
+	y, err := strconv.ParseUint(row, 10, 64)
+	if nil != err {
+		sendOWSException(w, r, status, "InvalidParameterValue", "tilerow", "Invalid tile row: "+row)
+		return
+	}
+	x, err := strconv.ParseUint(col, 10, 64)
+	if nil != err {
+		sendOWSException(w, r, status, "InvalidParameterValue", "tilecol", "Invalid tile column: "+col)
+		return
+	}
+	if z < uint64(config.MinZoom) || z > uint64(config.MaxZoom) {
+		sendOWSException(w, r, status, "TileOutOfRange", "tilematrix", "Tile matrix out of range: "+matrix)
+		return
+	}
+	if y >= 1<<z {
+		sendOWSException(w, r, status, "TileOutOfRange", "tilerow", "Tile row out of range: "+row)
+		return
+	}
+	if x >= 1<<z {
+		sendOWSException(w, r, status, "TileOutOfRange", "tilecol", "Tile column out of range: "+col)
+		return
+	}
+
+	result, config, err := fetchTile(db, lmp, TileCoord{X: x, Y: y, Zoom: z, Layer: lyr})
+	if nil != err {
+		status = http.StatusInternalServerError
+		sendOWSException(w, r, status, "NoApplicableCode", "", "Unable to render tile")
+		return
+	}
+
+	blob, err := tileContentEncoding(config, result.BlobPNG, w, r)
+	if nil != err {
+		Ligneous.Error(err)
+		status = http.StatusInternalServerError
+		sendOWSException(w, r, status, "NoApplicableCode", "", "Unable to read tile")
+		return
+	}
+
+	status = http.StatusOK
+	w.Header().Set("Content-Type", config.MimeType())
+	w.WriteHeader(status)
+	if _, err := w.Write(blob); nil != err {
+		Ligneous.Error(err)
+	}
+}
+
+// serveWMTS serves WMTS KVP requests.
+func serveWMTS(db TileDb, lmp *LayerMultiplex, base string, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	params := ogcParams(r)
+	if service := params["SERVICE"]; "" != service && !strings.EqualFold("WMTS", service) {
+		sendOWSException(w, r, http.StatusBadRequest, "InvalidParameterValue", "service", "Unsupported service: "+service)
+		Ligneous.Info(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+		return
+	}
+	switch strings.ToLower(params["REQUEST"]) {
+	case "getcapabilities":
+		WMTSCapabilities(start, base, lmp.LayerConfigs(), w, r)
+	case "gettile":
+		serveWMTSTile(start, db, lmp, params["LAYER"], params["STYLE"], params["TILEMATRIXSET"],
+			params["TILEMATRIX"], params["TILEROW"], params["TILECOL"], params["FORMAT"], w, r)
+	case "":
+		sendOWSException(w, r, http.StatusBadRequest, "MissingParameterValue", "request", "Missing request")
+		Ligneous.Info(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+	default:
+		sendOWSException(w, r, http.StatusBadRequest, "OperationNotSupported", "request", "Unsupported request: "+params["REQUEST"])
+		Ligneous.Info(fmt.Sprintf("%v %v %v [400]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+	}
+}
+
+// serveWMTSCapabilities serves RESTful WMTS capabilities document,
+// limited to one layer if the route has a layer.
+func serveWMTSCapabilities(lmp *LayerMultiplex, base string, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	layers := lmp.LayerConfigs()
+	if lyr, ok := mux.Vars(r)["lyr"]; ok {
+		config, ok := layers[lyr]
+		if !ok {
+			http.Error(w, "layer not found", http.StatusNotFound)
+			Ligneous.Info(fmt.Sprintf("%v %v %v [404]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+			return
+		}
+		layers = map[string]LayerConfig{lyr: config}
+	}
+	WMTSCapabilities(start, base, layers, w, r)
+}
+
+// serveWMTSRestTile serves RESTful WMTS tile requests.
+func serveWMTSRestTile(db TileDb, lmp *LayerMultiplex, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	vars := mux.Vars(r)
+	format, ok := tileFormats[vars["ext"]]
+	if !ok {
+		format = vars["ext"]
+	}
+	serveWMTSTile(start, db, lmp, vars["lyr"], vars["style"], vars["set"],
+		vars["z"], vars["y"], vars["x"], format, w, r)
+}
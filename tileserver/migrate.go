@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+import "maptiles"
+
+// MigrateCache copies layers, metadata, tiles and grids of the configured
+// tile cache into the cache given by -migrate-engine and -migrate-cache.
+// Both caches are closed before it returns, also on errors, so the
+// destination is flushed and the resume point stays valid.
+func MigrateCache() error {
+	src, err := maptiles.NewTileDb(config.Engine, config.Cache)
+	if nil != err {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := maptiles.NewTileDb(migrate_engine, migrate_cache)
+	if nil != err {
+		return err
+	}
+	defer dst.Close()
+
+	maptiles.Ligneous.Info(fmt.Sprintf("Migrating %v tile cache to %v", config.Engine, migrate_engine))
+
+	migration := maptiles.CacheMigration{
+		Src:       src,
+		Dst:       dst,
+		BatchSize: migrate_batch,
+		StateFile: migrate_state,
+	}
+	if "" != migrate_layers {
+		migration.Layers = strings.Split(migrate_layers, ",")
+	}
+
+	return migration.Run()
+}
+
+// migrateCommand migrates the tile cache to another database.
+func migrateCommand(args []string) {
+	flags := newFlagSet("migrate")
+	migrateFlags(flags, "")
+	flags.Parse(args)
+	getConfig()
+	if "" == migrate_cache {
+		exitOnError(fmt.Errorf("Missing -cache of the target database"))
+	}
+	exitOnError(MigrateCache())
+	maptiles.Ligneous.Flush()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import "maptiles"
+
+// reloadLock serializes config reloads.
+var reloadLock sync.Mutex
+
+// layerServer tile server with layers loaded from the config file.
+type layerServer interface {
+	LoadLayers(layers map[string]maptiles.LayerConfig, prune bool) error
+	DeleteMapnikLayer(layerName string, purge bool) error
+}
+
+// ReloadSummary tile layer changes made by a config reload.
+type ReloadSummary struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+}
+
+// diffLayers compares tile layers of two configs.
+func diffLayers(old, new map[string]maptiles.LayerConfig) ReloadSummary {
+	summary := ReloadSummary{Added: []string{}, Removed: []string{}, Updated: []string{}}
+	for name, layer := range new {
+		current, ok := old[name]
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, name)
+		case !reflect.DeepEqual(current, layer):
+			summary.Updated = append(summary.Updated, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			summary.Removed = append(summary.Removed, name)
+		}
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Updated)
+	return summary
+}
+
+// reloadConfig re-reads the config file and applies its tile layers.
+// Layers removed from the config are removed from the server, their
+// cached tiles are deleted if prune_layers is set. Renderers of changed
+// layers are replaced, requests already submitted to them are finished.
+// Cache, engine, port, pool and service settings need a restart.
+func reloadConfig(server layerServer) (ReloadSummary, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	newConfig, err := loadConfig(config_file)
+	if nil != err {
+		return ReloadSummary{}, err
+	}
+
+	if newConfig.Cache != config.Cache || newConfig.Engine != config.Engine ||
+		newConfig.Port != config.Port || newConfig.Pool != config.Pool || newConfig.Scheme != config.Scheme ||
+		newConfig.PublicURL != config.PublicURL || newConfig.WMSMaxSize != config.WMSMaxSize ||
+		!reflect.DeepEqual(newConfig.MarkerIcons, config.MarkerIcons) {
+		maptiles.Ligneous.Warn("Cache, engine, port, pool, scheme, public_url, wms_max_size and marker_icons changes require a restart")
+	}
+
+	summary := diffLayers(config.Layers, newConfig.Layers)
+	for _, name := range summary.Removed {
+		err := server.DeleteMapnikLayer(name, newConfig.PruneLayers)
+		if nil != err && maptiles.ErrLayerNotFound != err {
+			return summary, err
+		}
+	}
+
+	// removed layers are gone from the config from now on,
+	// even if loading the remaining layers fails
+	config.Layers = newConfig.Layers
+	config.PruneLayers = newConfig.PruneLayers
+
+	err = server.LoadLayers(newConfig.Layers, newConfig.PruneLayers)
+	if nil != err {
+		return summary, err
+	}
+
+	maptiles.Ligneous.Info(fmt.Sprintf("Config reloaded: added %v, removed %v, updated %v", summary.Added, summary.Removed, summary.Updated))
+	return summary, nil
+}
+
+// watchReload reloads the config file on SIGHUP.
+func watchReload(server layerServer) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			maptiles.Ligneous.Info("Reloading config: ", config_file)
+			if _, err := reloadConfig(server); nil != err {
+				maptiles.Ligneous.Error("Unable to reload config: ", err)
+			}
+		}
+	}()
+}
+
+// reloadHandler reloads the config file.
+func reloadHandler(server layerServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		summary, err := reloadConfig(server)
+		if nil != err {
+			maptiles.Ligneous.Error("Unable to reload config: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			maptiles.Ligneous.Error(fmt.Sprintf("%v %v %v [500]", r.RemoteAddr, r.URL.Path, time.Since(start)))
+			return
+		}
+		response := make(map[string]interface{})
+		response["status"] = "ok"
+		response["data"] = summary
+		status := maptiles.SendJsonResponseFromInterface(w, r, response)
+		maptiles.Ligneous.Info(fmt.Sprintf("%v %v %v [%v]", r.RemoteAddr, r.URL.Path, time.Since(start), status))
+	}
+}
@@ -0,0 +1,132 @@
+package stitch
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrTileNotFound is returned for tiles missing in a tile source.
+var ErrTileNotFound = errors.New("Tile not found")
+
+// SourceFunc adapts a function to a TileSource.
+type SourceFunc func(zoom, x, y int) ([]byte, error)
+
+// Tile calls the function.
+func (self SourceFunc) Tile(zoom, x, y int) ([]byte, error) {
+	return self(zoom, x, y)
+}
+
+// URLSource gets tiles from a tile server. Template has {z}, {x} and {y},
+// or {-y} for TMS rows, and optionally {s} for the a, b and c subdomains.
+type URLSource struct {
+	Template string
+	Client   *http.Client
+	Headers  map[string]string
+}
+
+// NewURLSource creates URLSource with a 30 second timeout.
+func NewURLSource(template string) *URLSource {
+	return &URLSource{
+		Template: template,
+		Client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Tile gets tile from the tile server.
+func (self *URLSource) Tile(zoom, x, y int) ([]byte, error) {
+	url := strings.NewReplacer(
+		"{z}", strconv.Itoa(zoom),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+		"{-y}", strconv.Itoa(1<<uint(zoom)-y-1),
+		"{s}", []string{"a", "b", "c"}[rand.Intn(3)],
+	).Replace(self.Template)
+	req, err := http.NewRequest("GET", url, nil)
+	if nil != err {
+		return nil, err
+	}
+	for k, v := range self.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := self.Client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	blob, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusNotFound == resp.StatusCode {
+		return nil, ErrTileNotFound
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return blob, nil
+}
+
+// MBTilesSource reads tiles from an MBTiles file or from a layer of the
+// sqlite tile cache of the tile server.
+type MBTilesSource struct {
+	db    *sql.DB
+	query string
+	args  []interface{}
+}
+
+// OpenMBTiles opens MBTiles file. Layer selects a tile layer of a tile
+// cache file and is ignored for plain MBTiles files.
+func OpenMBTiles(path string, layer string) (*MBTilesSource, error) {
+	db, err := sql.Open("sqlite3", path)
+	if nil != err {
+		return nil, err
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='layers'").Scan(&count)
+	if nil != err {
+		db.Close()
+		return nil, err
+	}
+	src := &MBTilesSource{db: db, query: "SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?"}
+	if 0 != count {
+		if "" == layer {
+			db.Close()
+			return nil, errors.New("Tile cache needs a tile layer")
+		}
+		src.query = `
+			SELECT tile_data
+			FROM tiles
+			JOIN layers ON tiles.layer_id = layers.rowid
+			WHERE zoom_level=?
+				AND tile_column=?
+				AND tile_row=?
+				AND layers.layer_name=?`
+		src.args = []interface{}{layer}
+	}
+	return src, nil
+}
+
+// Tile reads tile, rows are stored in TMS numbering.
+func (self *MBTilesSource) Tile(zoom, x, y int) ([]byte, error) {
+	var blob []byte
+	args := append([]interface{}{zoom, x, 1<<uint(zoom) - y - 1}, self.args...)
+	err := self.db.QueryRow(self.query, args...).Scan(&blob)
+	if sql.ErrNoRows == err {
+		return nil, ErrTileNotFound
+	}
+	return blob, err
+}
+
+// Close closes the MBTiles file.
+func (self *MBTilesSource) Close() error {
+	return self.db.Close()
+}
@@ -0,0 +1,240 @@
+// Package stitch composites map tiles of a bounding box into one image.
+// Tiles are drawn straight into the output image as they arrive, so memory
+// use is bounded by the size of the output rather than by the number of tiles.
+package stitch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"time"
+)
+
+import "georef"
+
+// mercatorExtent half width of the Web Mercator world in meters.
+const mercatorExtent = 20037508.342789244
+
+// maxLat latitude limit of Web Mercator tiles.
+const maxLat = 85.0511287798
+
+// DefaultMaxPixels limits stitched images to 16384 x 16384 pixels,
+// 1 GiB in memory.
+const DefaultMaxPixels = 1 << 28
+
+// DefaultPlaceholder fills tiles that could not be fetched.
+var DefaultPlaceholder = image.NewUniform(color.NRGBA{0xdd, 0xdd, 0xdd, 0xff})
+
+// TileSource provides encoded png or jpeg tiles in XYZ numbering.
+// Tile is called from several goroutines at once.
+type TileSource interface {
+	Tile(zoom, x, y int) ([]byte, error)
+}
+
+// Options settings of a stitched image. Bounds are west, south, east,
+// north in degrees, the image is cropped to them exactly. Bounds larger
+// than MaxPixels pixels at the zoom level are rejected, 0 is no limit.
+type Options struct {
+	Bounds      [4]float64
+	Zoom        int
+	TileSize    int
+	Workers     int
+	Retries     int
+	MaxPixels   int64
+	Placeholder image.Image
+}
+
+// NewOptions creates Options with default values.
+func NewOptions(bounds [4]float64, zoom int) Options {
+	return Options{
+		Bounds:      bounds,
+		Zoom:        zoom,
+		TileSize:    256,
+		Workers:     8,
+		Retries:     3,
+		MaxPixels:   DefaultMaxPixels,
+		Placeholder: DefaultPlaceholder,
+	}
+}
+
+// Stats counts fetched and missing tiles.
+type Stats struct {
+	Tiles   int
+	Missing int
+}
+
+// Tile a fetched and decoded tile.
+type Tile struct {
+	Zoom, X, Y int
+	Image      image.Image
+	Err        error
+}
+
+// worldPixel converts lon, lat to world pixel at zoom for tiles of tileSize.
+func worldPixel(lon, lat float64, zoom int, tileSize int) (float64, float64) {
+	lat = math.Max(math.Min(lat, maxLat), -maxLat)
+	mx := lon * mercatorExtent / 180
+	my := math.Log(math.Tan((90+lat)*math.Pi/360)) * mercatorExtent / math.Pi
+	res := 2 * mercatorExtent / (float64(tileSize) * math.Pow(2, float64(zoom)))
+	return (mx + mercatorExtent) / res, (mercatorExtent - my) / res
+}
+
+// PixelBounds returns the pixel rectangle of bounds in the world image at
+// the zoom level of options.
+func (self Options) PixelBounds() image.Rectangle {
+	x0, y0 := worldPixel(self.Bounds[0], self.Bounds[3], self.Zoom, self.TileSize)
+	x1, y1 := worldPixel(self.Bounds[2], self.Bounds[1], self.Zoom, self.TileSize)
+	return image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x1)), int(math.Ceil(y1)))
+}
+
+// Georeference returns Web Mercator georeference of stitched images.
+func (self Options) Georeference() georef.Georeference {
+	r := self.PixelBounds()
+	res := 2 * mercatorExtent / (float64(self.TileSize) * math.Pow(2, float64(self.Zoom)))
+	return georef.Georeference{
+		SRID: georef.WebMercator,
+		Bounds: [4]float64{
+			float64(r.Min.X)*res - mercatorExtent,
+			mercatorExtent - float64(r.Max.Y)*res,
+			float64(r.Max.X)*res - mercatorExtent,
+			mercatorExtent - float64(r.Min.Y)*res,
+		},
+		Width:  r.Dx(),
+		Height: r.Dy(),
+	}
+}
+
+// validate checks options.
+func (self Options) validate() error {
+	west, south, east, north := self.Bounds[0], self.Bounds[1], self.Bounds[2], self.Bounds[3]
+	if west < -180 || east > 180 || south < -90 || north > 90 || west >= east || south >= north {
+		return fmt.Errorf("Invalid bounds: %v", self.Bounds)
+	}
+	if self.Zoom < 0 || self.Zoom > 30 {
+		return fmt.Errorf("Invalid zoom level: %v", self.Zoom)
+	}
+	if self.TileSize < 1 {
+		return fmt.Errorf("Invalid tile size: %v", self.TileSize)
+	}
+	// computed in floating point, the pixel count overflows at high zoom levels
+	r := self.PixelBounds()
+	if pixels := float64(r.Dx()) * float64(r.Dy()); 0 != self.MaxPixels && pixels > float64(self.MaxPixels) {
+		return fmt.Errorf("Image of %v x %v pixels exceeds the limit of %v pixels, use a lower zoom level or smaller bounds", r.Dx(), r.Dy(), self.MaxPixels)
+	}
+	return nil
+}
+
+// tileRange returns the tiles covering the pixel rectangle.
+func (self Options) tileRange(r image.Rectangle) (x0, y0, x1, y1 int) {
+	max := 1<<uint(self.Zoom) - 1
+	clamp := func(v int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	size := self.TileSize
+	return clamp(r.Min.X / size), clamp(r.Min.Y / size), clamp((r.Max.X - 1) / size), clamp((r.Max.Y - 1) / size)
+}
+
+// fetchTile gets tile from source, retrying failed requests
+// with increasing delays.
+func fetchTile(src TileSource, zoom, x, y, retries int) (image.Image, error) {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if 0 != attempt {
+			time.Sleep(time.Duration(attempt*attempt) * 100 * time.Millisecond)
+		}
+		var blob []byte
+		blob, err = src.Tile(zoom, x, y)
+		if ErrTileNotFound == err {
+			return nil, err
+		}
+		if nil != err {
+			continue
+		}
+		if 0 == len(blob) {
+			return nil, errors.New("Empty tile")
+		}
+		// broken images are not retried
+		img, _, err := image.Decode(bytes.NewReader(blob))
+		return img, err
+	}
+	return nil, err
+}
+
+// Fetch fetches the tiles within bounds concurrently and calls fn with
+// each of them, including tiles that failed, from a single goroutine.
+func Fetch(src TileSource, opts Options, fn func(Tile)) (Stats, error) {
+	stats := Stats{}
+	if err := opts.validate(); nil != err {
+		return stats, err
+	}
+	x0, y0, x1, y1 := opts.tileRange(opts.PixelBounds())
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	coords := make(chan [2]int)
+	tiles := make(chan Tile)
+	go func() {
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				coords <- [2]int{x, y}
+			}
+		}
+		close(coords)
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for c := range coords {
+				img, err := fetchTile(src, opts.Zoom, c[0], c[1], opts.Retries)
+				tiles <- Tile{Zoom: opts.Zoom, X: c[0], Y: c[1], Image: img, Err: err}
+			}
+		}()
+	}
+
+	total := (x1 - x0 + 1) * (y1 - y0 + 1)
+	for i := 0; i < total; i++ {
+		tile := <-tiles
+		stats.Tiles++
+		if nil != tile.Err {
+			stats.Missing++
+		}
+		fn(tile)
+	}
+	return stats, nil
+}
+
+// Stitch composites the tiles within bounds into an image cropped to
+// bounds. Missing tiles are filled with the placeholder of options,
+// left transparent if it is nil.
+func Stitch(src TileSource, opts Options) (*image.RGBA, Stats, error) {
+	if err := opts.validate(); nil != err {
+		return nil, Stats{}, err
+	}
+	bounds := opts.PixelBounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	size := opts.TileSize
+	stats, err := Fetch(src, opts, func(tile Tile) {
+		r := image.Rect(tile.X*size, tile.Y*size, (tile.X+1)*size, (tile.Y+1)*size).Sub(bounds.Min)
+		if nil != tile.Err {
+			if nil != opts.Placeholder {
+				draw.Draw(img, r, opts.Placeholder, opts.Placeholder.Bounds().Min, draw.Src)
+			}
+			return
+		}
+		draw.Draw(img, r, tile.Image, tile.Image.Bounds().Min, draw.Src)
+	})
+	return img, stats, err
+}
@@ -0,0 +1,27 @@
+package stitch
+
+import (
+	"testing"
+)
+
+func TestStitchMaxPixels(t *testing.T) {
+	src := SourceFunc(func(zoom, x, y int) ([]byte, error) {
+		t.Fatalf("Tile %v/%v/%v fetched", zoom, x, y)
+		return nil, nil
+	})
+	// the stitch command defaults at zoom 16, about 2e13 pixels
+	opts := NewOptions([4]float64{-175, -85, 175, 85}, 16)
+	if _, _, err := Stitch(src, opts); nil == err {
+		t.Error("Image larger than MaxPixels stitched")
+	}
+
+	opts.MaxPixels = 0
+	if err := opts.validate(); nil != err {
+		t.Errorf("Without limit: %v", err)
+	}
+	opts.Zoom = 3
+	opts.MaxPixels = DefaultMaxPixels
+	if err := opts.validate(); nil != err {
+		t.Errorf("Zoom 3: %v", err)
+	}
+}